@@ -0,0 +1,78 @@
+// Package filter implements the expression language used to filter the messages delivered to a
+// subscriber.
+//
+// An expression compares operands with one of the operators ==, !=, startsWith, endsWith or
+// contains, and combines comparisons with &&, ||, ! and parentheses, e.g.
+//
+//	headers.region == "eu" && key startsWith "cust-"
+//
+// Operands are the message key (key), a header (headers.name, or headers["name"] for names that
+// aren't identifiers) or a double-quoted string literal. A missing header compares as the empty
+// string. Evaluation is linear in the size of the expression, which is itself bounded.
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// Maximum length of an expression, in bytes.
+	maxExpressionLength = 1024
+	// Maximum nesting of parentheses and negations.
+	maxDepth = 32
+)
+
+// Filter matches messages against a parsed expression. The zero Filter matches every message.
+type Filter struct {
+	root node
+	// The expression parsed, without surrounding whitespace.
+	expression string
+}
+
+// Parse the expression into a Filter. An empty expression gives a Filter matching every message.
+func Parse(expression string) (Filter, error) {
+	if len(expression) > maxExpressionLength {
+		return Filter{}, SyntaxError{Message: fmt.Sprintf("expression longer than %d bytes", maxExpressionLength)}
+	}
+	if strings.TrimSpace(expression) == "" {
+		return Filter{}, nil
+	}
+
+	tokens, err := lex(expression)
+	if err != nil {
+		return Filter{}, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr(0)
+	if err != nil {
+		return Filter{}, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return Filter{}, SyntaxError{Position: tok.position, Message: fmt.Sprintf("unexpected %s", tok)}
+	}
+	return Filter{root: root, expression: strings.TrimSpace(expression)}, nil
+}
+
+// The expression the Filter was parsed from, without surrounding whitespace.
+func (f Filter) String() string {
+	return f.expression
+}
+
+// Match reports whether a message with the given key and headers passes the filter.
+func (f Filter) Match(key string, headers map[string]string) bool {
+	if f.root == nil {
+		return true
+	}
+	return f.root.eval(key, headers)
+}
+
+type SyntaxError struct {
+	// Byte offset into the expression at which the error was found.
+	Position int
+	Message  string
+}
+
+func (e SyntaxError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Position, e.Message)
+}
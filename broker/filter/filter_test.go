@@ -0,0 +1,171 @@
+package filter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	headers := map[string]string{"region": "eu", "tier": "gold", "content-type": "json"}
+	for _, test := range []struct {
+		expression string
+		key        string
+		want       bool
+	}{
+		{expression: "", want: true},
+		{expression: "  ", want: true},
+		{expression: `key == "cust-1"`, key: "cust-1", want: true},
+		{expression: `key != "cust-1"`, key: "cust-1", want: false},
+		{expression: `key startsWith "cust-"`, key: "cust-1", want: true},
+		{expression: `key endsWith "-1"`, key: "cust-1", want: true},
+		{expression: `key contains "st-"`, key: "cust-1", want: true},
+		{expression: `"cust-1" == key`, key: "cust-1", want: true},
+		{expression: `headers.region == "eu"`, want: true},
+		{expression: `headers["content-type"] == "json"`, want: true},
+		{expression: `headers.content-type == "json"`, want: true},
+		{expression: `headers.missing == ""`, want: true},
+		{expression: `headers.region == headers.tier`, want: false},
+		{expression: `"a\"b" == "a\"b"`, want: true},
+
+		// && binds more tightly than ||, and ! more tightly than both.
+		{expression: `headers.region == "us" && headers.tier == "gold" || key == "k"`, key: "k", want: true},
+		{expression: `key == "k" || headers.region == "us" && headers.tier == "gold"`, key: "k", want: true},
+		{expression: `(key == "k" || headers.region == "us") && headers.tier == "silver"`, key: "k", want: false},
+		{expression: `!headers.region == "us" && headers.tier == "gold"`, want: true},
+		{expression: `!(headers.region == "eu" && headers.tier == "silver")`, want: true},
+		{expression: `!(headers.region == "eu" || headers.tier == "silver")`, want: false},
+		{expression: `!!(headers.region == "eu")`, want: true},
+		{expression: `key == "a" || key == "b" || key == "c"`, key: "c", want: true},
+		{expression: `key != "a" && key != "b" && key != "c"`, key: "c", want: false},
+	} {
+		f, err := Parse(test.expression)
+		if err != nil {
+			t.Errorf("parsing %s: %v", test.expression, err)
+			continue
+		}
+		if got := f.Match(test.key, headers); got != test.want {
+			t.Errorf("%s matched key %q: got %t, want %t", test.expression, test.key, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		position   int
+	}{
+		{expression: `key`, position: 3},
+		{expression: `key ==`, position: 6},
+		{expression: `key = "a"`, position: 4},
+		{expression: `key is "a"`, position: 4},
+		{expression: `key "a" "b"`, position: 4},
+		{expression: `value == "a"`, position: 0},
+		{expression: `== "a"`, position: 0},
+		{expression: `key == "a" &&`, position: 13},
+		{expression: `key == "a" || || key == "b"`, position: 14},
+		{expression: `key == "a" key == "b"`, position: 11},
+		{expression: `(key == "a"`, position: 11},
+		{expression: `key == "a")`, position: 10},
+		{expression: `()`, position: 1},
+		{expression: `!`, position: 1},
+		{expression: `headers`, position: 7},
+		{expression: `headers. == "a"`, position: 9},
+		{expression: `headers.region.tier == "a"`, position: 14},
+		{expression: `headers[region] == "a"`, position: 8},
+		{expression: `headers["region" == "a"`, position: 17},
+		{expression: `key == "a`, position: 7},
+		{expression: `key == "\q"`, position: 7},
+		{expression: `key == 'a'`, position: 7},
+		{expression: `key & "a"`, position: 4},
+		{expression: `key == "a" ; key == "b"`, position: 11},
+	} {
+		_, err := Parse(test.expression)
+		var syntaxErr SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("parsing %s: got %v, want a syntax error", test.expression, err)
+			continue
+		}
+		if syntaxErr.Position != test.position {
+			t.Errorf("parsing %s: got %v, want position %d", test.expression, err, test.position)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	comparison := `key == "a"`
+
+	long := comparison + strings.Repeat(" ", maxExpressionLength-len(comparison))
+	if _, err := Parse(long); err != nil {
+		t.Errorf("parsing an expression of %d bytes: %v", len(long), err)
+	}
+	if _, err := Parse(long + " "); err == nil {
+		t.Errorf("parsed an expression of %d bytes", len(long)+1)
+	}
+
+	nestNots := func(depth int) string { return strings.Repeat("!", depth) + comparison }
+	nestParens := func(depth int) string {
+		return strings.Repeat("(", depth) + comparison + strings.Repeat(")", depth)
+	}
+	for _, nest := range []func(depth int) string{nestNots, nestParens} {
+		if _, err := Parse(nest(maxDepth)); err != nil {
+			t.Errorf("parsing %s nested %d deep: %v", nest(maxDepth), maxDepth, err)
+		}
+		if _, err := Parse(nest(maxDepth + 1)); err == nil {
+			t.Errorf("parsed %s nested deeper than %d", nest(maxDepth+1), maxDepth)
+		}
+	}
+	// Negations and parentheses count towards the same depth.
+	if _, err := Parse("!" + nestParens(maxDepth)); err == nil {
+		t.Errorf("parsed a negation of parentheses nested %d deep", maxDepth)
+	}
+}
+
+func TestString(t *testing.T) {
+	f, err := Parse(" \tkey == \"a\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.String(), `key == "a"`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := (Filter{}).String(); got != "" {
+		t.Errorf("got %q for the zero Filter, want an empty string", got)
+	}
+}
+
+// Parsing never panics, rejects expressions with syntax errors, and filters parse the same from
+// their own String.
+func FuzzParse(f *testing.F) {
+	for _, expression := range []string{
+		`headers.region == "eu" && key startsWith "cust-"`,
+		`!(key == "a" || headers["content-type"] contains "json")`,
+		`((key != "é"))`,
+		`key ==`,
+		`"unterminated`,
+	} {
+		f.Add(expression, "cust-1", "eu")
+	}
+	f.Fuzz(func(t *testing.T, expression, key, region string) {
+		filter, err := Parse(expression)
+		if err != nil {
+			var syntaxErr SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("parsing %q: got %v, want a syntax error", expression, err)
+			}
+			if syntaxErr.Position < 0 || syntaxErr.Position > len(expression) {
+				t.Fatalf("parsing %q: %v is outside the expression", expression, err)
+			}
+			return
+		}
+
+		headers := map[string]string{"region": region}
+		reparsed, err := Parse(filter.String())
+		if err != nil {
+			t.Fatalf("parsing %q from %q: %v", filter.String(), expression, err)
+		}
+		if reparsed.Match(key, headers) != filter.Match(key, headers) {
+			t.Fatalf("%q and %q differ matching key %q", expression, filter.String(), key)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenDot
+	tokenLBracket
+	tokenRBracket
+	tokenLParen
+	tokenRParen
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenEqual
+	tokenNotEqual
+)
+
+type token struct {
+	kind     tokenKind
+	value    string
+	position int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.value)
+	default:
+		return fmt.Sprintf("%q", t.value)
+	}
+}
+
+var symbolTokens = []struct {
+	symbol string
+	kind   tokenKind
+}{
+	// Two character symbols come first, so they're preferred over their one character prefixes.
+	{symbol: "&&", kind: tokenAnd},
+	{symbol: "||", kind: tokenOr},
+	{symbol: "==", kind: tokenEqual},
+	{symbol: "!=", kind: tokenNotEqual},
+	{symbol: "!", kind: tokenNot},
+	{symbol: ".", kind: tokenDot},
+	{symbol: "[", kind: tokenLBracket},
+	{symbol: "]", kind: tokenRBracket},
+	{symbol: "(", kind: tokenLParen},
+	{symbol: ")", kind: tokenRParen},
+}
+
+func lex(expression string) ([]token, error) {
+	var tokens []token
+	i := 0
+tokenLoop:
+	for i < len(expression) {
+		r, size := utf8.DecodeRuneInString(expression[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			continue
+		case r == '"':
+			value, length, err := lexString(expression[i:])
+			if err != nil {
+				return nil, SyntaxError{Position: i, Message: err.Error()}
+			}
+			tokens = append(tokens, token{kind: tokenString, value: value, position: i})
+			i += length
+			continue
+		case isIdentStart(r):
+			start := i
+			for i < len(expression) {
+				r, size := utf8.DecodeRuneInString(expression[i:])
+				if !isIdentPart(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, token{kind: tokenIdent, value: expression[start:i], position: start})
+			continue
+		}
+
+		for _, symbolToken := range symbolTokens {
+			if strings.HasPrefix(expression[i:], symbolToken.symbol) {
+				tokens = append(tokens, token{kind: symbolToken.kind, value: symbolToken.symbol, position: i})
+				i += len(symbolToken.symbol)
+				continue tokenLoop
+			}
+		}
+		return nil, SyntaxError{Position: i, Message: fmt.Sprintf("unexpected character %q", r)}
+	}
+	return append(tokens, token{kind: tokenEOF, position: len(expression)}), nil
+}
+
+// Lex the double-quoted string literal at the start of s, returning its unquoted value and the
+// length of the literal.
+func lexString(s string) (string, int, error) {
+	escaped := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			value, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string literal %s", s[:i+1])
+			}
+			return value, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string literal")
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentPart(r rune) bool {
+	return r == '_' || r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,212 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+type node interface {
+	eval(key string, headers map[string]string) bool
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(key string, headers map[string]string) bool {
+	return n.left.eval(key, headers) && n.right.eval(key, headers)
+}
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(key string, headers map[string]string) bool {
+	return n.left.eval(key, headers) || n.right.eval(key, headers)
+}
+
+type notNode struct{ operand node }
+
+func (n notNode) eval(key string, headers map[string]string) bool {
+	return !n.operand.eval(key, headers)
+}
+
+type comparisonNode struct {
+	left, right operand
+	compare     func(left, right string) bool
+}
+
+func (n comparisonNode) eval(key string, headers map[string]string) bool {
+	return n.compare(n.left.value(key, headers), n.right.value(key, headers))
+}
+
+var comparisons = map[string]func(left, right string) bool{
+	"==":         func(left, right string) bool { return left == right },
+	"!=":         func(left, right string) bool { return left != right },
+	"startsWith": strings.HasPrefix,
+	"endsWith":   strings.HasSuffix,
+	"contains":   strings.Contains,
+}
+
+type operand struct {
+	kind operandKind
+	// The header name for header operands, or the value for literals.
+	text string
+}
+
+type operandKind int
+
+const (
+	operandKey operandKind = iota
+	operandHeader
+	operandLiteral
+)
+
+func (o operand) value(key string, headers map[string]string) string {
+	switch o.kind {
+	case operandKey:
+		return key
+	case operandHeader:
+		return headers[o.text]
+	default:
+		return o.text
+	}
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) expect(kind tokenKind, description string) (token, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		return tok, SyntaxError{Position: tok.position, Message: fmt.Sprintf("expected %s, got %s", description, tok)}
+	}
+	return tok, nil
+}
+
+func (p *parser) parseOr(depth int) (node, error) {
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		p.next()
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd(depth int) (node, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenAnd {
+		p.next()
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary(depth int) (node, error) {
+	if depth > maxDepth {
+		return nil, SyntaxError{Position: p.peek().position, Message: fmt.Sprintf("expression nested deeper than %d", maxDepth)}
+	}
+
+	switch p.peek().kind {
+	case tokenNot:
+		p.next()
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	case tokenLParen:
+		p.next()
+		expr, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	default:
+		return p.parseComparison()
+	}
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.next()
+	compare, ok := comparisons[tok.value]
+	if !ok || tok.kind == tokenString {
+		return nil, SyntaxError{Position: tok.position, Message: fmt.Sprintf("expected comparison operator, got %s", tok)}
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return comparisonNode{left: left, right: right, compare: compare}, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokenString:
+		return operand{kind: operandLiteral, text: tok.value}, nil
+	case tok.kind == tokenIdent && tok.value == "key":
+		return operand{kind: operandKey}, nil
+	case tok.kind == tokenIdent && tok.value == "headers":
+		return p.parseHeader()
+	default:
+		return operand{}, SyntaxError{Position: tok.position, Message: fmt.Sprintf("expected key, header or string, got %s", tok)}
+	}
+}
+
+// Parse the remainder of a header operand following "headers", either .name or ["name"].
+func (p *parser) parseHeader() (operand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenDot:
+		name, err := p.expect(tokenIdent, "header name")
+		if err != nil {
+			return operand{}, err
+		}
+		return operand{kind: operandHeader, text: name.value}, nil
+	case tokenLBracket:
+		name, err := p.expect(tokenString, "quoted header name")
+		if err != nil {
+			return operand{}, err
+		}
+		if _, err := p.expect(tokenRBracket, `"]"`); err != nil {
+			return operand{}, err
+		}
+		return operand{kind: operandHeader, text: name.value}, nil
+	default:
+		return operand{}, SyntaxError{Position: tok.position, Message: fmt.Sprintf(`expected "." or "[" after headers, got %s`, tok)}
+	}
+}
@@ -0,0 +1,64 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	brokerpb "pubsub/broker/proto/broker"
+	commonerrors "pubsub/common/errors"
+)
+
+func (s Server) Acknowledge(ctx context.Context, request *brokerpb.AcknowledgeRequest) (*emptypb.Empty, error) {
+	if err := s.validateAcknowledgeRequest(request); err != nil {
+		return nil, fmt.Errorf("acknowledging: %w", err)
+	}
+
+	if err := s.svc.Acknowledge(request.GetSubscriberId(), s.convertToMessageIDs(request.GetMessageIds()...)...); err != nil {
+		return nil, fmt.Errorf("acknowledging: %w", err)
+	}
+	return nil, nil
+}
+
+func (Server) validateAcknowledgeRequest(request *brokerpb.AcknowledgeRequest) error {
+	violations := []commonerrors.FieldViolation{}
+	if !request.HasSubscriberId() {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:  "subscriber_id",
+			Reason: "REQUIRED_FIELD",
+		})
+	}
+	if len(request.GetMessageIds()) == 0 {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       "message_ids",
+			Reason:      "BELOW_MIN_LENGTH",
+			Description: "Minimum length 1",
+		})
+	}
+	for i, messageID := range request.GetMessageIds() {
+		if !messageID.HasTopic() {
+			violations = append(violations, commonerrors.FieldViolation{
+				Field:  fmt.Sprintf("message_ids[%d].topic", i),
+				Reason: "REQUIRED_FIELD",
+			})
+		}
+		if !messageID.HasPartition() {
+			violations = append(violations, commonerrors.FieldViolation{
+				Field:  fmt.Sprintf("message_ids[%d].partition", i),
+				Reason: "REQUIRED_FIELD",
+			})
+		}
+		if !messageID.HasOffset() {
+			violations = append(violations, commonerrors.FieldViolation{
+				Field:  fmt.Sprintf("message_ids[%d].offset", i),
+				Reason: "REQUIRED_FIELD",
+			})
+		}
+	}
+
+	if len(violations) != 0 {
+		return commonerrors.NewInvalidArgument("invalid acknowledge request", violations...)
+	}
+	return nil
+}
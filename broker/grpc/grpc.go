@@ -1,22 +1,74 @@
 package grpc
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
 	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/broker/schema"
 	"pubsub/broker/svc"
 
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+const (
+	defaultMaxMessageSize  = 1 << 20
+	defaultMaxRequestSize  = 4 << 20
+	defaultMaxResponseSize = 4 << 20
+	// The most bytes a message can take in a PollResponse beyond its size as published, besides
+	// its topic's name: its field of the response, and its ID, timestamp, priority and retain flag.
+	polledMessageOverhead = 64
+)
+
 type Server struct {
 	brokerpb.UnimplementedBrokerServer
 
-	svc svc.Broker
+	svc               *svc.Broker
+	maxMessageSize    int
+	maxRequestSize    int
+	maxResponseSize   int
+	schemaRegistrants []string
+}
+
+type Options struct {
+	// The largest a published message can be, in bytes as encoded. Defaults to 1MiB.
+	MaxMessageSize int
+	// The largest a request can be, in bytes as encoded, which should match the gRPC server's
+	// maximum receive message size. Defaults to gRPC's 4MiB.
+	MaxRequestSize int
+	// The largest a response can be, in bytes as encoded, which should match the gRPC server's
+	// maximum send message size. Polls return at most this many bytes of messages. Defaults to
+	// 4MiB, the most gRPC clients receive by default.
+	MaxResponseSize int
+	// Schemas registered when the Server is created, in order, so each subject's versions are
+	// listed oldest first.
+	Schemas []Schema
+	// The IDs of the clients allowed to register schemas with the RegisterSchema RPC, as given with
+	// identity.UnaryClientInterceptor. An empty list allows every client.
+	SchemaRegistrants []string
 }
 
 type Topic struct {
 	Name               string
 	NumberOfPartitions int
 	PartitionStrategy  PartitionStrategy
+	// The key each partition after the first starts from, for KeyRangePartition.
+	KeySplitPoints []string
+	MessageTTL     time.Duration
+	RetainPerKey   bool
+	SchemaSubject  string
+	// The largest a message published to the topic can be, in bytes as encoded, which can't exceed
+	// the Server's MaxMessageSize. Defaults to the Server's.
+	MaxMessageSize    int
+	CleanupPolicy     CleanupPolicy
+	ReplicationFactor int
+	ACL               ACL
+	AllowKeyRemapping bool
 }
 
 type PartitionStrategy int
@@ -24,42 +76,286 @@ type PartitionStrategy int
 const (
 	HashPartition PartitionStrategy = iota
 	RoundRobinPartition
+	StickyPartition
+	KeyRangePartition
+	Murmur2Partition
+	ConsistentHashPartition
+)
+
+type CleanupPolicy int
+
+const (
+	DeleteCleanup CleanupPolicy = iota
+	CompactCleanup
+)
+
+// A Schema is a version of a subject's schema, as registered by the RegisterSchema RPC.
+type Schema struct {
+	Subject string
+	Type    SchemaType
+	// A serialised FileDescriptorSet for ProtobufSchema, or the schema's JSON otherwise.
+	Definition []byte
+	// The full name of the payload's message type, for ProtobufSchema.
+	MessageName   string
+	Compatibility Compatibility
+}
+
+type SchemaType int
+
+const (
+	ProtobufSchema SchemaType = iota
+	JSONSchema
+	AvroSchema
+)
+
+type Compatibility int
+
+const (
+	// Keeps the subject's existing compatibility mode, which is BackwardCompatibility for a new
+	// subject.
+	UnspecifiedCompatibility Compatibility = iota
+	NoCompatibility
+	BackwardCompatibility
+	ForwardCompatibility
+	FullCompatibility
 )
 
-func NewServer(topics ...Topic) Server {
+// An ACL lists the IDs of the clients allowed to publish and subscribe to a topic, as given with
+// identity.UnaryClientInterceptor. An empty list allows every client.
+type ACL struct {
+	Publishers  []string
+	Subscribers []string
+}
+
+// NewServer creates a Server with the topics, returning why the options or any of the topics are
+// invalid.
+func NewServer(opts Options, topics ...Topic) (Server, error) {
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = defaultMaxMessageSize
+	}
+	if opts.MaxRequestSize == 0 {
+		opts.MaxRequestSize = defaultMaxRequestSize
+	}
+	if opts.MaxResponseSize == 0 {
+		opts.MaxResponseSize = defaultMaxResponseSize
+	}
+	var errs []error
+	if opts.MaxMessageSize < 0 {
+		errs = append(errs, fmt.Errorf("max message size must not be negative, got %d", opts.MaxMessageSize))
+	}
+	if opts.MaxRequestSize < 0 {
+		errs = append(errs, fmt.Errorf("max request size must not be negative, got %d", opts.MaxRequestSize))
+	}
+	if opts.MaxResponseSize < 0 {
+		errs = append(errs, fmt.Errorf("max response size must not be negative, got %d", opts.MaxResponseSize))
+	}
+	if opts.MaxMessageSize > opts.MaxRequestSize {
+		errs = append(errs, fmt.Errorf("max message size %d must not exceed max request size %d", opts.MaxMessageSize, opts.MaxRequestSize))
+	}
+	if opts.MaxMessageSize+polledMessageOverhead > opts.MaxResponseSize {
+		errs = append(errs, fmt.Errorf("max message size %d must leave %d bytes of max response size %d for the fields added to polled messages", opts.MaxMessageSize, polledMessageOverhead, opts.MaxResponseSize))
+	}
+
+	if slices.Contains(opts.SchemaRegistrants, "") {
+		errs = append(errs, errors.New("schema registrant client IDs must not be empty"))
+	}
+
 	svcTopics := make([]svc.TopicDefinition, 0, len(topics))
 	for _, t := range topics {
-		svcTopics = append(svcTopics, svc.TopicDefinition{
-			Name:               t.Name,
-			NumberOfPartitions: t.NumberOfPartitions,
-			PartitionStrategy:  svc.PartitionStrategy(t.PartitionStrategy),
-		})
+		if err := validateTopicMaxMessageSize(t, opts.MaxMessageSize, opts.MaxResponseSize); err != nil {
+			errs = append(errs, fmt.Errorf("topic %q: %w", t.Name, err))
+		}
+		svcTopics = append(svcTopics, convertToTopicDefinition(t))
 	}
-	return Server{
-		svc: svc.NewBroker(svcTopics...),
+	broker, err := svc.NewBroker(svc.Options{MaxDecompressedSize: opts.MaxRequestSize}, svcTopics...)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, s := range opts.Schemas {
+			if _, err := broker.RegisterSchema(s.Subject, schema.Definition{
+				Type:        schema.Type(s.Type),
+				Definition:  s.Definition,
+				MessageName: s.MessageName,
+			}, schema.Compatibility(s.Compatibility)); err != nil {
+				errs = append(errs, fmt.Errorf("registering schema for subject %q: %w", s.Subject, err))
+			}
+		}
 	}
+	if len(errs) != 0 {
+		return Server{}, fmt.Errorf("creating server: %w", errors.Join(errs...))
+	}
+
+	server := Server{
+		svc:               broker,
+		maxMessageSize:    opts.MaxMessageSize,
+		maxRequestSize:    opts.MaxRequestSize,
+		maxResponseSize:   opts.MaxResponseSize,
+		schemaRegistrants: opts.SchemaRegistrants,
+	}
+	for _, t := range topics {
+		server.checkSchemaSubject(t)
+	}
+	return server, nil
+}
+
+// Warn if the topic's schema subject has no schema registered, as publishing to the topic fails
+// until one is.
+func (s Server) checkSchemaSubject(topic Topic) {
+	if topic.SchemaSubject == "" {
+		return
+	}
+	if _, _, err := s.svc.GetSchema(topic.SchemaSubject, 0); err != nil {
+		slog.Warn("Topic's schema subject has no schema registered, so publishing to it fails until one is", slog.String("topic", topic.Name), slog.String("subject", topic.SchemaSubject))
+	}
+}
+
+// CreateTopic adds the topic to the Server, returning why it's invalid.
+func (s Server) CreateTopic(topic Topic) error {
+	if err := validateTopicMaxMessageSize(topic, s.maxMessageSize, s.maxResponseSize); err != nil {
+		return fmt.Errorf("creating topic %q: %w", topic.Name, err)
+	}
+	if err := s.svc.CreateTopic(convertToTopicDefinition(topic)); err != nil {
+		return err
+	}
+	s.checkSchemaSubject(topic)
+	return nil
+}
+
+// UpdateTopic applies the topic's configuration to the existing topic of the same name, as
+// described by svc.Broker.UpdateTopic.
+func (s Server) UpdateTopic(topic Topic) error {
+	if err := validateTopicMaxMessageSize(topic, s.maxMessageSize, s.maxResponseSize); err != nil {
+		return fmt.Errorf("updating topic %q: %w", topic.Name, err)
+	}
+	return s.svc.UpdateTopic(convertToTopicDefinition(topic))
+}
+
+// Why the topic's max message size is invalid: it can't exceed the Server's, and its messages must
+// fit in a poll response once polled.
+func validateTopicMaxMessageSize(topic Topic, maxMessageSize, maxResponseSize int) error {
+	if topic.MaxMessageSize > maxMessageSize {
+		return fmt.Errorf("max message size %d must not exceed the broker's %d", topic.MaxMessageSize, maxMessageSize)
+	}
+	if topic.MaxMessageSize != 0 {
+		maxMessageSize = topic.MaxMessageSize
+	}
+	if overhead := polledMessageOverhead + len(topic.Name); maxMessageSize+overhead > maxResponseSize {
+		return fmt.Errorf("max message size %d must leave %d bytes of max response size %d for the fields added to polled messages", maxMessageSize, overhead, maxResponseSize)
+	}
+	return nil
+}
+
+func convertToTopicDefinition(t Topic) svc.TopicDefinition {
+	return svc.TopicDefinition{
+		Name:               t.Name,
+		NumberOfPartitions: t.NumberOfPartitions,
+		PartitionStrategy:  svc.PartitionStrategy(t.PartitionStrategy),
+		KeySplitPoints:     t.KeySplitPoints,
+		MessageTTL:         t.MessageTTL,
+		RetainPerKey:       t.RetainPerKey,
+		SchemaSubject:      t.SchemaSubject,
+		MaxMessageSize:     t.MaxMessageSize,
+		CleanupPolicy:      svc.CleanupPolicy(t.CleanupPolicy),
+		ReplicationFactor:  t.ReplicationFactor,
+		ACL: svc.ACL{
+			Publishers:  t.ACL.Publishers,
+			Subscribers: t.ACL.Subscribers,
+		},
+		AllowKeyRemapping: t.AllowKeyRemapping,
+	}
+}
+
+// The largest a message published to the topic can be, which is the smaller of the topic's limit
+// and the Server's, and leaves room in a poll response for the fields added to polled messages,
+// e.g. for a reply topic with a long name.
+func (s Server) topicMaxMessageSize(topicName string) int {
+	maxMessageSize := min(s.maxMessageSize, s.maxResponseSize-polledMessageOverhead-len(topicName))
+	info, err := s.svc.TopicInfo(topicName)
+	if err != nil || info.MaxMessageSize == 0 {
+		return maxMessageSize
+	}
+	return min(info.MaxMessageSize, maxMessageSize)
+}
+
+// RunRetention reclaims expired messages each interval, until ctx is done.
+func (s Server) RunRetention(ctx context.Context, interval time.Duration) {
+	s.svc.RunRetention(ctx, interval)
 }
 
 func (Server) convertToMessages(protoMessages ...*brokerpb.Message) []svc.Message {
 	messages := make([]svc.Message, len(protoMessages))
 	for i, protoMessage := range protoMessages {
+		var partition *int
+		if protoMessage.HasPartition() {
+			partition = toPtr(int(protoMessage.GetPartition()))
+		}
 		messages[i] = svc.Message{
-			Key:       protoMessage.GetKey(),
-			Timestamp: protoMessage.GetTimestamp().AsTime(),
-			Payload:   protoMessage.GetPayload(),
+			Key:         protoMessage.GetKey(),
+			Timestamp:   protoMessage.GetTimestamp().AsTime(),
+			Payload:     protoMessage.GetPayload(),
+			Headers:     protoMessage.GetHeaders(),
+			TTL:         protoMessage.GetTtl().AsDuration(),
+			Retain:      protoMessage.GetRetain(),
+			Priority:    int(protoMessage.GetPriority()),
+			Compression: protoMessage.GetCompression(),
+			Partition:   partition,
 		}
 	}
 	return messages
 }
 
-func (Server) convertFromMessages(messages ...svc.Message) []*brokerpb.Message {
+func (s Server) convertFromMessages(messages ...svc.Message) []*brokerpb.Message {
 	protoMessages := make([]*brokerpb.Message, len(messages))
 	for i, message := range messages {
-		protoMessages[i] = brokerpb.Message_builder{
-			Key:       &message.Key,
-			Timestamp: timestamppb.New(message.Timestamp),
-			Payload:   message.Payload,
-		}.Build()
+		protoMessages[i] = s.convertFromMessage(message)
 	}
 	return protoMessages
 }
+
+func (s Server) convertFromMessage(message svc.Message) *brokerpb.Message {
+	var ttl *durationpb.Duration
+	if message.TTL != 0 {
+		ttl = durationpb.New(message.TTL)
+	}
+	var compressionName *string
+	if message.Compression != "" {
+		compressionName = &message.Compression
+	}
+	var id *brokerpb.MessageId
+	if message.ID != (svc.MessageID{}) {
+		id = s.convertFromMessageID(message.ID)
+	}
+	return brokerpb.Message_builder{
+		Id:          id,
+		Key:         &message.Key,
+		Timestamp:   timestamppb.New(message.Timestamp),
+		Payload:     message.Payload,
+		Headers:     message.Headers,
+		Ttl:         ttl,
+		Retain:      &message.Retain,
+		Priority:    toPtr(int32(message.Priority)),
+		Compression: compressionName,
+	}.Build()
+}
+
+func (Server) convertToMessageIDs(protoMessageIDs ...*brokerpb.MessageId) []svc.MessageID {
+	messageIDs := make([]svc.MessageID, len(protoMessageIDs))
+	for i, protoMessageID := range protoMessageIDs {
+		messageIDs[i] = svc.MessageID{
+			Topic:     protoMessageID.GetTopic(),
+			Partition: int(protoMessageID.GetPartition()),
+			Offset:    int(protoMessageID.GetOffset()),
+		}
+	}
+	return messageIDs
+}
+
+func (Server) convertFromMessageID(messageID svc.MessageID) *brokerpb.MessageId {
+	return brokerpb.MessageId_builder{
+		Topic:     &messageID.Topic,
+		Partition: toPtr(int32(messageID.Partition)),
+		Offset:    toPtr(int64(messageID.Offset)),
+	}.Build()
+}
+
+func toPtr[P *T, T any](t T) P { return &t }
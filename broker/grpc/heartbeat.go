@@ -0,0 +1,38 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+
+	brokerpb "pubsub/broker/proto/broker"
+	commonerrors "pubsub/common/errors"
+)
+
+func (s Server) Heartbeat(ctx context.Context, request *brokerpb.HeartbeatRequest) (*brokerpb.HeartbeatResponse, error) {
+	if err := s.validateHeartbeatRequest(request); err != nil {
+		return nil, fmt.Errorf("sending heartbeat: %w", err)
+	}
+
+	active, err := s.svc.Heartbeat(request.GetSubscriberId())
+	if err != nil {
+		return nil, fmt.Errorf("sending heartbeat: %w", err)
+	}
+	return brokerpb.HeartbeatResponse_builder{
+		Active: &active,
+	}.Build(), nil
+}
+
+func (Server) validateHeartbeatRequest(request *brokerpb.HeartbeatRequest) error {
+	violations := []commonerrors.FieldViolation{}
+	if !request.HasSubscriberId() {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:  "subscriber_id",
+			Reason: "REQUIRED_FIELD",
+		})
+	}
+
+	if len(violations) != 0 {
+		return commonerrors.NewInvalidArgument("invalid heartbeat request", violations...)
+	}
+	return nil
+}
@@ -3,8 +3,12 @@ package grpc
 import (
 	"context"
 	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
 
 	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/broker/svc"
 	commonerrors "pubsub/common/errors"
 )
 
@@ -13,10 +17,20 @@ func (s Server) Poll(ctx context.Context, request *brokerpb.PollRequest) (*broke
 		return nil, fmt.Errorf("polling: %w", err)
 	}
 
-	messages, err := s.svc.Poll(request.GetSubscriberId(), int(request.GetLimit()))
+	maxBytes := s.maxResponseSize
+	if request.GetMaxBytes() != 0 {
+		maxBytes = min(int(request.GetMaxBytes()), maxBytes)
+	}
+	messages, err := s.svc.Poll(request.GetSubscriberId(), svc.PollLimits{
+		MaxMessages:       int(request.GetLimit()),
+		MaxBytes:          maxBytes,
+		PartitionMaxBytes: int(request.GetPartitionMaxBytes()),
+		Size:              polledMessageSize,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("polling: %w", err)
 	}
+	defer s.svc.ReleasePoll(messages)
 
 	return brokerpb.PollResponse_builder{
 		Messages: s.convertFromMessages(messages...),
@@ -43,9 +57,69 @@ func (Server) validatePollRequest(request *brokerpb.PollRequest) error {
 			Description: "Minimum value 1",
 		})
 	}
+	if request.GetMaxBytes() < 0 {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       "max_bytes",
+			Reason:      "BELOW_MIN_VALUE",
+			Description: "Minimum value 0",
+		})
+	}
+	if request.GetPartitionMaxBytes() < 0 {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       "partition_max_bytes",
+			Reason:      "BELOW_MIN_VALUE",
+			Description: "Minimum value 0",
+		})
+	}
 
 	if len(violations) != 0 {
 		return commonerrors.NewInvalidArgument("invalid poll request", violations...)
 	}
 	return nil
 }
+
+// The size of the message as encoded in a PollResponse, so that the response is no larger than the
+// limits. It's summed from the fields convertFromMessage sets, so the message needn't be built
+// until it's returned.
+func polledMessageSize(message svc.Message) int {
+	size := sizeField(1, len(message.Key))
+	size += sizeField(2, sizeDuration(message.Timestamp.Unix(), message.Timestamp.Nanosecond()))
+	if message.Payload != nil {
+		size += sizeField(3, len(message.Payload))
+	}
+	if message.TTL != 0 {
+		size += sizeField(4, sizeDuration(int64(message.TTL/time.Second), int(message.TTL%time.Second)))
+	}
+	for key, value := range message.Headers {
+		size += sizeField(5, sizeField(1, len(key))+sizeField(2, len(value)))
+	}
+	size += protowire.SizeTag(6) + protowire.SizeVarint(protowire.EncodeBool(message.Retain))
+	if message.ID != (svc.MessageID{}) {
+		size += sizeField(7, sizeField(1, len(message.ID.Topic))+
+			protowire.SizeTag(2)+protowire.SizeVarint(uint64(message.ID.Partition))+
+			protowire.SizeTag(3)+protowire.SizeVarint(uint64(message.ID.Offset)))
+	}
+	size += protowire.SizeTag(8) + protowire.SizeVarint(uint64(message.Priority))
+	if message.Compression != "" {
+		size += sizeField(9, len(message.Compression))
+	}
+	// The message is itself a field of the PollResponse.
+	return sizeField(1, size)
+}
+
+// The size of a Timestamp or Duration, which omit their zero fields.
+func sizeDuration(seconds int64, nanos int) int {
+	size := 0
+	if seconds != 0 {
+		size += protowire.SizeTag(1) + protowire.SizeVarint(uint64(seconds))
+	}
+	if nanos != 0 {
+		size += protowire.SizeTag(2) + protowire.SizeVarint(uint64(nanos))
+	}
+	return size
+}
+
+// The size of a length-delimited field.
+func sizeField(number protowire.Number, length int) int {
+	return protowire.SizeTag(number) + protowire.SizeBytes(length)
+}
@@ -0,0 +1,61 @@
+package grpc
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/broker/svc"
+)
+
+// Polled messages are sized without building them, so the size must match the encoded message's.
+func TestPolledMessageSize(t *testing.T) {
+	for _, message := range []svc.Message{
+		{},
+		{Key: "k", Payload: []byte{}, Timestamp: time.Unix(1, 0)},
+		{Key: "k", Payload: make([]byte, 300), Timestamp: time.Now(), Priority: 9, Retain: true},
+		{Payload: []byte("p"), Headers: map[string]string{"a": "", "": "b", "long": string(make([]byte, 200))}},
+		{TTL: time.Hour + time.Nanosecond, Compression: "gzip", Timestamp: time.Now()},
+		{ID: svc.MessageID{Topic: "t", Partition: 300, Offset: 1 << 40}, Timestamp: time.Now()},
+		{ID: svc.MessageID{Topic: "t"}, TTL: time.Millisecond},
+	} {
+		s := Server{}
+		want := proto.Size(brokerpb.PollResponse_builder{Messages: []*brokerpb.Message{s.convertFromMessage(message)}}.Build())
+		if got := polledMessageSize(message); got != want {
+			t.Errorf("got size %d for %+v, want %d", got, message, want)
+		}
+	}
+}
+
+// The largest messages must still fit in a poll response once polled.
+func TestNewServerPolledMessageOverhead(t *testing.T) {
+	if _, err := NewServer(Options{MaxMessageSize: 1000, MaxResponseSize: 1000}); err == nil {
+		t.Error("created a server whose largest messages don't fit in a poll response")
+	}
+	name := string(make([]byte, 100))
+	if _, err := NewServer(Options{MaxMessageSize: 1000, MaxResponseSize: 1000 + polledMessageOverhead}, Topic{Name: name, NumberOfPartitions: 1}); err == nil {
+		t.Error("created a topic whose largest messages don't fit in a poll response with its name")
+	}
+	s, err := NewServer(Options{MaxMessageSize: 1000, MaxResponseSize: 1000 + polledMessageOverhead}, Topic{Name: name, NumberOfPartitions: 1, MaxMessageSize: 900})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The largest message which can be published to the topic fits once polled.
+	payload := make([]byte, 897)
+	if size := proto.Size(brokerpb.Message_builder{Payload: payload}.Build()); size != s.topicMaxMessageSize(name) {
+		t.Fatalf("published message is %d bytes, want the max %d", size, s.topicMaxMessageSize(name))
+	}
+	polled := svc.Message{
+		ID:        svc.MessageID{Topic: name, Partition: 1 << 30, Offset: 1 << 62},
+		Timestamp: time.Now(),
+		Payload:   payload,
+		Priority:  9,
+		Retain:    true,
+	}
+	if size := polledMessageSize(polled); size > 1000+polledMessageOverhead {
+		t.Errorf("polled message is %d bytes, more than the max response size %d", size, 1000+polledMessageOverhead)
+	}
+}
@@ -2,26 +2,88 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
 
 	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/broker/svc"
+	"pubsub/common/compression"
 	commonerrors "pubsub/common/errors"
+	"pubsub/common/grpc/identity"
 )
 
 func (s Server) Publish(ctx context.Context, request *brokerpb.PublishRequest) (*emptypb.Empty, error) {
-	if err := s.validatePublishRequest(request); err != nil {
+	messages, err := s.decompressMessages(request)
+	if err != nil {
+		return nil, fmt.Errorf("publishing: %w", err)
+	}
+	if err := s.validatePublishRequest(request, messages); err != nil {
+		return nil, fmt.Errorf("publishing: %w", err)
+	}
+	if err := s.svc.Authorize(request.GetTopic(), identity.ClientID(ctx), svc.PublishAccess); err != nil {
 		return nil, fmt.Errorf("publishing: %w", err)
 	}
 
-	if err := s.svc.Publish(request.GetTopic(), s.convertToMessages(request.GetMessages()...)...); err != nil {
+	if err := s.svc.Publish(request.GetTopic(), s.convertToMessages(messages...)...); err != nil {
 		return nil, fmt.Errorf("publishing: %w", err)
 	}
 	return nil, nil
 }
 
-func (Server) validatePublishRequest(request *brokerpb.PublishRequest) error {
+// The request's messages, decompressing them if they were sent compressed, to at most the max
+// request size.
+func (s Server) decompressMessages(request *brokerpb.PublishRequest) ([]*brokerpb.Message, error) {
+	if !request.HasCompression() {
+		return request.GetMessages(), nil
+	}
+
+	codec, ok := compression.Lookup(request.GetCompression())
+	if !ok {
+		return nil, commonerrors.NewInvalidArgument("invalid publish request", commonerrors.FieldViolation{
+			Field:       "compression",
+			Reason:      "UNSUPPORTED_COMPRESSION",
+			Description: fmt.Sprintf("Supported compressions: %s", strings.Join(compression.Names(), ", ")),
+		})
+	}
+	if len(request.GetMessages()) != 0 {
+		return nil, commonerrors.NewInvalidArgument("invalid publish request", commonerrors.FieldViolation{
+			Field:       "messages",
+			Reason:      "ABOVE_MAX_LENGTH",
+			Description: "Maximum length 0 when compressed",
+		})
+	}
+
+	data, err := codec.Decompress(request.GetCompressedMessages(), s.maxRequestSize)
+	if errors.Is(err, compression.ErrTooLarge) {
+		return nil, commonerrors.NewInvalidArgument("invalid publish request", commonerrors.FieldViolation{
+			Field:       "compressed_messages",
+			Reason:      "ABOVE_MAX_SIZE",
+			Description: fmt.Sprintf("Maximum size %d bytes when decompressed", s.maxRequestSize),
+		})
+	}
+	if err != nil {
+		return nil, commonerrors.NewInvalidArgument("invalid publish request", commonerrors.FieldViolation{
+			Field:       "compressed_messages",
+			Reason:      "INVALID_COMPRESSED_MESSAGES",
+			Description: err.Error(),
+		})
+	}
+	batch := &brokerpb.MessageBatch{}
+	if err := proto.Unmarshal(data, batch); err != nil {
+		return nil, commonerrors.NewInvalidArgument("invalid publish request", commonerrors.FieldViolation{
+			Field:       "compressed_messages",
+			Reason:      "INVALID_COMPRESSED_MESSAGES",
+			Description: err.Error(),
+		})
+	}
+	return batch.GetMessages(), nil
+}
+
+func (s Server) validatePublishRequest(request *brokerpb.PublishRequest, messages []*brokerpb.Message) error {
 	violations := []commonerrors.FieldViolation{}
 	if !request.HasTopic() {
 		violations = append(violations, commonerrors.FieldViolation{
@@ -29,26 +91,16 @@ func (Server) validatePublishRequest(request *brokerpb.PublishRequest) error {
 			Reason: "REQUIRED_FIELD",
 		})
 	}
-	if len(request.GetMessages()) == 0 {
+	if len(messages) == 0 {
 		violations = append(violations, commonerrors.FieldViolation{
 			Field:       "messages",
 			Reason:      "BELOW_MIN_LENGTH",
 			Description: "Minimum length 1",
 		})
 	}
-	for i, msg := range request.GetMessages() {
-		if !msg.HasPayload() {
-			violations = append(violations, commonerrors.FieldViolation{
-				Field:  fmt.Sprintf("messages[%d].payload", i),
-				Reason: "REQUIRED_FIELD",
-			})
-		} else if len(msg.GetPayload()) == 0 {
-			violations = append(violations, commonerrors.FieldViolation{
-				Field:       fmt.Sprintf("messages[%d].payload", i),
-				Reason:      "BELOW_MIN_LENGTH",
-				Description: "Minimum length 1",
-			})
-		}
+	maxMessageSize := s.topicMaxMessageSize(request.GetTopic())
+	for i, msg := range messages {
+		violations = append(violations, s.validateMessage(fmt.Sprintf("messages[%d]", i), msg, maxMessageSize)...)
 	}
 
 	if len(violations) != 0 {
@@ -56,3 +108,56 @@ func (Server) validatePublishRequest(request *brokerpb.PublishRequest) error {
 	}
 	return nil
 }
+
+func (Server) validateMessage(field string, msg *brokerpb.Message, maxMessageSize int) []commonerrors.FieldViolation {
+	violations := []commonerrors.FieldViolation{}
+	if size := proto.Size(msg); size > maxMessageSize {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       field,
+			Reason:      "ABOVE_MAX_SIZE",
+			Description: fmt.Sprintf("Maximum size %d bytes, was %d bytes", maxMessageSize, size),
+		})
+	}
+	if !msg.HasPayload() {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:  field + ".payload",
+			Reason: "REQUIRED_FIELD",
+		})
+	} else if len(msg.GetPayload()) == 0 {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       field + ".payload",
+			Reason:      "BELOW_MIN_LENGTH",
+			Description: "Minimum length 1",
+		})
+	}
+	if msg.HasTtl() && msg.GetTtl().AsDuration() <= 0 {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       field + ".ttl",
+			Reason:      "BELOW_MIN_VALUE",
+			Description: "Minimum value 1ns",
+		})
+	}
+	if msg.HasCompression() {
+		if _, ok := compression.Lookup(msg.GetCompression()); !ok {
+			violations = append(violations, commonerrors.FieldViolation{
+				Field:       field + ".compression",
+				Reason:      "UNSUPPORTED_COMPRESSION",
+				Description: fmt.Sprintf("Supported compressions: %s", strings.Join(compression.Names(), ", ")),
+			})
+		}
+	}
+	if msg.GetPriority() < 0 {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       field + ".priority",
+			Reason:      "BELOW_MIN_VALUE",
+			Description: "Minimum value 0",
+		})
+	} else if msg.GetPriority() > svc.MaxPriority {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       field + ".priority",
+			Reason:      "ABOVE_MAX_VALUE",
+			Description: fmt.Sprintf("Maximum value %d", svc.MaxPriority),
+		})
+	}
+	return violations
+}
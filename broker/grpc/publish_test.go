@@ -0,0 +1,51 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/common/compression"
+	commonerrors "pubsub/common/errors"
+)
+
+// A compressed batch is rejected if it decompresses to more than the max request size, however
+// small it is compressed.
+func TestPublishCompressedMessagesMaxSize(t *testing.T) {
+	s, err := NewServer(Options{MaxMessageSize: 1000, MaxRequestSize: 10000}, Topic{Name: "t", NumberOfPartitions: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(messages int) error {
+		batch, err := proto.Marshal(brokerpb.MessageBatch_builder{
+			Messages: slices.Repeat([]*brokerpb.Message{brokerpb.Message_builder{Payload: bytes.Repeat([]byte("a"), 990)}.Build()}, messages),
+		}.Build())
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec, _ := compression.Lookup(compression.Gzip)
+		compressed, err := codec.Compress(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Publish(context.Background(), brokerpb.PublishRequest_builder{
+			Topic:              toPtr("t"),
+			Compression:        toPtr(compression.Gzip),
+			CompressedMessages: compressed,
+		}.Build())
+		return err
+	}
+
+	if err := publish(9); err != nil {
+		t.Errorf("publishing a batch within the max request size: %v", err)
+	}
+	invalidArgument := commonerrors.InvalidArgument{}
+	if err := publish(11); !errors.As(err, &invalidArgument) || invalidArgument.FieldViolations[0].Reason != "ABOVE_MAX_SIZE" {
+		t.Errorf("publishing a batch beyond the max request size got %v, want a violation", err)
+	}
+}
@@ -0,0 +1,65 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/broker/svc"
+	commonerrors "pubsub/common/errors"
+	"pubsub/common/grpc/identity"
+)
+
+func (s Server) Request(ctx context.Context, request *brokerpb.RequestRequest) (*brokerpb.RequestResponse, error) {
+	if err := s.validateRequestRequest(request); err != nil {
+		return nil, fmt.Errorf("requesting: %w", err)
+	}
+	if err := s.svc.Authorize(request.GetTopic(), identity.ClientID(ctx), svc.PublishAccess); err != nil {
+		return nil, fmt.Errorf("requesting: %w", err)
+	}
+
+	if request.HasTimeout() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, request.GetTimeout().AsDuration())
+		defer cancel()
+	}
+
+	reply, err := s.svc.Request(ctx, request.GetTopic(), s.convertToMessages(request.GetMessage())[0])
+	if err != nil {
+		return nil, fmt.Errorf("requesting: %w", err)
+	}
+
+	return brokerpb.RequestResponse_builder{
+		Reply: s.convertFromMessages(reply)[0],
+	}.Build(), nil
+}
+
+func (s Server) validateRequestRequest(request *brokerpb.RequestRequest) error {
+	violations := []commonerrors.FieldViolation{}
+	if !request.HasTopic() {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:  "topic",
+			Reason: "REQUIRED_FIELD",
+		})
+	}
+	if !request.HasMessage() {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:  "message",
+			Reason: "REQUIRED_FIELD",
+		})
+	} else {
+		violations = append(violations, s.validateMessage("message", request.GetMessage(), s.topicMaxMessageSize(request.GetTopic()))...)
+	}
+	if request.HasTimeout() && request.GetTimeout().AsDuration() <= 0 {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       "timeout",
+			Reason:      "BELOW_MIN_VALUE",
+			Description: "Minimum value 1ns",
+		})
+	}
+
+	if len(violations) != 0 {
+		return commonerrors.NewInvalidArgument("invalid request request", violations...)
+	}
+	return nil
+}
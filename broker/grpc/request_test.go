@@ -0,0 +1,161 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/broker/svc"
+	commonerrors "pubsub/common/errors"
+	"pubsub/common/headers"
+)
+
+// Poll the topic as the group until a message is published, returning it.
+func awaitRequest(t *testing.T, s Server, subscriberID string) svc.Message {
+	t.Helper()
+	for {
+		msgs, err := s.svc.Poll(subscriberID, svc.PollLimits{MaxMessages: 1})
+		if err != nil {
+			t.Error(err)
+			return svc.Message{}
+		}
+		if len(msgs) != 0 {
+			return msgs[0]
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func mustNewServer(t *testing.T, topics ...Topic) Server {
+	t.Helper()
+	s, err := NewServer(Options{MaxMessageSize: 1000, MaxRequestSize: 10000, MaxResponseSize: 10000}, topics...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// A request is published with a temporary reply topic and correlation ID, returns the reply with
+// its correlation ID published to that topic, and deletes the topic once it's returned.
+func TestRequestReply(t *testing.T) {
+	s := mustNewServer(t, Topic{Name: "t", NumberOfPartitions: 1})
+	subscriberID, err := s.svc.Subscribe("t", "responders", svc.SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make(chan svc.Message, 1)
+	go func() {
+		request := awaitRequest(t, s, subscriberID)
+		requests <- request
+		replyTo, correlationID := request.Headers[headers.ReplyTo], request.Headers[headers.CorrelationID]
+		// Replies to other requests are ignored.
+		if err := s.svc.Publish(replyTo,
+			svc.Message{Payload: []byte("other"), Headers: map[string]string{headers.CorrelationID: "other"}},
+			svc.Message{Payload: []byte("reply"), Headers: map[string]string{headers.CorrelationID: correlationID}},
+		); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	response, err := s.Request(context.Background(), brokerpb.RequestRequest_builder{
+		Topic:   toPtr("t"),
+		Message: brokerpb.Message_builder{Payload: []byte("request"), Headers: map[string]string{"h": "v"}}.Build(),
+		Timeout: durationpb.New(10 * time.Second),
+	}.Build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(response.GetReply().GetPayload()); got != "reply" {
+		t.Errorf("got reply %q, want the reply with the request's correlation ID", got)
+	}
+
+	request := <-requests
+	if string(request.Payload) != "request" || request.Headers["h"] != "v" {
+		t.Errorf("published the request as %+v, want its payload and headers kept", request)
+	}
+	if request.Headers[headers.CorrelationID] == "" {
+		t.Errorf("published the request without a correlation ID")
+	}
+	if _, err := s.svc.TopicInfo(request.Headers[headers.ReplyTo]); err == nil {
+		t.Errorf("reply topic %q still exists once the request returned", request.Headers[headers.ReplyTo])
+	}
+}
+
+// Requests without a reply fail once their timeout, or the call's deadline, has passed, and delete
+// their reply topic.
+func TestRequestDeadline(t *testing.T) {
+	s := mustNewServer(t, Topic{Name: "t", NumberOfPartitions: 1})
+	subscriberID, err := s.svc.Subscribe("t", "responders", svc.SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		callTimeout time.Duration
+		timeout     *durationpb.Duration
+	}{
+		{name: "timeout", callTimeout: time.Hour, timeout: durationpb.New(10 * time.Millisecond)},
+		{name: "call deadline", callTimeout: 10 * time.Millisecond},
+		{name: "call deadline before timeout", callTimeout: 10 * time.Millisecond, timeout: durationpb.New(time.Hour)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), test.callTimeout)
+			defer cancel()
+			start := time.Now()
+			_, err := s.Request(ctx, brokerpb.RequestRequest_builder{
+				Topic:   toPtr("t"),
+				Message: brokerpb.Message_builder{Payload: []byte("request")}.Build(),
+				Timeout: test.timeout,
+			}.Build())
+			if !errors.As(err, &commonerrors.DeadlineExceeded{}) {
+				t.Errorf("got %v, want deadline exceeded", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Minute {
+				t.Errorf("request took %s to time out", elapsed)
+			}
+
+			request := awaitRequest(t, s, subscriberID)
+			if err := s.svc.MoveOffset(subscriberID, 1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.svc.TopicInfo(request.Headers[headers.ReplyTo]); err == nil {
+				t.Errorf("reply topic %q still exists once the request timed out", request.Headers[headers.ReplyTo])
+			}
+		})
+	}
+}
+
+func TestRequestInvalid(t *testing.T) {
+	s := mustNewServer(t, Topic{Name: "guarded", NumberOfPartitions: 1, ACL: ACL{Publishers: []string{"p"}}})
+	message := brokerpb.Message_builder{Payload: []byte("request")}.Build()
+	for _, test := range []struct {
+		name    string
+		request *brokerpb.RequestRequest
+		reason  string
+	}{
+		{name: "no topic", request: brokerpb.RequestRequest_builder{Message: message}.Build(), reason: "REQUIRED_FIELD"},
+		{name: "no message", request: brokerpb.RequestRequest_builder{Topic: toPtr("guarded")}.Build(), reason: "REQUIRED_FIELD"},
+		{name: "zero timeout", request: brokerpb.RequestRequest_builder{Topic: toPtr("guarded"), Message: message, Timeout: durationpb.New(0)}.Build(), reason: "BELOW_MIN_VALUE"},
+	} {
+		invalidArgument := commonerrors.InvalidArgument{}
+		if _, err := s.Request(context.Background(), test.request); !errors.As(err, &invalidArgument) || invalidArgument.FieldViolations[0].Reason != test.reason {
+			t.Errorf("%s: got %v, want a %s violation", test.name, err, test.reason)
+		}
+	}
+
+	request := brokerpb.RequestRequest_builder{Topic: toPtr("guarded"), Message: message, Timeout: durationpb.New(time.Millisecond)}.Build()
+	if _, err := s.Request(context.Background(), request); !errors.As(err, &commonerrors.PermissionDenied{}) {
+		t.Errorf("requesting from a client the topic's ACL doesn't allow to publish got %v, want permission denied", err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("pubsub-client-id", "p"))
+	if _, err := s.Request(ctx, request); !errors.As(err, &commonerrors.DeadlineExceeded{}) {
+		t.Errorf("requesting from an allowed client without a responder got %v, want deadline exceeded", err)
+	}
+}
@@ -0,0 +1,151 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/broker/schema"
+	commonerrors "pubsub/common/errors"
+	"pubsub/common/grpc/identity"
+)
+
+func (s Server) RegisterSchema(ctx context.Context, request *brokerpb.RegisterSchemaRequest) (*brokerpb.RegisterSchemaResponse, error) {
+	if err := s.validateRegisterSchemaRequest(request); err != nil {
+		return nil, fmt.Errorf("registering schema: %w", err)
+	}
+	if clientID := identity.ClientID(ctx); len(s.schemaRegistrants) != 0 && !slices.Contains(s.schemaRegistrants, clientID) {
+		return nil, fmt.Errorf("registering schema: %w", commonerrors.NewPermissionDenied(fmt.Sprintf("client %q isn't allowed to register schemas", clientID)))
+	}
+
+	version, err := s.svc.RegisterSchema(request.GetSubject(), schema.Definition{
+		Type:        schemaTypes[request.GetType()],
+		Definition:  request.GetDefinition(),
+		MessageName: request.GetMessageName(),
+	}, compatibilities[request.GetCompatibility()])
+	if err != nil {
+		return nil, fmt.Errorf("registering schema: %w", err)
+	}
+	return brokerpb.RegisterSchemaResponse_builder{
+		Version: toPtr(int32(version)),
+	}.Build(), nil
+}
+
+func (Server) validateRegisterSchemaRequest(request *brokerpb.RegisterSchemaRequest) error {
+	violations := []commonerrors.FieldViolation{}
+	if !request.HasSubject() {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:  "subject",
+			Reason: "REQUIRED_FIELD",
+		})
+	}
+	if !request.HasType() {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:  "type",
+			Reason: "REQUIRED_FIELD",
+		})
+	} else if _, ok := schemaTypes[request.GetType()]; !ok {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       "type",
+			Reason:      "UNRECOGNISED_ENUM_VALUE",
+			Description: fmt.Sprintf("Unrecognised schema type %d", request.GetType()),
+		})
+	}
+	if len(request.GetDefinition()) == 0 {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:  "definition",
+			Reason: "REQUIRED_FIELD",
+		})
+	}
+	if request.GetType() == brokerpb.SchemaType_SCHEMA_TYPE_PROTOBUF && !request.HasMessageName() {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:  "message_name",
+			Reason: "REQUIRED_FIELD",
+		})
+	}
+	if _, ok := compatibilities[request.GetCompatibility()]; !ok {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       "compatibility",
+			Reason:      "UNRECOGNISED_ENUM_VALUE",
+			Description: fmt.Sprintf("Unrecognised compatibility %d", request.GetCompatibility()),
+		})
+	}
+
+	if len(violations) != 0 {
+		return commonerrors.NewInvalidArgument("invalid register schema request", violations...)
+	}
+	return nil
+}
+
+func (s Server) GetSchema(ctx context.Context, request *brokerpb.GetSchemaRequest) (*brokerpb.Schema, error) {
+	if err := s.validateGetSchemaRequest(request); err != nil {
+		return nil, fmt.Errorf("getting schema: %w", err)
+	}
+
+	version, compatibility, err := s.svc.GetSchema(request.GetSubject(), int(request.GetVersion()))
+	if err != nil {
+		return nil, fmt.Errorf("getting schema: %w", err)
+	}
+	var messageName *string
+	if version.MessageName != "" {
+		messageName = &version.MessageName
+	}
+	return brokerpb.Schema_builder{
+		Subject:       &version.Subject,
+		Version:       toPtr(int32(version.Version)),
+		Type:          toPtr(schemaTypesFromSvc[version.Type]),
+		Definition:    version.Definition.Definition,
+		MessageName:   messageName,
+		Compatibility: toPtr(compatibilitiesFromSvc[compatibility]),
+	}.Build(), nil
+}
+
+func (Server) validateGetSchemaRequest(request *brokerpb.GetSchemaRequest) error {
+	violations := []commonerrors.FieldViolation{}
+	if !request.HasSubject() {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:  "subject",
+			Reason: "REQUIRED_FIELD",
+		})
+	}
+	if request.GetVersion() < 0 {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       "version",
+			Reason:      "BELOW_MIN_VALUE",
+			Description: "Minimum value 0",
+		})
+	}
+
+	if len(violations) != 0 {
+		return commonerrors.NewInvalidArgument("invalid get schema request", violations...)
+	}
+	return nil
+}
+
+var schemaTypes = map[brokerpb.SchemaType]schema.Type{
+	brokerpb.SchemaType_SCHEMA_TYPE_PROTOBUF: schema.ProtobufSchema,
+	brokerpb.SchemaType_SCHEMA_TYPE_JSON:     schema.JSONSchema,
+	brokerpb.SchemaType_SCHEMA_TYPE_AVRO:     schema.AvroSchema,
+}
+
+var schemaTypesFromSvc = map[schema.Type]brokerpb.SchemaType{
+	schema.ProtobufSchema: brokerpb.SchemaType_SCHEMA_TYPE_PROTOBUF,
+	schema.JSONSchema:     brokerpb.SchemaType_SCHEMA_TYPE_JSON,
+	schema.AvroSchema:     brokerpb.SchemaType_SCHEMA_TYPE_AVRO,
+}
+
+var compatibilities = map[brokerpb.Compatibility]schema.Compatibility{
+	brokerpb.Compatibility_COMPATIBILITY_UNSPECIFIED: schema.UnspecifiedCompatibility,
+	brokerpb.Compatibility_COMPATIBILITY_NONE:        schema.NoCompatibility,
+	brokerpb.Compatibility_COMPATIBILITY_BACKWARD:    schema.BackwardCompatibility,
+	brokerpb.Compatibility_COMPATIBILITY_FORWARD:     schema.ForwardCompatibility,
+	brokerpb.Compatibility_COMPATIBILITY_FULL:        schema.FullCompatibility,
+}
+
+var compatibilitiesFromSvc = map[schema.Compatibility]brokerpb.Compatibility{
+	schema.NoCompatibility:       brokerpb.Compatibility_COMPATIBILITY_NONE,
+	schema.BackwardCompatibility: brokerpb.Compatibility_COMPATIBILITY_BACKWARD,
+	schema.ForwardCompatibility:  brokerpb.Compatibility_COMPATIBILITY_FORWARD,
+	schema.FullCompatibility:     brokerpb.Compatibility_COMPATIBILITY_FULL,
+}
@@ -0,0 +1,49 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+
+	brokerpb "pubsub/broker/proto/broker"
+	commonerrors "pubsub/common/errors"
+)
+
+// Only the schema registrants can register schemas, once there are any.
+func TestRegisterSchemaRegistrants(t *testing.T) {
+	request := brokerpb.RegisterSchemaRequest_builder{
+		Subject:    toPtr("s"),
+		Type:       toPtr(brokerpb.SchemaType_SCHEMA_TYPE_JSON),
+		Definition: []byte(`{"type": "string"}`),
+	}.Build()
+	withClientID := func(clientID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("pubsub-client-id", clientID))
+	}
+
+	if _, err := NewServer(Options{SchemaRegistrants: []string{""}}); err == nil {
+		t.Error("created a server with an empty schema registrant")
+	}
+
+	s, err := NewServer(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RegisterSchema(context.Background(), request); err != nil {
+		t.Errorf("registering without schema registrants: %v", err)
+	}
+
+	s, err = NewServer(Options{SchemaRegistrants: []string{"admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ctx := range []context.Context{context.Background(), withClientID("other")} {
+		if _, err := s.RegisterSchema(ctx, request); !errors.As(err, &commonerrors.PermissionDenied{}) {
+			t.Errorf("registering as %q got %v, want permission denied", metadata.ValueFromIncomingContext(ctx, "pubsub-client-id"), err)
+		}
+	}
+	if _, err := s.RegisterSchema(withClientID("admin"), request); err != nil {
+		t.Errorf("registering as a schema registrant: %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package grpc
+
+import (
+	"context"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/common/compression"
+)
+
+func (s Server) GetServerInfo(ctx context.Context, request *emptypb.Empty) (*brokerpb.ServerInfo, error) {
+	return brokerpb.ServerInfo_builder{
+		Compressions:    compression.Names(),
+		MaxMessageSize:  toPtr(int32(s.maxMessageSize)),
+		MaxRequestSize:  toPtr(int32(s.maxRequestSize)),
+		MaxResponseSize: toPtr(int32(s.maxResponseSize)),
+	}.Build(), nil
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"fmt"
 
+	"pubsub/broker/filter"
 	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/broker/svc"
 	commonerrors "pubsub/common/errors"
+	"pubsub/common/grpc/identity"
 )
 
 func (s Server) Subscribe(ctx context.Context, request *brokerpb.SubscribeRequest) (*brokerpb.SubscribeResponse, error) {
@@ -13,7 +16,13 @@ func (s Server) Subscribe(ctx context.Context, request *brokerpb.SubscribeReques
 		return nil, fmt.Errorf("subscribing: %w", err)
 	}
 
-	subscriberID, err := s.svc.Subscribe(request.GetTopic(), request.GetGroup())
+	opts, err := s.convertToSubscriptionOptions(request)
+	if err != nil {
+		return nil, fmt.Errorf("subscribing: %w", err)
+	}
+	opts.ClientID = identity.ClientID(ctx)
+
+	subscriberID, err := s.svc.Subscribe(request.GetTopic(), request.GetGroup(), opts)
 	if err != nil {
 		return nil, fmt.Errorf("subscribing: %w", err)
 	}
@@ -30,6 +39,12 @@ func (Server) validateSubscribeRequest(request *brokerpb.SubscribeRequest) error
 			Field:  "topic",
 			Reason: "REQUIRED_FIELD",
 		})
+	} else if err := svc.ValidateTopicPattern(request.GetTopic()); err != nil {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       "topic",
+			Reason:      "INVALID_TOPIC_PATTERN",
+			Description: err.Error(),
+		})
 	}
 	if !request.HasGroup() {
 		violations = append(violations, commonerrors.FieldViolation{
@@ -37,9 +52,60 @@ func (Server) validateSubscribeRequest(request *brokerpb.SubscribeRequest) error
 			Reason: "REQUIRED_FIELD",
 		})
 	}
+	if _, ok := subscriptionTypes[request.GetType()]; !ok {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       "type",
+			Reason:      "UNRECOGNISED_ENUM_VALUE",
+			Description: fmt.Sprintf("Unrecognised subscription type %d", request.GetType()),
+		})
+	}
+	if request.HasAckTimeout() && request.GetAckTimeout().AsDuration() <= 0 {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       "ack_timeout",
+			Reason:      "BELOW_MIN_VALUE",
+			Description: "Minimum value 1ns",
+		})
+	}
+	if request.HasSessionTimeout() && request.GetSessionTimeout().AsDuration() <= 0 {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:       "session_timeout",
+			Reason:      "BELOW_MIN_VALUE",
+			Description: "Minimum value 1ns",
+		})
+	}
 
 	if len(violations) != 0 {
 		return commonerrors.NewInvalidArgument("invalid subscribe request", violations...)
 	}
 	return nil
 }
+
+func (Server) convertToSubscriptionOptions(request *brokerpb.SubscribeRequest) (svc.SubscriptionOptions, error) {
+	subscriptionFilter, err := filter.Parse(request.GetFilter())
+	if err != nil {
+		return svc.SubscriptionOptions{}, commonerrors.NewInvalidArgument("invalid subscribe request", commonerrors.FieldViolation{
+			Field:       "filter",
+			Reason:      "INVALID_FILTER",
+			Description: err.Error(),
+		})
+	}
+
+	return svc.SubscriptionOptions{
+		Filter:             subscriptionFilter,
+		ReceiveRetained:    request.GetReceiveRetained(),
+		Type:               subscriptionTypes[request.GetType()],
+		AckTimeout:         request.GetAckTimeout().AsDuration(),
+		SessionTimeout:     request.GetSessionTimeout().AsDuration(),
+		AcceptCompressions: request.GetAcceptCompressions(),
+	}, nil
+}
+
+var subscriptionTypes = map[brokerpb.SubscriptionType]svc.SubscriptionType{
+	brokerpb.SubscriptionType_SUBSCRIPTION_TYPE_UNSPECIFIED: svc.PartitionedSubscription,
+	brokerpb.SubscriptionType_SUBSCRIPTION_TYPE_PARTITIONED: svc.PartitionedSubscription,
+	brokerpb.SubscriptionType_SUBSCRIPTION_TYPE_SHARED:      svc.SharedSubscription,
+	brokerpb.SubscriptionType_SUBSCRIPTION_TYPE_KEY_SHARED:  svc.KeySharedSubscription,
+	brokerpb.SubscriptionType_SUBSCRIPTION_TYPE_KEY_ORDERED: svc.KeyOrderedSubscription,
+	brokerpb.SubscriptionType_SUBSCRIPTION_TYPE_EXCLUSIVE:   svc.ExclusiveSubscription,
+	brokerpb.SubscriptionType_SUBSCRIPTION_TYPE_FAILOVER:    svc.FailoverSubscription,
+}
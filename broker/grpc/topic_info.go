@@ -0,0 +1,44 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+
+	brokerpb "pubsub/broker/proto/broker"
+	commonerrors "pubsub/common/errors"
+)
+
+func (s Server) GetTopicInfo(ctx context.Context, request *brokerpb.GetTopicInfoRequest) (*brokerpb.TopicInfo, error) {
+	if err := s.validateGetTopicInfoRequest(request); err != nil {
+		return nil, fmt.Errorf("getting topic info: %w", err)
+	}
+
+	info, err := s.svc.TopicInfo(request.GetTopic())
+	if err != nil {
+		return nil, fmt.Errorf("getting topic info: %w", err)
+	}
+	return brokerpb.TopicInfo_builder{
+		NumOfPartitions: toPtr(int32(info.NumberOfPartitions)),
+		MaxMessageSize:  toPtr(int32(s.topicMaxMessageSize(request.GetTopic()))),
+		Metrics: brokerpb.TopicMetrics_builder{
+			ExpiredSkipped:   toPtr(info.Metrics.ExpiredSkipped),
+			ExpiredReclaimed: toPtr(info.Metrics.ExpiredReclaimed),
+			Compacted:        toPtr(info.Metrics.Compacted),
+		}.Build(),
+	}.Build(), nil
+}
+
+func (Server) validateGetTopicInfoRequest(request *brokerpb.GetTopicInfoRequest) error {
+	violations := []commonerrors.FieldViolation{}
+	if !request.HasTopic() {
+		violations = append(violations, commonerrors.FieldViolation{
+			Field:  "topic",
+			Reason: "REQUIRED_FIELD",
+		})
+	}
+
+	if len(violations) != 0 {
+		return commonerrors.NewInvalidArgument("invalid get topic info request", violations...)
+	}
+	return nil
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"log/slog"
 	"net"
 	"os"
+	"slices"
+	"time"
 
 	"google.golang.org/grpc"
 
@@ -17,24 +21,236 @@ import (
 )
 
 type Config struct {
-	Logging logging.Config `koanf:"logging"`
-	Port    int            `koanf:"port"`
-	Topics  []Topic        `koanf:"topics"`
+	Logging           logging.Config `koanf:"logging"`
+	Port              int            `koanf:"port"`
+	MaxMessageSize    int            `koanf:"max_message_size"`
+	MaxRequestSize    int            `koanf:"max_request_size"`
+	MaxResponseSize   int            `koanf:"max_response_size"`
+	RetentionInterval time.Duration  `koanf:"retention_interval"`
+	Topics            []Topic        `koanf:"topics"`
+	Schemas           []Schema       `koanf:"schemas"`
+	// The client IDs allowed to register schemas, or every client if empty.
+	SchemaRegistrants []string `koanf:"schema_registrants"`
 }
 
 type Topic struct {
 	Name               string `koanf:"name"`
 	NumberOfPartitions int    `koanf:"num_of_partitions"`
+	// One of hash, the default, round_robin, sticky, key_range, murmur2 or consistent_hash.
+	PartitionStrategy string `koanf:"partition_strategy"`
+	// The key each partition after the first starts from, for the key_range strategy.
+	KeySplitPoints []string      `koanf:"key_split_points"`
+	MessageTTL     time.Duration `koanf:"message_ttl"`
+	RetainPerKey   bool          `koanf:"retain_per_key"`
+	SchemaSubject  string        `koanf:"schema_subject"`
+	MaxMessageSize int           `koanf:"max_message_size"`
+	// One of delete, the default, or compact.
+	CleanupPolicy     string `koanf:"cleanup_policy"`
+	ReplicationFactor int    `koanf:"replication_factor"`
+	ACL               ACL    `koanf:"acl"`
+	// Whether partitions can be added when reloading, for strategies which partition by key other
+	// than consistent_hash.
+	AllowKeyRemapping bool `koanf:"allow_key_remapping"`
+}
+
+// A Schema is registered as the next version of its subject's schema when the Broker starts.
+type Schema struct {
+	Subject string `koanf:"subject"`
+	// One of protobuf, json or avro.
+	Type string `koanf:"type"`
+	// Path to the schema's definition: a serialised FileDescriptorSet for protobuf, or the schema's
+	// JSON otherwise.
+	File string `koanf:"file"`
+	// The full name of the payload's message type, for protobuf.
+	MessageName string `koanf:"message_name"`
+	// One of none, backward, forward or full. Defaults to the subject's existing mode, or backward.
+	Compatibility string `koanf:"compatibility"`
+}
+
+type ACL struct {
+	Publish   []string `koanf:"publish"`
+	Subscribe []string `koanf:"subscribe"`
+}
+
+var partitionStrategies = map[string]brokergrpc.PartitionStrategy{
+	"":                brokergrpc.HashPartition,
+	"hash":            brokergrpc.HashPartition,
+	"round_robin":     brokergrpc.RoundRobinPartition,
+	"sticky":          brokergrpc.StickyPartition,
+	"key_range":       brokergrpc.KeyRangePartition,
+	"murmur2":         brokergrpc.Murmur2Partition,
+	"consistent_hash": brokergrpc.ConsistentHashPartition,
+}
+
+var cleanupPolicies = map[string]brokergrpc.CleanupPolicy{
+	"":        brokergrpc.DeleteCleanup,
+	"delete":  brokergrpc.DeleteCleanup,
+	"compact": brokergrpc.CompactCleanup,
+}
+
+var schemaTypes = map[string]brokergrpc.SchemaType{
+	"protobuf": brokergrpc.ProtobufSchema,
+	"json":     brokergrpc.JSONSchema,
+	"avro":     brokergrpc.AvroSchema,
+}
+
+var compatibilities = map[string]brokergrpc.Compatibility{
+	"":         brokergrpc.UnspecifiedCompatibility,
+	"none":     brokergrpc.NoCompatibility,
+	"backward": brokergrpc.BackwardCompatibility,
+	"forward":  brokergrpc.ForwardCompatibility,
+	"full":     brokergrpc.FullCompatibility,
+}
+
+var defaultConfig = Config{
+	Port:              9123,
+	RetentionInterval: 10 * time.Second,
+}
+
+func (c Config) Validate() error {
+	var errs []error
+	if c.Port < 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: must be between 0 and 65535, got %d", c.Port))
+	}
+	if c.MaxMessageSize < 0 {
+		errs = append(errs, fmt.Errorf("max_message_size: must not be negative, got %d", c.MaxMessageSize))
+	}
+	if c.MaxRequestSize < 0 {
+		errs = append(errs, fmt.Errorf("max_request_size: must not be negative, got %d", c.MaxRequestSize))
+	}
+	if c.MaxResponseSize < 0 {
+		errs = append(errs, fmt.Errorf("max_response_size: must not be negative, got %d", c.MaxResponseSize))
+	}
+	if c.RetentionInterval < 0 {
+		errs = append(errs, fmt.Errorf("retention_interval: must not be negative, got %s", c.RetentionInterval))
+	}
+	if _, err := c.topics(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := c.schemas(); err != nil {
+		errs = append(errs, err)
+	}
+	if slices.Contains(c.SchemaRegistrants, "") {
+		errs = append(errs, errors.New("schema_registrants: client IDs must not be empty"))
+	}
+	return errors.Join(errs...)
+}
+
+// The configured topics, or why any of them are invalid. The topics are validated further when
+// the server is created.
+func (c Config) topics() ([]brokergrpc.Topic, error) {
+	topics := make([]brokergrpc.Topic, 0, len(c.Topics))
+	var errs []error
+	for i, t := range c.Topics {
+		if t.Name == "" {
+			errs = append(errs, fmt.Errorf("topics[%d].name: required", i))
+		}
+		partitionStrategy, ok := partitionStrategies[t.PartitionStrategy]
+		if !ok {
+			errs = append(errs, fmt.Errorf("topics[%d].partition_strategy: unknown strategy %q, expected hash, round_robin, sticky, key_range, murmur2 or consistent_hash", i, t.PartitionStrategy))
+		}
+		cleanupPolicy, ok := cleanupPolicies[t.CleanupPolicy]
+		if !ok {
+			errs = append(errs, fmt.Errorf("topics[%d].cleanup_policy: unknown policy %q, expected delete or compact", i, t.CleanupPolicy))
+		}
+
+		topics = append(topics, brokergrpc.Topic{
+			Name:               t.Name,
+			NumberOfPartitions: t.NumberOfPartitions,
+			PartitionStrategy:  partitionStrategy,
+			KeySplitPoints:     t.KeySplitPoints,
+			MessageTTL:         t.MessageTTL,
+			RetainPerKey:       t.RetainPerKey,
+			SchemaSubject:      t.SchemaSubject,
+			MaxMessageSize:     t.MaxMessageSize,
+			CleanupPolicy:      cleanupPolicy,
+			ReplicationFactor:  t.ReplicationFactor,
+			ACL: brokergrpc.ACL{
+				Publishers:  t.ACL.Publish,
+				Subscribers: t.ACL.Subscribe,
+			},
+			AllowKeyRemapping: t.AllowKeyRemapping,
+		})
+	}
+	return topics, errors.Join(errs...)
+}
+
+// The configured schemas with their definitions read, or why any of them are invalid. The
+// definitions are validated further when the server is created.
+func (c Config) schemas() ([]brokergrpc.Schema, error) {
+	schemas := make([]brokergrpc.Schema, 0, len(c.Schemas))
+	var errs []error
+	for i, s := range c.Schemas {
+		if s.Subject == "" {
+			errs = append(errs, fmt.Errorf("schemas[%d].subject: required", i))
+		}
+		schemaType, ok := schemaTypes[s.Type]
+		if !ok {
+			errs = append(errs, fmt.Errorf("schemas[%d].type: unknown type %q, expected protobuf, json or avro", i, s.Type))
+		}
+		if schemaType == brokergrpc.ProtobufSchema && s.MessageName == "" {
+			errs = append(errs, fmt.Errorf("schemas[%d].message_name: required for protobuf", i))
+		}
+		compatibility, ok := compatibilities[s.Compatibility]
+		if !ok {
+			errs = append(errs, fmt.Errorf("schemas[%d].compatibility: unknown mode %q, expected none, backward, forward or full", i, s.Compatibility))
+		}
+		var definition []byte
+		if s.File == "" {
+			errs = append(errs, fmt.Errorf("schemas[%d].file: required", i))
+		} else {
+			var err error
+			if definition, err = os.ReadFile(s.File); err != nil {
+				errs = append(errs, fmt.Errorf("schemas[%d].file: %w", i, err))
+			}
+		}
+
+		schemas = append(schemas, brokergrpc.Schema{
+			Subject:       s.Subject,
+			Type:          schemaType,
+			Definition:    definition,
+			MessageName:   s.MessageName,
+			Compatibility: compatibility,
+		})
+	}
+	return schemas, errors.Join(errs...)
 }
 
 func main() {
-	cfg, err := config.ParseYAML[Config]("broker/config.yml", "config")
+	loader, err := config.NewLoader(defaultConfig, config.Options{
+		DefaultFiles: []string{"broker/config.yml"},
+		ConfigPath:   "config",
+		EnvPrefix:    "PUBSUB_",
+	}, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("Parsing flags", slog.Any("error", err))
+		os.Exit(2)
+	}
+	cfg, err := loader.Load()
 	if err != nil {
-		slog.Error("Parsing config", slog.Any("error", err))
+		slog.Error("Loading config", slog.Any("error", err))
 		os.Exit(1)
 	}
 	logging.SetLevel(cfg.Logging)
-	slog.Debug("Config loaded", slog.Any("config", cfg))
+	slog.Debug("Config loaded", slog.Any("files", loader.Files()), slog.Any("config", cfg))
+
+	// The topics and schemas were validated when the config was loaded.
+	topics, _ := cfg.topics()
+	schemas, _ := cfg.schemas()
+	server, err := brokergrpc.NewServer(brokergrpc.Options{
+		MaxMessageSize:    cfg.MaxMessageSize,
+		MaxRequestSize:    cfg.MaxRequestSize,
+		MaxResponseSize:   cfg.MaxResponseSize,
+		Schemas:           schemas,
+		SchemaRegistrants: cfg.SchemaRegistrants,
+	}, topics...)
+	if err != nil {
+		slog.Error("Invalid config", slog.Any("error", err))
+		os.Exit(1)
+	}
 
 	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", cfg.Port))
 	if err != nil {
@@ -42,17 +258,22 @@ func main() {
 		os.Exit(1)
 	}
 
-	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcerrors.UnaryServerInterceptor))
+	serverOpts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(grpcerrors.UnaryServerInterceptor)}
+	if cfg.MaxRequestSize != 0 {
+		serverOpts = append(serverOpts, grpc.MaxRecvMsgSize(cfg.MaxRequestSize))
+	}
+	if cfg.MaxResponseSize != 0 {
+		serverOpts = append(serverOpts, grpc.MaxSendMsgSize(cfg.MaxResponseSize))
+	}
+	srv := grpc.NewServer(serverOpts...)
 
-	topics := make([]brokergrpc.Topic, 0, len(cfg.Topics))
-	for _, t := range cfg.Topics {
-		topics = append(topics, brokergrpc.Topic{
-			Name:               t.Name,
-			NumberOfPartitions: t.NumberOfPartitions,
-			PartitionStrategy:  brokergrpc.HashPartition,
-		})
+	brokerpb.RegisterBrokerServer(srv, server)
+
+	reloader := newReloader(server, cfg)
+	if err := loader.Watch(reloader.reload); err != nil {
+		slog.Error("Watching config", slog.Any("error", err))
+		os.Exit(1)
 	}
-	brokerpb.RegisterBrokerServer(srv, brokergrpc.NewServer(topics...))
 
 	log.Printf("Starting Broker, listening on port %d.\n", cfg.Port)
 	if srv.Serve(lis); err != nil {
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+
+	brokergrpc "pubsub/broker/grpc"
+	"pubsub/common/logging"
+)
+
+// A reloader applies changes to the config files while the Broker is running. Topics can be created,
+// and their retention, max message sizes and ACLs changed, as can the logging verbosity and the
+// retention interval. Changes which can't be applied live are logged and ignored, and take effect
+// on restart if they're valid.
+type reloader struct {
+	mutex sync.Mutex
+
+	server brokergrpc.Server
+	// The config as applied, so without any changes which were ignored.
+	cfg           Config
+	stopRetention context.CancelFunc
+}
+
+func newReloader(server brokergrpc.Server, cfg Config) *reloader {
+	r := &reloader{
+		server: server,
+		cfg:    cfg,
+	}
+	r.startRetention()
+	return r
+}
+
+// Run retention at the config's interval, if any, stopping any previous run. The mutex must be
+// held, except when creating the reloader.
+func (r *reloader) startRetention() {
+	if r.stopRetention != nil {
+		r.stopRetention()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stopRetention = cancel
+	if r.cfg.RetentionInterval > 0 {
+		go r.server.RunRetention(ctx, r.cfg.RetentionInterval)
+	}
+}
+
+// Apply the changes from the applied config to the new config which can be applied live. Nothing
+// is applied if the new config is invalid.
+func (r *reloader) reload(cfg Config, err error) {
+	if err != nil {
+		slog.Error("Reloading config", slog.Any("error", err))
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	applied := r.cfg
+	var restartChanges []change
+	restartChanges = append(restartChanges, diff("port", r.cfg.Port, cfg.Port)...)
+	restartChanges = append(restartChanges, diff("max_message_size", r.cfg.MaxMessageSize, cfg.MaxMessageSize)...)
+	restartChanges = append(restartChanges, diff("max_request_size", r.cfg.MaxRequestSize, cfg.MaxRequestSize)...)
+	restartChanges = append(restartChanges, diff("max_response_size", r.cfg.MaxResponseSize, cfg.MaxResponseSize)...)
+	restartChanges = append(restartChanges, diff("schemas", r.cfg.Schemas, cfg.Schemas)...)
+	restartChanges = append(restartChanges, diff("schema_registrants", r.cfg.SchemaRegistrants, cfg.SchemaRegistrants)...)
+	if len(restartChanges) != 0 {
+		slog.Warn("Ignoring config changes which need a restart", slog.Any("changes", restartChanges))
+	}
+
+	if changes := diff("logging", r.cfg.Logging, cfg.Logging); len(changes) != 0 {
+		logging.SetLevel(cfg.Logging)
+		applied.Logging = cfg.Logging
+		slog.Info("Applied config changes", slog.Any("changes", changes))
+	}
+
+	if changes := diff("retention_interval", r.cfg.RetentionInterval, cfg.RetentionInterval); len(changes) != 0 {
+		applied.RetentionInterval = cfg.RetentionInterval
+		slog.Info("Applied config changes", slog.Any("changes", changes))
+	}
+
+	applied.Topics = r.reloadTopics(cfg)
+	retentionChanged := applied.RetentionInterval != r.cfg.RetentionInterval
+	r.cfg = applied
+	if retentionChanged {
+		r.startRetention()
+	}
+}
+
+// Create the new config's new topics and update its changed topics, returning the topics' config
+// as applied. The mutex must be held.
+func (r *reloader) reloadTopics(cfg Config) []Topic {
+	// The topics were validated when the config was loaded.
+	topics, _ := cfg.topics()
+
+	previousByName := make(map[string]Topic, len(r.cfg.Topics))
+	for _, t := range r.cfg.Topics {
+		previousByName[t.Name] = t
+	}
+	applied := make([]Topic, 0, len(cfg.Topics))
+	for i, t := range cfg.Topics {
+		previous, ok := previousByName[t.Name]
+		delete(previousByName, t.Name)
+		if !ok {
+			if err := r.server.CreateTopic(topics[i]); err != nil {
+				slog.Warn("Rejected new topic", slog.String("topic", t.Name), slog.Any("error", err))
+				continue
+			}
+			slog.Info("Created topic", slog.String("topic", t.Name))
+			applied = append(applied, t)
+			continue
+		}
+
+		changes := diff(fmt.Sprintf("topics[%s]", t.Name), previous, t)
+		if len(changes) == 0 {
+			applied = append(applied, t)
+			continue
+		}
+		if err := r.server.UpdateTopic(topics[i]); err != nil {
+			slog.Warn("Rejected topic config changes", slog.String("topic", t.Name), slog.Any("changes", changes), slog.Any("error", err))
+			applied = append(applied, previous)
+			continue
+		}
+		slog.Info("Applied config changes", slog.String("topic", t.Name), slog.Any("changes", changes))
+		applied = append(applied, t)
+	}
+
+	// Topics can't be deleted as they may have subscribers, so they're kept in the applied config.
+	for _, t := range r.cfg.Topics {
+		if _, ok := previousByName[t.Name]; ok {
+			slog.Warn("Ignoring removed topic, which needs a restart", slog.String("topic", t.Name))
+			applied = append(applied, t)
+		}
+	}
+	return applied
+}
+
+// A change of a config value, named by its path.
+type change struct {
+	path     string
+	old, new any
+}
+
+func (c change) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.path, c.old, c.new)
+}
+
+// The changes between the old and new values, recursing into structs' fields by their koanf names.
+func diff(path string, old, new any) []change {
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	if oldValue.Kind() != reflect.Struct {
+		if reflect.DeepEqual(old, new) {
+			return nil
+		}
+		return []change{{path: path, old: old, new: new}}
+	}
+
+	var changes []change
+	for i := range oldValue.NumField() {
+		name := oldValue.Type().Field(i).Tag.Get("koanf")
+		changes = append(changes, diff(path+"."+name, oldValue.Field(i).Interface(), newValue.Field(i).Interface())...)
+	}
+	return changes
+}
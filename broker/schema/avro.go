@@ -0,0 +1,423 @@
+package schema
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+var avroPrimitives = []string{"null", "boolean", "int", "long", "float", "double", "bytes", "string"}
+
+// The types each Avro primitive can be promoted to when read, besides itself.
+var avroPromotions = map[string][]string{
+	"int":    {"long", "float", "double"},
+	"long":   {"float", "double"},
+	"float":  {"double"},
+	"string": {"bytes"},
+	"bytes":  {"string"},
+}
+
+// An Avro schema, which payloads are a single datum of in Avro's binary encoding.
+type avroSchema struct {
+	root *avroType
+}
+
+type avroType struct {
+	// One of the primitives, or record, enum, array, map, union or fixed.
+	kind string
+	// Full name of a record, enum or fixed.
+	name string
+
+	fields  []avroField
+	symbols []string
+	// Whether the enum has a default symbol, used when reading symbols it doesn't define.
+	hasDefault bool
+	// The items of an array, or values of a map.
+	items    *avroType
+	branches []*avroType
+	size     int
+}
+
+type avroField struct {
+	name       string
+	typ        *avroType
+	hasDefault bool
+}
+
+type avroParser struct {
+	named map[string]*avroType
+}
+
+func compileAvro(definition []byte) (validator, error) {
+	var schema any
+	if err := json.Unmarshal(definition, &schema); err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	parser := avroParser{named: map[string]*avroType{}}
+	root, err := parser.parse(schema, "")
+	if err != nil {
+		return nil, err
+	}
+	return avroSchema{root: root}, nil
+}
+
+func (p avroParser) parse(schema any, namespace string) (*avroType, error) {
+	switch schema := schema.(type) {
+	case string:
+		if slices.Contains(avroPrimitives, schema) {
+			return &avroType{kind: schema}, nil
+		}
+		if t, ok := p.named[fullName(schema, namespace)]; ok {
+			return t, nil
+		}
+		if t, ok := p.named[schema]; ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", schema)
+	case []any:
+		union := &avroType{kind: "union"}
+		for _, branch := range schema {
+			t, err := p.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			if t.kind == "union" {
+				return nil, fmt.Errorf("unions can't contain unions")
+			}
+			union.branches = append(union.branches, t)
+		}
+		return union, nil
+	case map[string]any:
+		return p.parseComplex(schema, namespace)
+	default:
+		return nil, fmt.Errorf("invalid schema %v", schema)
+	}
+}
+
+func (p avroParser) parseComplex(schema map[string]any, namespace string) (*avroType, error) {
+	kind, _ := schema["type"].(string)
+	switch kind {
+	case "record", "error", "enum", "fixed":
+		name, _ := schema["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("%s must have a name", kind)
+		}
+		if ns, ok := schema["namespace"].(string); ok {
+			namespace = ns
+		}
+		t := &avroType{kind: kind, name: fullName(name, namespace)}
+		if kind == "error" {
+			t.kind = "record"
+		}
+		if _, ok := p.named[t.name]; ok {
+			return nil, fmt.Errorf("type %q is defined more than once", t.name)
+		}
+		// Registered before its fields are parsed, so they can refer to it.
+		p.named[t.name] = t
+		if i := strings.LastIndexByte(t.name, '.'); i >= 0 {
+			namespace = t.name[:i]
+		}
+		return t, p.parseNamed(t, schema, namespace)
+	case "array", "map":
+		key := "items"
+		if kind == "map" {
+			key = "values"
+		}
+		items, ok := schema[key]
+		if !ok {
+			return nil, fmt.Errorf("%s must have %s", kind, key)
+		}
+		t, err := p.parse(items, namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroType{kind: kind, items: t}, nil
+	default:
+		// Primitives can be written as objects, e.g. to give a logical type.
+		if slices.Contains(avroPrimitives, kind) {
+			return &avroType{kind: kind}, nil
+		}
+		return nil, fmt.Errorf("unknown type %v", schema["type"])
+	}
+}
+
+func (p avroParser) parseNamed(t *avroType, schema map[string]any, namespace string) error {
+	switch t.kind {
+	case "record":
+		fields, ok := schema["fields"].([]any)
+		if !ok {
+			return fmt.Errorf("record %q must have fields", t.name)
+		}
+		for _, field := range fields {
+			field, ok := field.(map[string]any)
+			if !ok {
+				return fmt.Errorf("record %q has an invalid field", t.name)
+			}
+			name, _ := field["name"].(string)
+			if name == "" {
+				return fmt.Errorf("record %q has a field without a name", t.name)
+			}
+			typ, err := p.parse(field["type"], namespace)
+			if err != nil {
+				return fmt.Errorf("field %q of record %q: %w", name, t.name, err)
+			}
+			_, hasDefault := field["default"]
+			t.fields = append(t.fields, avroField{name: name, typ: typ, hasDefault: hasDefault})
+		}
+	case "enum":
+		symbols, ok := schema["symbols"].([]any)
+		if !ok || len(symbols) == 0 {
+			return fmt.Errorf("enum %q must have symbols", t.name)
+		}
+		for _, symbol := range symbols {
+			symbol, ok := symbol.(string)
+			if !ok {
+				return fmt.Errorf("enum %q has an invalid symbol", t.name)
+			}
+			t.symbols = append(t.symbols, symbol)
+		}
+		_, t.hasDefault = schema["default"]
+	case "fixed":
+		size, ok := schema["size"].(float64)
+		if !ok || size < 0 || size != math.Trunc(size) {
+			return fmt.Errorf("fixed %q must have a size", t.name)
+		}
+		t.size = int(size)
+	}
+	return nil
+}
+
+func fullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func (s avroSchema) validate(payload []byte) []Violation {
+	decoder := &avroDecoder{data: payload}
+	if violation := decoder.decode(s.root, ""); violation != nil {
+		return []Violation{*violation}
+	}
+	if len(decoder.data) != 0 {
+		return []Violation{{Description: fmt.Sprintf("%d bytes after the datum", len(decoder.data))}}
+	}
+	return nil
+}
+
+// Decodes a datum, stopping at the first invalid value as the rest can't be located.
+type avroDecoder struct {
+	data []byte
+}
+
+func (d *avroDecoder) decode(t *avroType, path string) *Violation {
+	invalid := func(format string, args ...any) *Violation {
+		return &Violation{Path: path, Description: fmt.Sprintf(format, args...)}
+	}
+
+	switch t.kind {
+	case "null":
+	case "boolean":
+		if len(d.data) < 1 || d.data[0] > 1 {
+			return invalid("invalid boolean")
+		}
+		d.data = d.data[1:]
+	case "int", "long":
+		n, ok := d.long()
+		if !ok {
+			return invalid("invalid %s", t.kind)
+		}
+		if t.kind == "int" && (n < math.MinInt32 || n > math.MaxInt32) {
+			return invalid("int out of range")
+		}
+	case "float", "double":
+		size := 4
+		if t.kind == "double" {
+			size = 8
+		}
+		if len(d.data) < size {
+			return invalid("truncated %s", t.kind)
+		}
+		d.data = d.data[size:]
+	case "bytes", "string":
+		b, ok := d.bytes()
+		if !ok {
+			return invalid("invalid %s length", t.kind)
+		}
+		if t.kind == "string" && !utf8.Valid(b) {
+			return invalid("string isn't valid UTF-8")
+		}
+	case "fixed":
+		if len(d.data) < t.size {
+			return invalid("truncated fixed")
+		}
+		d.data = d.data[t.size:]
+	case "enum":
+		i, ok := d.long()
+		if !ok || i < 0 || i >= int64(len(t.symbols)) {
+			return invalid("invalid enum index")
+		}
+	case "union":
+		i, ok := d.long()
+		if !ok || i < 0 || i >= int64(len(t.branches)) {
+			return invalid("invalid union branch")
+		}
+		return d.decode(t.branches[i], path)
+	case "record":
+		for _, field := range t.fields {
+			if violation := d.decode(field.typ, joinPath(path, field.name)); violation != nil {
+				return violation
+			}
+		}
+	case "array", "map":
+		return d.decodeBlocks(t, path)
+	}
+	return nil
+}
+
+// Decode the blocks of an array or map, each a count of items followed by the items.
+func (d *avroDecoder) decodeBlocks(t *avroType, path string) *Violation {
+	for i := 0; ; {
+		count, ok := d.long()
+		if !ok {
+			return &Violation{Path: path, Description: fmt.Sprintf("invalid %s block count", t.kind)}
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			// A negative count is followed by the block's size in bytes.
+			count = -count
+			if _, ok := d.long(); !ok {
+				return &Violation{Path: path, Description: fmt.Sprintf("invalid %s block size", t.kind)}
+			}
+		}
+		for ; count > 0; count-- {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			if t.kind == "map" {
+				key, ok := d.bytes()
+				if !ok || !utf8.Valid(key) {
+					return &Violation{Path: itemPath, Description: "invalid map key"}
+				}
+				itemPath = fmt.Sprintf("%s[%s]", path, key)
+			}
+			if violation := d.decode(t.items, itemPath); violation != nil {
+				return violation
+			}
+			i++
+		}
+	}
+}
+
+// Decode a zig-zag encoded varint.
+func (d *avroDecoder) long() (int64, bool) {
+	n, size := binary.Varint(d.data)
+	if size <= 0 {
+		return 0, false
+	}
+	d.data = d.data[size:]
+	return n, true
+}
+
+func (d *avroDecoder) bytes() ([]byte, bool) {
+	n, ok := d.long()
+	if !ok || n < 0 || n > int64(len(d.data)) {
+		return nil, false
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, true
+}
+
+func (s avroSchema) incompatibilities(writer validator) []string {
+	return avroReadIncompatibilities(s.root, writer.(avroSchema).root, "", map[[2]*avroType]bool{})
+}
+
+// Why data written with the writer's schema couldn't be read with the reader's, following Avro's
+// schema resolution rules. Aliases aren't supported, so renamed types and fields don't match.
+func avroReadIncompatibilities(reader, writer *avroType, path string, seen map[[2]*avroType]bool) []string {
+	location := path
+	if location == "" {
+		location = "payload"
+	}
+
+	if writer.kind == "union" {
+		var incompatibilities []string
+		for _, branch := range writer.branches {
+			incompatibilities = append(incompatibilities, avroReadIncompatibilities(reader, branch, path, seen)...)
+		}
+		return incompatibilities
+	}
+	if reader.kind == "union" {
+		for _, branch := range reader.branches {
+			if len(avroReadIncompatibilities(branch, writer, path, seen)) == 0 {
+				return nil
+			}
+		}
+		return []string{fmt.Sprintf("%s: %s isn't in the union", location, describeAvroType(writer))}
+	}
+
+	if reader.kind != writer.kind {
+		if slices.Contains(avroPromotions[writer.kind], reader.kind) {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: %s can't be read as %s", location, describeAvroType(writer), describeAvroType(reader))}
+	}
+	// Named types match by their unqualified names.
+	if shortName(reader.name) != shortName(writer.name) {
+		return []string{fmt.Sprintf("%s: %s can't be read as %s", location, describeAvroType(writer), describeAvroType(reader))}
+	}
+
+	// Recursive types are only compared once.
+	pair := [2]*avroType{reader, writer}
+	if seen[pair] {
+		return nil
+	}
+	seen[pair] = true
+
+	var incompatibilities []string
+	switch reader.kind {
+	case "record":
+		for _, field := range reader.fields {
+			i := slices.IndexFunc(writer.fields, func(f avroField) bool { return f.name == field.name })
+			if i < 0 {
+				if !field.hasDefault {
+					incompatibilities = append(incompatibilities, fmt.Sprintf("%s: field has no default", joinPath(path, field.name)))
+				}
+				continue
+			}
+			incompatibilities = append(incompatibilities, avroReadIncompatibilities(field.typ, writer.fields[i].typ, joinPath(path, field.name), seen)...)
+		}
+	case "enum":
+		if reader.hasDefault {
+			break
+		}
+		for _, symbol := range writer.symbols {
+			if !slices.Contains(reader.symbols, symbol) {
+				incompatibilities = append(incompatibilities, fmt.Sprintf("%s: enum symbol %s is unknown", location, symbol))
+			}
+		}
+	case "fixed":
+		if reader.size != writer.size {
+			incompatibilities = append(incompatibilities, fmt.Sprintf("%s: fixed size %d can't be read as %d", location, writer.size, reader.size))
+		}
+	case "array", "map":
+		incompatibilities = append(incompatibilities, avroReadIncompatibilities(reader.items, writer.items, path+"[]", seen)...)
+	}
+	return incompatibilities
+}
+
+func describeAvroType(t *avroType) string {
+	if t.name != "" {
+		return fmt.Sprintf("%s %s", t.kind, t.name)
+	}
+	return t.kind
+}
+
+func shortName(name string) string {
+	return name[strings.LastIndexByte(name, '.')+1:]
+}
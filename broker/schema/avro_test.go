@@ -0,0 +1,134 @@
+package schema
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+)
+
+// Encode Avro longs and strings, given as int and string values, and raw bytes.
+func avroEncode(values ...any) []byte {
+	var data []byte
+	for _, value := range values {
+		switch value := value.(type) {
+		case int:
+			data = binary.AppendVarint(data, int64(value))
+		case string:
+			data = binary.AppendVarint(data, int64(len(value)))
+			data = append(data, value...)
+		case []byte:
+			data = append(data, value...)
+		}
+	}
+	return data
+}
+
+func TestAvroValidate(t *testing.T) {
+	const person = `{
+		"type": "record",
+		"name": "Person",
+		"namespace": "example",
+		"fields": [
+			{"name": "name", "type": "string"},
+			{"name": "age", "type": "int"},
+			{"name": "nickname", "type": ["null", "string"]},
+			{"name": "kind", "type": {"type": "enum", "name": "Kind", "symbols": ["A", "B"]}},
+			{"name": "tags", "type": {"type": "array", "items": "string"}},
+			{"name": "scores", "type": {"type": "map", "values": "double"}},
+			{"name": "id", "type": {"type": "fixed", "name": "ID", "size": 2}},
+			{"name": "active", "type": "boolean"},
+			{"name": "parent", "type": ["null", "Person"]}
+		]
+	}`
+	tests := []struct {
+		name    string
+		schema  string
+		payload []byte
+		// The path of the violation, or none if the payload is valid.
+		want []string
+	}{
+		{name: "valid", schema: person, payload: avroEncode("a", 1, 1, "nick", 1, 2, "x", "y", 0, 1, "k", []byte{0, 0, 0, 0, 0, 0, 0, 0}, 0, []byte{1, 2}, []byte{0}, 0)},
+		{name: "recursive", schema: person, payload: avroEncode("a", 1, 0, 0, 0, 0, []byte{1, 2}, []byte{1}, 1, "b", 2, 0, 0, 0, 0, []byte{1, 2}, []byte{1}, 0)},
+		{name: "truncated string", schema: person, payload: avroEncode(4, "a"), want: []string{"name"}},
+		{name: "invalid UTF-8", schema: person, payload: avroEncode("\xff"), want: []string{"name"}},
+		{name: "int out of range", schema: person, payload: avroEncode("a", math.MaxInt32+1), want: []string{"age"}},
+		{name: "union branch", schema: person, payload: avroEncode("a", 1, 2), want: []string{"nickname"}},
+		{name: "enum index", schema: person, payload: avroEncode("a", 1, 0, 2), want: []string{"kind"}},
+		{name: "array item", schema: person, payload: avroEncode("a", 1, 0, 0, 2, "x", []byte{0x80}), want: []string{"tags[1]"}},
+		{name: "map value after a sized block", schema: person, payload: avroEncode("a", 1, 0, 0, -1, 2, "x", 0, 1, "k", []byte{0}), want: []string{"scores[k]"}},
+		{name: "fixed", schema: person, payload: avroEncode("a", 1, 0, 0, 0, 0, []byte{1}), want: []string{"id"}},
+		{name: "boolean", schema: person, payload: avroEncode("a", 1, 0, 0, 0, 0, []byte{1, 2}, []byte{2}), want: []string{"active"}},
+		{name: "nested", schema: person, payload: avroEncode("a", 1, 0, 0, 0, 0, []byte{1, 2}, []byte{1}, 1, "b", 1<<40), want: []string{"parent.age"}},
+		{name: "trailing bytes", schema: `"long"`, payload: avroEncode(1, 1), want: []string{""}},
+		{name: "null", schema: `"null"`, payload: nil},
+		{name: "truncated double", schema: `"double"`, payload: []byte{1, 2, 3}, want: []string{""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := mustCompile(t, Definition{Type: AvroSchema, Definition: []byte(test.schema)})
+			if got := violationPaths(v.validate(test.payload)); !slices.Equal(got, test.want) {
+				t.Errorf("got violations at %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAvroCompile(t *testing.T) {
+	for _, schema := range []string{
+		`"text"`,
+		`{"type": "record", "fields": []}`,
+		`{"type": "record", "name": "r"}`,
+		`{"type": "record", "name": "r", "fields": [{"name": "a", "type": "Unknown"}]}`,
+		`{"type": "enum", "name": "e", "symbols": []}`,
+		`{"type": "fixed", "name": "f", "size": 1.5}`,
+		`{"type": "array"}`,
+		`[["null"]]`,
+		`[{"type": "fixed", "name": "f", "size": 1}, {"type": "fixed", "name": "f", "size": 2}]`,
+	} {
+		if _, err := compile(Definition{Type: AvroSchema, Definition: []byte(schema)}); err == nil {
+			t.Errorf("compiled invalid schema %s", schema)
+		}
+	}
+}
+
+// Data written with the writer's schema must be readable with a compatible reader's, following
+// Avro's schema resolution rules.
+func TestAvroIncompatibilities(t *testing.T) {
+	record := func(fields string) string {
+		return `{"type": "record", "name": "r", "fields": [` + fields + `]}`
+	}
+	tests := []struct {
+		name           string
+		reader, writer string
+		compatible     bool
+	}{
+		{name: "promoted", reader: `"double"`, writer: `"int"`, compatible: true},
+		{name: "demoted", reader: `"int"`, writer: `"long"`},
+		{name: "string read as bytes", reader: `"bytes"`, writer: `"string"`, compatible: true},
+		{name: "field with default added", reader: record(`{"name": "a", "type": "int"}, {"name": "b", "type": "int", "default": 0}`), writer: record(`{"name": "a", "type": "int"}`), compatible: true},
+		{name: "field without default added", reader: record(`{"name": "a", "type": "int"}, {"name": "b", "type": "int"}`), writer: record(`{"name": "a", "type": "int"}`)},
+		{name: "field removed", reader: record(`{"name": "a", "type": "int"}`), writer: record(`{"name": "a", "type": "int"}, {"name": "b", "type": "int"}`), compatible: true},
+		{name: "field type changed", reader: record(`{"name": "a", "type": "string"}`), writer: record(`{"name": "a", "type": "int"}`)},
+		{name: "record renamed", reader: `{"type": "record", "name": "s", "fields": []}`, writer: `{"type": "record", "name": "r", "fields": []}`},
+		{name: "namespace changed", reader: `{"type": "record", "name": "a.r", "fields": []}`, writer: `{"type": "record", "name": "b.r", "fields": []}`, compatible: true},
+		{name: "enum symbol added", reader: `{"type": "enum", "name": "e", "symbols": ["A", "B"]}`, writer: `{"type": "enum", "name": "e", "symbols": ["A"]}`, compatible: true},
+		{name: "enum symbol removed", reader: `{"type": "enum", "name": "e", "symbols": ["A"]}`, writer: `{"type": "enum", "name": "e", "symbols": ["A", "B"]}`},
+		{name: "enum symbol removed with default", reader: `{"type": "enum", "name": "e", "symbols": ["A"], "default": "A"}`, writer: `{"type": "enum", "name": "e", "symbols": ["A", "B"]}`, compatible: true},
+		{name: "fixed resized", reader: `{"type": "fixed", "name": "f", "size": 2}`, writer: `{"type": "fixed", "name": "f", "size": 1}`},
+		{name: "written into union", reader: `["null", "string"]`, writer: `"string"`, compatible: true},
+		{name: "not in union", reader: `["null", "string"]`, writer: `"int"`},
+		{name: "union branch removed", reader: `"string"`, writer: `["null", "string"]`},
+		{name: "array items promoted", reader: `{"type": "array", "items": "long"}`, writer: `{"type": "array", "items": "int"}`, compatible: true},
+		{name: "map values changed", reader: `{"type": "map", "values": "int"}`, writer: `{"type": "map", "values": "string"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := mustCompile(t, Definition{Type: AvroSchema, Definition: []byte(test.reader)})
+			writer := mustCompile(t, Definition{Type: AvroSchema, Definition: []byte(test.writer)})
+			if incompatibilities := reader.incompatibilities(writer); (len(incompatibilities) == 0) != test.compatible {
+				t.Errorf("got incompatibilities %q, want compatible %t", incompatibilities, test.compatible)
+			}
+		})
+	}
+}
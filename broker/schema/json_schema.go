@@ -0,0 +1,432 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"unicode/utf8"
+)
+
+// Keywords which would change which payloads are valid but aren't supported, so schemas using them
+// are rejected rather than validated more loosely than intended.
+var unsupportedKeywords = []string{
+	"$ref", "$defs", "definitions", "allOf", "anyOf", "oneOf", "not", "if", "then", "else",
+	"patternProperties", "propertyNames", "dependentRequired", "dependentSchemas", "dependencies",
+	"prefixItems", "contains", "uniqueItems", "exclusiveMinimum", "exclusiveMaximum", "multipleOf",
+	"minProperties", "maxProperties", "unevaluatedProperties", "unevaluatedItems",
+}
+
+var jsonTypes = []string{"null", "boolean", "object", "array", "number", "integer", "string"}
+
+// A JSON Schema, compiled from its JSON. A nil jsonSchema allows any value.
+type jsonSchema struct {
+	// Whether no value is allowed, for the schema `false`.
+	never bool
+	// The types allowed, or every type if empty.
+	types []string
+	enum  []any
+	// The only value allowed, if hasConst.
+	constant any
+	hasConst bool
+
+	minimum, maximum     *float64
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+	minItems, maxItems   *int
+	items                *jsonSchema
+
+	properties map[string]*jsonSchema
+	required   []string
+	// Whether properties not in properties are disallowed, rather than validated against
+	// additionalProperties.
+	noAdditionalProperties bool
+	additionalProperties   *jsonSchema
+}
+
+type rawJSONSchema struct {
+	Type                 json.RawMessage            `json:"type"`
+	Enum                 []any                      `json:"enum"`
+	Const                json.RawMessage            `json:"const"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Pattern              *string                    `json:"pattern"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	Items                json.RawMessage            `json:"items"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+}
+
+func compileJSONSchema(definition []byte) (validator, error) {
+	schema, err := parseJSONSchema(definition, "")
+	if err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func parseJSONSchema(data []byte, path string) (*jsonSchema, error) {
+	data = bytes.TrimSpace(data)
+	switch string(data) {
+	case "true":
+		return nil, nil
+	case "false":
+		return &jsonSchema{never: true}, nil
+	}
+
+	keywords := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &keywords); err != nil {
+		return nil, fmt.Errorf("parsing schema%s: %w", describePath(path), err)
+	}
+	for _, keyword := range unsupportedKeywords {
+		if _, ok := keywords[keyword]; ok {
+			return nil, fmt.Errorf("schema%s: unsupported keyword %q", describePath(path), keyword)
+		}
+	}
+	raw := rawJSONSchema{}
+	if err := unmarshalJSON(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing schema%s: %w", describePath(path), err)
+	}
+
+	schema := &jsonSchema{
+		enum:      raw.Enum,
+		minimum:   raw.Minimum,
+		maximum:   raw.Maximum,
+		minLength: raw.MinLength,
+		maxLength: raw.MaxLength,
+		minItems:  raw.MinItems,
+		maxItems:  raw.MaxItems,
+		required:  raw.Required,
+	}
+	if len(raw.Type) != 0 {
+		if err := unmarshalJSON(raw.Type, &schema.types); err != nil {
+			var single string
+			if err := unmarshalJSON(raw.Type, &single); err != nil {
+				return nil, fmt.Errorf("schema%s: type must be a string or array of strings", describePath(path))
+			}
+			schema.types = []string{single}
+		}
+		for _, t := range schema.types {
+			if !slices.Contains(jsonTypes, t) {
+				return nil, fmt.Errorf("schema%s: unknown type %q", describePath(path), t)
+			}
+		}
+	}
+	if len(raw.Const) != 0 {
+		schema.hasConst = true
+		if err := unmarshalJSON(raw.Const, &schema.constant); err != nil {
+			return nil, fmt.Errorf("parsing schema%s: %w", describePath(path), err)
+		}
+	}
+	if raw.Pattern != nil {
+		pattern, err := regexp.Compile(*raw.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("schema%s: invalid pattern: %w", describePath(path), err)
+		}
+		schema.pattern = pattern
+	}
+	if len(raw.Items) != 0 {
+		items, err := parseJSONSchema(raw.Items, joinPath(path, "[]"))
+		if err != nil {
+			return nil, err
+		}
+		schema.items = items
+	}
+	if len(raw.Properties) != 0 {
+		schema.properties = make(map[string]*jsonSchema, len(raw.Properties))
+		for name, data := range raw.Properties {
+			property, err := parseJSONSchema(data, joinPath(path, name))
+			if err != nil {
+				return nil, err
+			}
+			schema.properties[name] = property
+		}
+	}
+	if len(raw.AdditionalProperties) != 0 {
+		additional, err := parseJSONSchema(raw.AdditionalProperties, joinPath(path, "*"))
+		if err != nil {
+			return nil, err
+		}
+		if additional != nil && additional.never {
+			schema.noAdditionalProperties = true
+		} else {
+			schema.additionalProperties = additional
+		}
+	}
+	return schema, nil
+}
+
+// Unmarshal JSON keeping numbers as json.Number, so integers are told apart from other numbers.
+func unmarshalJSON(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after JSON value")
+	}
+	return nil
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return ""
+	}
+	return " at " + path
+}
+
+func (s *jsonSchema) validate(payload []byte) []Violation {
+	var value any
+	if err := unmarshalJSON(payload, &value); err != nil {
+		return []Violation{{Description: fmt.Sprintf("invalid JSON: %s", err)}}
+	}
+	return s.validateValue("", value)
+}
+
+func (s *jsonSchema) validateValue(path string, value any) []Violation {
+	if s == nil {
+		return nil
+	}
+	if s.never {
+		return []Violation{{Path: path, Description: "no value is allowed"}}
+	}
+	if len(s.types) != 0 && !slices.ContainsFunc(s.types, func(t string) bool { return hasJSONType(value, t) }) {
+		return []Violation{{Path: path, Description: fmt.Sprintf("expected %s, got %s", joinTypes(s.types), jsonTypeOf(value))}}
+	}
+	if s.enum != nil && !slices.ContainsFunc(s.enum, func(v any) bool { return jsonEqual(v, value) }) {
+		return []Violation{{Path: path, Description: "not one of the enum's values"}}
+	}
+	if s.hasConst && !jsonEqual(s.constant, value) {
+		return []Violation{{Path: path, Description: "not the const value"}}
+	}
+
+	var violations []Violation
+	violation := func(path, format string, args ...any) {
+		violations = append(violations, Violation{Path: path, Description: fmt.Sprintf(format, args...)})
+	}
+	switch value := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(value)
+		if s.minLength != nil && length < *s.minLength {
+			violation(path, "minimum length %d, was %d", *s.minLength, length)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			violation(path, "maximum length %d, was %d", *s.maxLength, length)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(value) {
+			violation(path, "doesn't match pattern %q", s.pattern)
+		}
+	case json.Number:
+		number, _ := value.Float64()
+		if s.minimum != nil && number < *s.minimum {
+			violation(path, "minimum value %v, was %s", *s.minimum, value)
+		}
+		if s.maximum != nil && number > *s.maximum {
+			violation(path, "maximum value %v, was %s", *s.maximum, value)
+		}
+	case []any:
+		if s.minItems != nil && len(value) < *s.minItems {
+			violation(path, "minimum length %d, was %d", *s.minItems, len(value))
+		}
+		if s.maxItems != nil && len(value) > *s.maxItems {
+			violation(path, "maximum length %d, was %d", *s.maxItems, len(value))
+		}
+		for i, item := range value {
+			violations = append(violations, s.items.validateValue(fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := value[name]; !ok {
+				violation(joinPath(path, name), "required property is missing")
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(value)) {
+			if property, ok := s.properties[name]; ok {
+				violations = append(violations, property.validateValue(joinPath(path, name), value[name])...)
+			} else if s.noAdditionalProperties {
+				violation(joinPath(path, name), "unknown property")
+			} else {
+				violations = append(violations, s.additionalProperties.validateValue(joinPath(path, name), value[name])...)
+			}
+		}
+	}
+	return violations
+}
+
+func jsonTypeOf(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if hasJSONType(value, "integer") {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func hasJSONType(value any, t string) bool {
+	if number, ok := value.(json.Number); ok && t == "integer" {
+		f, err := number.Float64()
+		return err == nil && f == math.Trunc(f)
+	}
+	actual := jsonTypeOf(value)
+	return actual == t || (actual == "integer" && t == "number")
+}
+
+func joinTypes(types []string) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return fmt.Sprintf("one of %v", types)
+}
+
+// Whether the JSON values are equal, comparing numbers by value.
+func jsonEqual(a, b any) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, aErr := a.Float64()
+		bf, bErr := b.Float64()
+		return aErr == nil && bErr == nil && af == bf
+	case []any:
+		b, ok := b.([]any)
+		return ok && slices.EqualFunc(a, b, jsonEqual)
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		return ok && maps.EqualFunc(a, b, jsonEqual)
+	default:
+		return a == b
+	}
+}
+
+func (s *jsonSchema) incompatibilities(writer validator) []string {
+	return s.readIncompatibilities(writer.(*jsonSchema), "")
+}
+
+// Why values valid against the writer wouldn't be valid against the reader. This is conservative,
+// so schemas which differ in ways it can't compare are incompatible even if every value is valid
+// against both.
+func (s *jsonSchema) readIncompatibilities(writer *jsonSchema, path string) []string {
+	if s == nil || (writer != nil && writer.never) {
+		return nil
+	}
+	if writer == nil {
+		writer = &jsonSchema{}
+	}
+	location := path
+	if location == "" {
+		location = "payload"
+	}
+
+	var incompatibilities []string
+	incompatible := func(format string, args ...any) {
+		incompatibilities = append(incompatibilities, location+": "+fmt.Sprintf(format, args...))
+	}
+	if s.never {
+		incompatible("no value is allowed")
+		return incompatibilities
+	}
+	if len(s.types) != 0 {
+		if len(writer.types) == 0 {
+			incompatible("types are restricted to %s", joinTypes(s.types))
+		}
+		for _, t := range writer.types {
+			if !slices.Contains(s.types, t) && !(t == "integer" && slices.Contains(s.types, "number")) {
+				incompatible("type %s isn't allowed", t)
+			}
+		}
+	}
+	if s.enum != nil {
+		writerValues := writer.enum
+		if writer.hasConst {
+			writerValues = []any{writer.constant}
+		}
+		if writerValues == nil {
+			incompatible("values are restricted to an enum")
+		}
+		for _, value := range writerValues {
+			if !slices.ContainsFunc(s.enum, func(v any) bool { return jsonEqual(v, value) }) {
+				incompatible("enum value %v isn't allowed", value)
+			}
+		}
+	}
+	if s.hasConst && !(writer.hasConst && jsonEqual(s.constant, writer.constant)) {
+		incompatible("const value differs")
+	}
+
+	tighter := func(keyword string, reader, writer *float64, less bool) {
+		if reader != nil && (writer == nil || (less && *writer < *reader) || (!less && *writer > *reader)) {
+			incompatible("%s is tighter", keyword)
+		}
+	}
+	tighter("minimum", s.minimum, writer.minimum, true)
+	tighter("maximum", s.maximum, writer.maximum, false)
+	tighter("minLength", intToFloat(s.minLength), intToFloat(writer.minLength), true)
+	tighter("maxLength", intToFloat(s.maxLength), intToFloat(writer.maxLength), false)
+	tighter("minItems", intToFloat(s.minItems), intToFloat(writer.minItems), true)
+	tighter("maxItems", intToFloat(s.maxItems), intToFloat(writer.maxItems), false)
+	if s.pattern != nil && (writer.pattern == nil || writer.pattern.String() != s.pattern.String()) {
+		incompatible("pattern differs")
+	}
+	incompatibilities = append(incompatibilities, s.items.readIncompatibilities(writer.items, joinPath(path, "[]"))...)
+
+	for _, name := range s.required {
+		if !slices.Contains(writer.required, name) {
+			incompatible("property %s is required", name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.properties)) {
+		// Properties the writer disallows can't appear, so needn't be compared.
+		if writerProperty, ok := writer.properties[name]; ok {
+			incompatibilities = append(incompatibilities, s.properties[name].readIncompatibilities(writerProperty, joinPath(path, name))...)
+		} else if !writer.noAdditionalProperties {
+			incompatibilities = append(incompatibilities, s.properties[name].readIncompatibilities(writer.additionalProperties, joinPath(path, name))...)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(writer.properties)) {
+		if _, ok := s.properties[name]; ok {
+			continue
+		}
+		if s.noAdditionalProperties {
+			incompatible("property %s isn't allowed", name)
+		} else {
+			incompatibilities = append(incompatibilities, s.additionalProperties.readIncompatibilities(writer.properties[name], joinPath(path, name))...)
+		}
+	}
+	if !writer.noAdditionalProperties {
+		if s.noAdditionalProperties {
+			incompatible("additional properties aren't allowed")
+		} else {
+			incompatibilities = append(incompatibilities, s.additionalProperties.readIncompatibilities(writer.additionalProperties, joinPath(path, "*"))...)
+		}
+	}
+	return incompatibilities
+}
+
+func intToFloat(i *int) *float64 {
+	if i == nil {
+		return nil
+	}
+	f := float64(*i)
+	return &f
+}
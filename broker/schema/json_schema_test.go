@@ -0,0 +1,143 @@
+package schema
+
+import (
+	"slices"
+	"testing"
+)
+
+// The paths of the violations, in order.
+func violationPaths(violations []Violation) []string {
+	paths := make([]string, len(violations))
+	for i, violation := range violations {
+		paths[i] = violation.Path
+	}
+	return paths
+}
+
+func mustCompile(t *testing.T, def Definition) validator {
+	t.Helper()
+	v, err := compile(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	const person = `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 5, "pattern": "^[a-z]+$"},
+			"age": {"type": "integer", "minimum": 0, "maximum": 150},
+			"kind": {"enum": ["a", "b"]},
+			"version": {"const": 1},
+			"tags": {"type": "array", "items": {"type": "string"}, "minItems": 1, "maxItems": 2}
+		},
+		"required": ["name"],
+		"additionalProperties": false
+	}`
+	tests := []struct {
+		name    string
+		schema  string
+		payload string
+		// The paths of the violations, or none if the payload is valid.
+		want []string
+	}{
+		{name: "valid", schema: person, payload: `{"name": "ab", "age": 3, "kind": "a", "version": 1.0, "tags": ["x"]}`},
+		{name: "required", schema: person, payload: `{}`, want: []string{"name"}},
+		{name: "type", schema: person, payload: `[]`, want: []string{""}},
+		{name: "integer", schema: person, payload: `{"name": "a", "age": 1.5}`, want: []string{"age"}},
+		{name: "minimum", schema: person, payload: `{"name": "a", "age": -1}`, want: []string{"age"}},
+		{name: "maximum", schema: person, payload: `{"name": "a", "age": 151}`, want: []string{"age"}},
+		{name: "string length and pattern", schema: person, payload: `{"name": "ABCDEF"}`, want: []string{"name", "name"}},
+		{name: "enum", schema: person, payload: `{"name": "a", "kind": "c"}`, want: []string{"kind"}},
+		{name: "const", schema: person, payload: `{"name": "a", "version": 2}`, want: []string{"version"}},
+		{name: "items", schema: person, payload: `{"name": "a", "tags": ["x", 1]}`, want: []string{"tags[1]"}},
+		{name: "item count", schema: person, payload: `{"name": "a", "tags": []}`, want: []string{"tags"}},
+		{name: "additional properties", schema: person, payload: `{"name": "a", "other": 1, "more": 2}`, want: []string{"more", "other"}},
+		{name: "additional properties schema", schema: `{"additionalProperties": {"type": "number"}}`, payload: `{"a": 1, "b": "x"}`, want: []string{"b"}},
+		{name: "true", schema: `true`, payload: `{"a": [null]}`},
+		{name: "false", schema: `false`, payload: `1`, want: []string{""}},
+		{name: "type list", schema: `{"type": ["string", "null"]}`, payload: `null`},
+		{name: "invalid JSON", schema: person, payload: `{"name": "a"`, want: []string{""}},
+		{name: "trailing data", schema: `true`, payload: `1 2`, want: []string{""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := mustCompile(t, Definition{Type: JSONSchema, Definition: []byte(test.schema)})
+			if got := violationPaths(v.validate([]byte(test.payload))); !slices.Equal(got, test.want) {
+				t.Errorf("got violations at %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaCompile(t *testing.T) {
+	for _, schema := range []string{
+		`{"type": "text"}`,
+		`{"type": 1}`,
+		`{"oneOf": [{"type": "string"}]}`,
+		`{"properties": {"a": {"$ref": "#/b"}}}`,
+		`{"pattern": "("}`,
+		`{"items": {"type": "nope"}}`,
+		`{`,
+	} {
+		if _, err := compile(Definition{Type: JSONSchema, Definition: []byte(schema)}); err == nil {
+			t.Errorf("compiled invalid schema %s", schema)
+		}
+	}
+}
+
+// Payloads valid against the writer must be valid against a compatible reader.
+func TestJSONSchemaIncompatibilities(t *testing.T) {
+	tests := []struct {
+		name           string
+		reader, writer string
+		compatible     bool
+	}{
+		{name: "identical", reader: `{"type": "string"}`, writer: `{"type": "string"}`, compatible: true},
+		{name: "integer read as number", reader: `{"type": "number"}`, writer: `{"type": "integer"}`, compatible: true},
+		{name: "number read as integer", reader: `{"type": "integer"}`, writer: `{"type": "number"}`},
+		{name: "type restricted", reader: `{"type": "string"}`, writer: `true`},
+		{name: "minimum loosened", reader: `{"minimum": 0}`, writer: `{"minimum": 1}`, compatible: true},
+		{name: "minimum tightened", reader: `{"minimum": 2}`, writer: `{"minimum": 1}`},
+		{name: "maxLength tightened", reader: `{"maxLength": 2}`, writer: `{"maxLength": 3}`},
+		{name: "enum extended", reader: `{"enum": [1, 2]}`, writer: `{"enum": [1]}`, compatible: true},
+		{name: "enum reduced", reader: `{"enum": [1]}`, writer: `{"enum": [1, 2]}`},
+		{name: "const in enum", reader: `{"enum": [1, 2]}`, writer: `{"const": 2}`, compatible: true},
+		{name: "pattern changed", reader: `{"pattern": "a"}`, writer: `{"pattern": "b"}`},
+		{name: "property required", reader: `{"required": ["a"]}`, writer: `{}`},
+		{name: "property no longer required", reader: `{}`, writer: `{"required": ["a"]}`, compatible: true},
+		{
+			name:       "optional property added",
+			reader:     `{"properties": {"a": {"type": "string"}}, "additionalProperties": false}`,
+			writer:     `{"properties": {}, "additionalProperties": false}`,
+			compatible: true,
+		},
+		{
+			name:   "property removed",
+			reader: `{"properties": {}, "additionalProperties": false}`,
+			writer: `{"properties": {"a": {"type": "string"}}, "additionalProperties": false}`,
+		},
+		{
+			name:   "additional properties disallowed",
+			reader: `{"additionalProperties": false}`,
+			writer: `{}`,
+		},
+		{
+			name:   "nested type changed",
+			reader: `{"properties": {"a": {"items": {"type": "string"}}}}`,
+			writer: `{"properties": {"a": {"items": {"type": "integer"}}}}`,
+		},
+		{name: "never written", reader: `{"type": "string"}`, writer: `false`, compatible: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := mustCompile(t, Definition{Type: JSONSchema, Definition: []byte(test.reader)})
+			writer := mustCompile(t, Definition{Type: JSONSchema, Definition: []byte(test.writer)})
+			if incompatibilities := reader.incompatibilities(writer); (len(incompatibilities) == 0) != test.compatible {
+				t.Errorf("got incompatibilities %q, want compatible %t", incompatibilities, test.compatible)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package schema
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// A protobuf message type, which payloads are binary encoded messages of. Fields unknown to the
+// message type are invalid, as are values of closed enums it doesn't define.
+type protobufSchema struct {
+	message protoreflect.MessageDescriptor
+}
+
+// Compile the message type from a FileDescriptorSet, which must include the files it depends on.
+func compileProtobuf(definition []byte, messageName string) (validator, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(definition, set); err != nil {
+		return nil, fmt.Errorf("parsing file descriptor set: %w", err)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("building file descriptors: %w", err)
+	}
+	if messageName == "" {
+		return nil, fmt.Errorf("message name is required for protobuf schemas")
+	}
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(messageName))
+	if err != nil {
+		return nil, fmt.Errorf("finding message %q: %w", messageName, err)
+	}
+	message, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q isn't a message", messageName)
+	}
+	return protobufSchema{message: message}, nil
+}
+
+func (s protobufSchema) validate(payload []byte) []Violation {
+	message := dynamicpb.NewMessage(s.message)
+	if err := proto.Unmarshal(payload, message); err != nil {
+		return []Violation{{Description: err.Error()}}
+	}
+	return unknownFields("", message)
+}
+
+// Violations for the unknown fields of the message and those nested within it.
+func unknownFields(path string, message protoreflect.Message) []Violation {
+	var violations []Violation
+	for unknown := message.GetUnknown(); len(unknown) > 0; {
+		number, _, n := protowire.ConsumeField(unknown)
+		if n < 0 {
+			violations = append(violations, Violation{Path: path, Description: protowire.ParseError(n).Error()})
+			break
+		}
+		violations = append(violations, Violation{Path: path, Description: fmt.Sprintf("unknown field number %d", number)})
+		unknown = unknown[n:]
+	}
+
+	message.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		fieldPath := joinPath(path, string(field.Name()))
+		switch {
+		case field.IsMap():
+			if field.MapValue().Message() == nil {
+				break
+			}
+			value.Map().Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+				violations = append(violations, unknownFields(fmt.Sprintf("%s[%v]", fieldPath, key.Interface()), value.Message())...)
+				return true
+			})
+		case field.IsList():
+			if field.Message() == nil {
+				break
+			}
+			list := value.List()
+			for i := range list.Len() {
+				violations = append(violations, unknownFields(fmt.Sprintf("%s[%d]", fieldPath, i), list.Get(i).Message())...)
+			}
+		case field.Message() != nil:
+			violations = append(violations, unknownFields(fieldPath, value.Message())...)
+		}
+		return true
+	})
+	return violations
+}
+
+func (s protobufSchema) incompatibilities(writer validator) []string {
+	return messageIncompatibilities(s.message, writer.(protobufSchema).message, "", map[[2]protoreflect.FullName]bool{})
+}
+
+// Why messages of the writer type wouldn't be valid messages of the reader type. Fields are matched
+// by number, so may be renamed.
+func messageIncompatibilities(reader, writer protoreflect.MessageDescriptor, path string, seen map[[2]protoreflect.FullName]bool) []string {
+	// Recursive types are only compared once.
+	pair := [2]protoreflect.FullName{reader.FullName(), writer.FullName()}
+	if seen[pair] {
+		return nil
+	}
+	seen[pair] = true
+
+	var incompatibilities []string
+	writerFields := writer.Fields()
+	for i := range writerFields.Len() {
+		writerField := writerFields.Get(i)
+		fieldPath := joinPath(path, string(writerField.Name()))
+		readerField := reader.Fields().ByNumber(writerField.Number())
+		if readerField == nil {
+			incompatibilities = append(incompatibilities, fmt.Sprintf("%s: field number %d is unknown", fieldPath, writerField.Number()))
+			continue
+		}
+		incompatibilities = append(incompatibilities, fieldIncompatibilities(readerField, writerField, fieldPath, seen)...)
+	}
+
+	readerFields := reader.Fields()
+	for i := range readerFields.Len() {
+		readerField := readerFields.Get(i)
+		if readerField.Cardinality() == protoreflect.Required && writerFields.ByNumber(readerField.Number()) == nil {
+			incompatibilities = append(incompatibilities, fmt.Sprintf("%s: required field number %d is missing", joinPath(path, string(readerField.Name())), readerField.Number()))
+		}
+	}
+	return incompatibilities
+}
+
+func fieldIncompatibilities(reader, writer protoreflect.FieldDescriptor, path string, seen map[[2]protoreflect.FullName]bool) []string {
+	if reader.IsMap() != writer.IsMap() || reader.IsList() != writer.IsList() {
+		return []string{fmt.Sprintf("%s: cardinality differs", path)}
+	}
+	if reader.IsMap() {
+		if reader.MapKey().Kind() != writer.MapKey().Kind() {
+			return []string{fmt.Sprintf("%s: map key type %s can't be read as %s", path, writer.MapKey().Kind(), reader.MapKey().Kind())}
+		}
+		return fieldIncompatibilities(reader.MapValue(), writer.MapValue(), path, seen)
+	}
+
+	// Strings can be read as bytes, but not the other way round as bytes needn't be valid UTF-8.
+	if reader.Kind() != writer.Kind() && (reader.Kind() != protoreflect.BytesKind || writer.Kind() != protoreflect.StringKind) {
+		return []string{fmt.Sprintf("%s: type %s can't be read as %s", path, writer.Kind(), reader.Kind())}
+	}
+	switch reader.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return messageIncompatibilities(reader.Message(), writer.Message(), path, seen)
+	case protoreflect.EnumKind:
+		if !reader.Enum().IsClosed() {
+			return nil
+		}
+		var incompatibilities []string
+		writerValues := writer.Enum().Values()
+		for i := range writerValues.Len() {
+			if reader.Enum().Values().ByNumber(writerValues.Get(i).Number()) == nil {
+				incompatibilities = append(incompatibilities, fmt.Sprintf("%s: enum value %s is unknown", path, writerValues.Get(i).Name()))
+			}
+		}
+		return incompatibilities
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package schema
+
+import (
+	"slices"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// A FileDescriptorSet of a proto3 file in package example with the messages.
+func protobufDefinition(t *testing.T, messages ...*descriptorpb.DescriptorProto) []byte {
+	t.Helper()
+	definition, err := proto.Marshal(&descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{{
+			Name:        proto.String("example.proto"),
+			Package:     proto.String("example"),
+			Syntax:      proto.String("proto3"),
+			MessageType: messages,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return definition
+}
+
+func protobufField(name string, number int32, fieldType descriptorpb.FieldDescriptorProto_Type, typeName string, repeated bool) *descriptorpb.FieldDescriptorProto {
+	label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	if repeated {
+		label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	}
+	field := &descriptorpb.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(number),
+		Type:   fieldType.Enum(),
+		Label:  label.Enum(),
+	}
+	if typeName != "" {
+		field.TypeName = proto.String(typeName)
+	}
+	return field
+}
+
+func protobufMessage(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+	return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+}
+
+func TestProtobufValidate(t *testing.T) {
+	definition := protobufDefinition(t,
+		protobufMessage("Person",
+			protobufField("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", false),
+			protobufField("address", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".example.Address", false),
+			protobufField("previous", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".example.Address", true),
+		),
+		protobufMessage("Address",
+			protobufField("city", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", false),
+		),
+	)
+	address := protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "x")
+	unknown := protowire.AppendVarint(protowire.AppendTag(nil, 9, protowire.VarintType), 1)
+	field := func(number protowire.Number, value []byte) []byte {
+		return protowire.AppendBytes(protowire.AppendTag(nil, number, protowire.BytesType), value)
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		// The paths of the violations, or none if the payload is valid.
+		want []string
+	}{
+		{name: "valid", payload: slices.Concat(field(1, []byte("a")), field(2, address), field(3, address), field(3, address))},
+		{name: "empty", payload: nil},
+		{name: "unknown field", payload: slices.Concat(field(1, []byte("a")), unknown), want: []string{""}},
+		{name: "nested unknown field", payload: field(2, slices.Concat(address, unknown)), want: []string{"address"}},
+		{name: "repeated unknown field", payload: slices.Concat(field(3, address), field(3, unknown)), want: []string{"previous[1]"}},
+		{name: "invalid UTF-8", payload: field(1, []byte("\xff")), want: []string{""}},
+		{name: "wrong wire type", payload: protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 1), want: []string{""}},
+		{name: "truncated", payload: field(1, []byte("abc"))[:3], want: []string{""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := mustCompile(t, Definition{Type: ProtobufSchema, Definition: definition, MessageName: "example.Person"})
+			if got := violationPaths(v.validate(test.payload)); !slices.Equal(got, test.want) {
+				t.Errorf("got violations at %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProtobufCompile(t *testing.T) {
+	definition := protobufDefinition(t, protobufMessage("Person"))
+	for _, def := range []Definition{
+		{Definition: definition},
+		{Definition: definition, MessageName: "example.Unknown"},
+		{Definition: []byte("not a descriptor set"), MessageName: "example.Person"},
+		{Definition: protobufDefinition(t, protobufMessage("Person", protobufField("a", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".example.Missing", false))), MessageName: "example.Person"},
+	} {
+		def.Type = ProtobufSchema
+		if _, err := compile(def); err == nil {
+			t.Errorf("compiled invalid schema for message %q", def.MessageName)
+		}
+	}
+}
+
+// Messages of the writer type must be valid messages of a compatible reader type.
+func TestProtobufIncompatibilities(t *testing.T) {
+	str := func(name string, number int32) *descriptorpb.FieldDescriptorProto {
+		return protobufField(name, number, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", false)
+	}
+	tests := []struct {
+		name           string
+		reader, writer *descriptorpb.DescriptorProto
+		compatible     bool
+	}{
+		{name: "field added", reader: protobufMessage("M", str("a", 1), str("b", 2)), writer: protobufMessage("M", str("a", 1)), compatible: true},
+		{name: "field removed", reader: protobufMessage("M", str("a", 1)), writer: protobufMessage("M", str("a", 1), str("b", 2))},
+		{name: "field renamed", reader: protobufMessage("M", str("b", 1)), writer: protobufMessage("M", str("a", 1)), compatible: true},
+		{
+			name:       "string read as bytes",
+			reader:     protobufMessage("M", protobufField("a", 1, descriptorpb.FieldDescriptorProto_TYPE_BYTES, "", false)),
+			writer:     protobufMessage("M", str("a", 1)),
+			compatible: true,
+		},
+		{
+			name:   "bytes read as string",
+			reader: protobufMessage("M", str("a", 1)),
+			writer: protobufMessage("M", protobufField("a", 1, descriptorpb.FieldDescriptorProto_TYPE_BYTES, "", false)),
+		},
+		{
+			name:   "made repeated",
+			reader: protobufMessage("M", protobufField("a", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", true)),
+			writer: protobufMessage("M", str("a", 1)),
+		},
+		{
+			name:   "type changed",
+			reader: protobufMessage("M", protobufField("a", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64, "", false)),
+			writer: protobufMessage("M", str("a", 1)),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := mustCompile(t, Definition{Type: ProtobufSchema, Definition: protobufDefinition(t, test.reader), MessageName: "example.M"})
+			writer := mustCompile(t, Definition{Type: ProtobufSchema, Definition: protobufDefinition(t, test.writer), MessageName: "example.M"})
+			if incompatibilities := reader.incompatibilities(writer); (len(incompatibilities) == 0) != test.compatible {
+				t.Errorf("got incompatibilities %q, want compatible %t", incompatibilities, test.compatible)
+			}
+		})
+	}
+}
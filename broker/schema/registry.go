@@ -0,0 +1,177 @@
+package schema
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	commonerrors "pubsub/common/errors"
+)
+
+const (
+	errSchemaNotFound     = "SCHEMA_NOT_FOUND"
+	errSchemaIncompatible = "SCHEMA_INCOMPATIBLE"
+)
+
+// A Registry stores the versions of each subject's schema. It's safe for concurrent use.
+type Registry struct {
+	mutex    sync.RWMutex
+	subjects map[string]*subject
+}
+
+type subject struct {
+	compatibility Compatibility
+	versions      []compiledVersion
+}
+
+type compiledVersion struct {
+	Version
+	validator validator
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		subjects: map[string]*subject{},
+	}
+}
+
+// Register the definition as the subject's next version, returning its version number. A
+// definition identical to the subject's latest version isn't registered again, and its version
+// number is returned instead.
+//
+// The new version must be compatible with the previous one according to the compatibility mode,
+// which then becomes the subject's. If it's UnspecifiedCompatibility, the subject's existing mode
+// is used.
+func (r *Registry) Register(subjectName string, def Definition, compatibility Compatibility) (int, error) {
+	compiled, err := compile(def)
+	if err != nil {
+		return 0, commonerrors.NewInvalidArgument("invalid schema", commonerrors.FieldViolation{
+			Field:       "definition",
+			Reason:      "INVALID_SCHEMA",
+			Description: err.Error(),
+		})
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, ok := r.subjects[subjectName]
+	if !ok {
+		s = &subject{compatibility: BackwardCompatibility}
+	}
+	if compatibility == UnspecifiedCompatibility {
+		compatibility = s.compatibility
+	}
+
+	if len(s.versions) != 0 {
+		latest := s.versions[len(s.versions)-1]
+		if latest.Type == def.Type && latest.MessageName == def.MessageName && bytes.Equal(latest.Definition.Definition, def.Definition) {
+			s.compatibility = compatibility
+			return latest.Version.Version, nil
+		}
+		if failures := checkCompatibility(compatibility, latest, compiledVersion{Version: Version{Definition: def}, validator: compiled}); len(failures) != 0 {
+			return 0, commonerrors.NewFailedPrecondition(fmt.Sprintf("schema incompatible with version %d of subject %q", latest.Version.Version, subjectName), failures...)
+		}
+	}
+
+	version := Version{
+		Subject:    subjectName,
+		Version:    len(s.versions) + 1,
+		Definition: def,
+	}
+	s.versions = append(s.versions, compiledVersion{Version: version, validator: compiled})
+	s.compatibility = compatibility
+	r.subjects[subjectName] = s
+	return version.Version, nil
+}
+
+// Why the next version isn't compatible with the previous one under the compatibility mode.
+func checkCompatibility(compatibility Compatibility, previous, next compiledVersion) []commonerrors.PreconditionFailure {
+	if compatibility == NoCompatibility {
+		return nil
+	}
+	if previous.Type != next.Type {
+		return []commonerrors.PreconditionFailure{{
+			Type:        errSchemaIncompatible,
+			Description: fmt.Sprintf("schema type changed from %s to %s", previous.Type, next.Type),
+		}}
+	}
+
+	var failures []commonerrors.PreconditionFailure
+	if compatibility == BackwardCompatibility || compatibility == FullCompatibility {
+		for _, incompatibility := range next.validator.incompatibilities(previous.validator) {
+			failures = append(failures, commonerrors.PreconditionFailure{
+				Type:        errSchemaIncompatible,
+				Description: "backward: " + incompatibility,
+			})
+		}
+	}
+	if compatibility == ForwardCompatibility || compatibility == FullCompatibility {
+		for _, incompatibility := range previous.validator.incompatibilities(next.validator) {
+			failures = append(failures, commonerrors.PreconditionFailure{
+				Type:        errSchemaIncompatible,
+				Description: "forward: " + incompatibility,
+			})
+		}
+	}
+	return failures
+}
+
+// Get the version of the subject's schema, or its latest version if version is zero.
+func (r *Registry) Get(subjectName string, version int) (Version, Compatibility, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	compiled, s, err := r.get(subjectName, version)
+	if err != nil {
+		return Version{}, UnspecifiedCompatibility, err
+	}
+	return compiled.Version, s.compatibility, nil
+}
+
+// Validate the payload against the version of the subject's schema it was written with, or if
+// version is zero, against each version from the latest until one it's valid against. Returns the
+// version the payload was validated against, which is the latest if it's invalid against them all,
+// and where the payload is invalid.
+func (r *Registry) Validate(subjectName string, version int, payload []byte) (int, []Violation, error) {
+	r.mutex.RLock()
+	compiled, s, err := r.get(subjectName, version)
+	var versions []compiledVersion
+	if err == nil && version == 0 {
+		// Versions are only appended, so the slice can be read once the mutex is released.
+		versions = s.versions
+	}
+	r.mutex.RUnlock()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	violations := compiled.validator.validate(payload)
+	for i := len(versions) - 2; i >= 0 && len(violations) != 0; i-- {
+		if len(versions[i].validator.validate(payload)) == 0 {
+			return versions[i].Version.Version, nil, nil
+		}
+	}
+	return compiled.Version.Version, violations, nil
+}
+
+// The mutex must be held.
+func (r *Registry) get(subjectName string, version int) (compiledVersion, *subject, error) {
+	s, ok := r.subjects[subjectName]
+	if !ok {
+		return compiledVersion{}, nil, commonerrors.NewFailedPrecondition("schema not found", commonerrors.PreconditionFailure{
+			Type:        errSchemaNotFound,
+			Description: fmt.Sprintf("subject %q has no registered schema", subjectName),
+		})
+	}
+	if version == 0 {
+		version = len(s.versions)
+	}
+	if version < 1 || version > len(s.versions) {
+		return compiledVersion{}, nil, commonerrors.NewFailedPrecondition("schema not found", commonerrors.PreconditionFailure{
+			Type:        errSchemaNotFound,
+			Description: fmt.Sprintf("subject %q has no version %d", subjectName, version),
+		})
+	}
+	return s.versions[version-1], s, nil
+}
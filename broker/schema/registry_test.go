@@ -0,0 +1,133 @@
+package schema
+
+import (
+	"testing"
+)
+
+func TestRegistryCompatibility(t *testing.T) {
+	const (
+		v1 = `{"properties": {"name": {"type": "string"}}, "additionalProperties": false}`
+		// Readers of v1 payloads can read v2's, but not the other way round.
+		optionalAdded = `{"properties": {"name": {"type": "string"}, "age": {"type": "integer"}}, "additionalProperties": false}`
+		// Readers of v2 payloads can read v1's, but not the other way round.
+		removed     = `{"properties": {}, "additionalProperties": false}`
+		typeChanged = `{"properties": {"name": {"type": "integer"}}, "additionalProperties": false}`
+	)
+	tests := []struct {
+		name string
+		next Definition
+		// Whether registering next after v1 is allowed under each mode.
+		allowed map[Compatibility]bool
+	}{
+		{
+			name:    "optional property added",
+			next:    Definition{Type: JSONSchema, Definition: []byte(optionalAdded)},
+			allowed: map[Compatibility]bool{NoCompatibility: true, BackwardCompatibility: true},
+		},
+		{
+			name:    "property removed",
+			next:    Definition{Type: JSONSchema, Definition: []byte(removed)},
+			allowed: map[Compatibility]bool{NoCompatibility: true, ForwardCompatibility: true},
+		},
+		{
+			name:    "type changed",
+			next:    Definition{Type: JSONSchema, Definition: []byte(typeChanged)},
+			allowed: map[Compatibility]bool{NoCompatibility: true},
+		},
+		{
+			name:    "schema type changed",
+			next:    Definition{Type: AvroSchema, Definition: []byte(`"string"`)},
+			allowed: map[Compatibility]bool{NoCompatibility: true},
+		},
+		{
+			name:    "unchanged",
+			next:    Definition{Type: JSONSchema, Definition: []byte(v1)},
+			allowed: map[Compatibility]bool{NoCompatibility: true, BackwardCompatibility: true, ForwardCompatibility: true, FullCompatibility: true},
+		},
+	}
+	for _, test := range tests {
+		for _, compatibility := range []Compatibility{NoCompatibility, BackwardCompatibility, ForwardCompatibility, FullCompatibility} {
+			t.Run(test.name+"/"+compatibility.String(), func(t *testing.T) {
+				r := NewRegistry()
+				if _, err := r.Register("s", Definition{Type: JSONSchema, Definition: []byte(v1)}, compatibility); err != nil {
+					t.Fatal(err)
+				}
+				// The subject's mode applies when registering without one.
+				_, err := r.Register("s", test.next, UnspecifiedCompatibility)
+				if allowed := test.allowed[compatibility]; (err == nil) != allowed {
+					t.Errorf("registering got %v, want allowed %t", err, allowed)
+				}
+			})
+		}
+	}
+}
+
+func TestRegistryVersions(t *testing.T) {
+	r := NewRegistry()
+	if _, _, err := r.Validate("s", 0, []byte(`"a"`)); err == nil {
+		t.Error("validated against a subject without a schema")
+	}
+
+	for i, definition := range []string{`{"type": "string"}`, `{"type": ["string", "integer"]}`, `{"type": ["string", "integer"]}`} {
+		version, err := r.Register("s", Definition{Type: JSONSchema, Definition: []byte(definition)}, UnspecifiedCompatibility)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Registering the latest version again doesn't add a version.
+		if want := min(i+1, 2); version != want {
+			t.Errorf("registered version %d, want %d", version, want)
+		}
+	}
+	if got, compatibility, err := r.Get("s", 0); err != nil || got.Version != 2 || compatibility != BackwardCompatibility {
+		t.Errorf("got latest version %d with %s compatibility (%v), want 2 with backward", got.Version, compatibility, err)
+	}
+	if _, _, err := r.Get("s", 3); err == nil {
+		t.Error("got a version which isn't registered")
+	}
+
+	tests := []struct {
+		name        string
+		version     int
+		payload     string
+		wantVersion int
+		wantValid   bool
+	}{
+		{name: "latest", payload: `1`, wantVersion: 2, wantValid: true},
+		{name: "valid against both", payload: `"a"`, wantVersion: 2, wantValid: true},
+		{name: "writer's version", version: 1, payload: `"a"`, wantVersion: 1, wantValid: true},
+		{name: "invalid against writer's version", version: 1, payload: `1`, wantVersion: 1},
+		{name: "invalid against every version", payload: `null`, wantVersion: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, violations, err := r.Validate("s", test.version, []byte(test.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != test.wantVersion || (len(violations) == 0) != test.wantValid {
+				t.Errorf("got version %d with violations %v, want version %d and valid %t", version, violations, test.wantVersion, test.wantValid)
+			}
+		})
+	}
+}
+
+// Payloads written with an earlier version are valid without giving their version, even if the
+// latest version can't validate them.
+func TestRegistryValidateEarlierVersion(t *testing.T) {
+	r := NewRegistry()
+	for _, definition := range []string{
+		`{"type": "record", "name": "r", "fields": [{"name": "a", "type": "string"}]}`,
+		`{"type": "record", "name": "r", "fields": [{"name": "a", "type": "string"}, {"name": "b", "type": "int", "default": 0}]}`,
+	} {
+		if _, err := r.Register("s", Definition{Type: AvroSchema, Definition: []byte(definition)}, BackwardCompatibility); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v1 := avroEncode("x")
+	if version, violations, err := r.Validate("s", 0, v1); err != nil || len(violations) != 0 || version != 1 {
+		t.Errorf("got version %d with violations %v (%v), want valid against version 1", version, violations, err)
+	}
+	if _, violations, err := r.Validate("s", 2, v1); err != nil || len(violations) == 0 {
+		t.Errorf("got violations %v (%v) against version 2, want invalid", violations, err)
+	}
+}
@@ -0,0 +1,136 @@
+// Package schema implements a registry of versioned schemas which topics' payloads are validated
+// against.
+//
+// Three kinds of schema are supported:
+//   - Protobuf, a serialised FileDescriptorSet and the full name of the payload's message type.
+//   - JSON Schema, of which the type, properties, required, additionalProperties, items, enum,
+//     const, minimum, maximum, minLength, maxLength, pattern, minItems and maxItems keywords are
+//     supported.
+//   - Avro, validating payloads in Avro's binary encoding.
+//
+// Registering a new version of a subject's schema checks it's compatible with the previous
+// version, according to the subject's compatibility mode.
+package schema
+
+import (
+	"fmt"
+)
+
+// The kind of a schema.
+type Type int
+
+const (
+	ProtobufSchema Type = iota
+	JSONSchema
+	AvroSchema
+)
+
+func (t Type) String() string {
+	switch t {
+	case ProtobufSchema:
+		return "protobuf"
+	case JSONSchema:
+		return "JSON Schema"
+	case AvroSchema:
+		return "Avro"
+	default:
+		return fmt.Sprintf("Type(%d)", int(t))
+	}
+}
+
+// Which earlier versions of a subject's schema a new version must be compatible with.
+type Compatibility int
+
+const (
+	// Keeps the subject's existing compatibility mode, which is BackwardCompatibility for a new
+	// subject.
+	UnspecifiedCompatibility Compatibility = iota
+	// New versions aren't checked.
+	NoCompatibility
+	// Payloads valid against the previous version must be valid against the new version, so
+	// consumers can move to the new version before producers.
+	BackwardCompatibility
+	// Payloads valid against the new version must be valid against the previous version, so
+	// producers can move to the new version before consumers.
+	ForwardCompatibility
+	// Both BackwardCompatibility and ForwardCompatibility.
+	FullCompatibility
+)
+
+func (c Compatibility) String() string {
+	switch c {
+	case UnspecifiedCompatibility:
+		return "unspecified"
+	case NoCompatibility:
+		return "none"
+	case BackwardCompatibility:
+		return "backward"
+	case ForwardCompatibility:
+		return "forward"
+	case FullCompatibility:
+		return "full"
+	default:
+		return fmt.Sprintf("Compatibility(%d)", int(c))
+	}
+}
+
+// A Definition describes a schema as registered.
+type Definition struct {
+	Type Type
+	// A serialised FileDescriptorSet for ProtobufSchema, or the schema's JSON otherwise.
+	Definition []byte
+	// Full name of the payload's message type, for ProtobufSchema.
+	MessageName string
+}
+
+// A Version is a registered version of a subject's schema.
+type Version struct {
+	Subject string
+	// Starts from 1 for each subject.
+	Version int
+	Definition
+}
+
+// A Violation describes where and why a payload isn't valid against a schema.
+type Violation struct {
+	// Dot separated path to the invalid value within the payload, e.g. `address.lines[1]`, which
+	// is empty for the payload as a whole.
+	Path        string
+	Description string
+}
+
+// Field is the name of the field the violation is in, given the name of the payload's field.
+func (v Violation) Field(payloadField string) string {
+	return joinPath(payloadField, v.Path)
+}
+
+// A compiled schema.
+type validator interface {
+	// Validate the payload, returning where it's invalid.
+	validate(payload []byte) []Violation
+	// Why payloads valid against the writer wouldn't be valid against this schema, which must be
+	// of the same Type.
+	incompatibilities(writer validator) []string
+}
+
+// Compile the definition, returning why it isn't a valid schema.
+func compile(def Definition) (validator, error) {
+	switch def.Type {
+	case ProtobufSchema:
+		return compileProtobuf(def.Definition, def.MessageName)
+	case JSONSchema:
+		return compileJSONSchema(def.Definition)
+	case AvroSchema:
+		return compileAvro(def.Definition)
+	default:
+		return nil, fmt.Errorf("unknown schema type %d", int(def.Type))
+	}
+}
+
+// Join the path of a value with the field or index of one within it.
+func joinPath(path, field string) string {
+	if path == "" || field == "" || field[0] == '[' {
+		return path + field
+	}
+	return path + "." + field
+}
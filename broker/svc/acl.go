@@ -0,0 +1,72 @@
+package svc
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	commonerrors "pubsub/common/errors"
+)
+
+// What a client is allowed to do with a topic.
+type Access int
+
+const (
+	PublishAccess Access = iota
+	SubscribeAccess
+)
+
+func (a Access) String() string {
+	switch a {
+	case PublishAccess:
+		return "publish"
+	case SubscribeAccess:
+		return "subscribe"
+	default:
+		return fmt.Sprintf("Access(%d)", int(a))
+	}
+}
+
+// An ACL lists the IDs of the clients allowed each kind of access to a topic. An empty list allows
+// every client, including those without an ID.
+//
+// Client IDs are given by the clients themselves rather than authenticated, so an ACL guards
+// against misconfigured clients rather than malicious ones.
+type ACL struct {
+	Publishers  []string
+	Subscribers []string
+}
+
+func (a ACL) validate() error {
+	if slices.Contains(a.Publishers, "") || slices.Contains(a.Subscribers, "") {
+		return errors.New("ACL client IDs must not be empty")
+	}
+	return nil
+}
+
+// Whether the client is allowed the access.
+func (a ACL) allows(clientID string, access Access) bool {
+	clientIDs := a.Publishers
+	if access == SubscribeAccess {
+		clientIDs = a.Subscribers
+	}
+	return len(clientIDs) == 0 || slices.Contains(clientIDs, clientID)
+}
+
+func errAccessDenied(topicName, clientID string, access Access) error {
+	return commonerrors.NewPermissionDenied(fmt.Sprintf("client %q isn't allowed to %s to topic %q", clientID, access, topicName))
+}
+
+// Authorize checks the client is allowed the access to the topic.
+func (b *Broker) Authorize(topicName, clientID string, access Access) error {
+	b.mutex.RLock()
+	topic, ok := b.topicsByName[topicName]
+	b.mutex.RUnlock()
+	if !ok {
+		return errTopicNotFound{topic: topicName}
+	}
+	if !topic.allows(clientID, access) {
+		return errAccessDenied(topicName, clientID, access)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package svc
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	commonerrors "pubsub/common/errors"
+)
+
+func TestAuthorize(t *testing.T) {
+	b := mustNewBroker(t,
+		TopicDefinition{Name: "guarded", NumberOfPartitions: 1, ACL: ACL{Publishers: []string{"p"}, Subscribers: []string{"s"}}},
+		TopicDefinition{Name: "open", NumberOfPartitions: 1},
+	)
+	for _, test := range []struct {
+		topic    string
+		clientID string
+		access   Access
+		allowed  bool
+	}{
+		{topic: "guarded", clientID: "p", access: PublishAccess, allowed: true},
+		{topic: "guarded", clientID: "s", access: PublishAccess, allowed: false},
+		{topic: "guarded", clientID: "", access: PublishAccess, allowed: false},
+		{topic: "guarded", clientID: "s", access: SubscribeAccess, allowed: true},
+		{topic: "guarded", clientID: "p", access: SubscribeAccess, allowed: false},
+		{topic: "guarded", clientID: "", access: SubscribeAccess, allowed: false},
+		{topic: "open", clientID: "", access: PublishAccess, allowed: true},
+		{topic: "open", clientID: "any", access: SubscribeAccess, allowed: true},
+	} {
+		err := b.Authorize(test.topic, test.clientID, test.access)
+		if test.allowed && err != nil {
+			t.Errorf("authorizing %q to %s to %q: %v", test.clientID, test.access, test.topic, err)
+		} else if !test.allowed && !errors.As(err, &commonerrors.PermissionDenied{}) {
+			t.Errorf("authorizing %q to %s to %q got %v, want permission denied", test.clientID, test.access, test.topic, err)
+		}
+	}
+
+	if err := b.Authorize("missing", "p", PublishAccess); !errors.As(err, &errTopicNotFound{}) {
+		t.Errorf("authorizing access to a missing topic got %v, want topic not found", err)
+	}
+}
+
+// Subscribing to a topic by name fails unless its ACL allows the client, whilst subscribing to a
+// pattern only joins the matching topics which allow it.
+func TestSubscribeACL(t *testing.T) {
+	topicDefs := []TopicDefinition{
+		{Name: "a.x", NumberOfPartitions: 1, ACL: ACL{Subscribers: []string{"other"}}},
+		{Name: "a.y", NumberOfPartitions: 1, ACL: ACL{Subscribers: []string{"c"}}},
+		{Name: "a.z", NumberOfPartitions: 1},
+	}
+	b := mustNewBroker(t, topicDefs...)
+	for _, topicDef := range topicDefs {
+		if err := b.Publish(topicDef.Name, Message{Payload: []byte(topicDef.Name)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := b.Subscribe("a.x", "g", SubscriptionOptions{ClientID: "c"}); !errors.As(err, &commonerrors.PermissionDenied{}) {
+		t.Errorf("subscribing to a topic which doesn't allow the client got %v, want permission denied", err)
+	}
+	if _, err := b.Subscribe("a.x", "g", SubscriptionOptions{}); !errors.As(err, &commonerrors.PermissionDenied{}) {
+		t.Errorf("subscribing without a client ID to a topic with subscribers listed got %v, want permission denied", err)
+	}
+	subscriberID, err := b.Subscribe("a.y", "g", SubscriptionOptions{ClientID: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(mustPoll(t, b, subscriberID, 10)); !slices.Equal(got, []string{"a.y"}) {
+		t.Errorf("polled %q, want the allowed topic's message", got)
+	}
+
+	subscriberID, err = b.Subscribe("a.*", "pattern", SubscriptionOptions{ClientID: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := payloads(mustPoll(t, b, subscriberID, 10))
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"a.y", "a.z"}) {
+		t.Errorf("polled %q, want the messages of only the topics allowing the client", got)
+	}
+}
+
+func TestACLValidation(t *testing.T) {
+	for _, acl := range []ACL{{Publishers: []string{"p", ""}}, {Subscribers: []string{""}}} {
+		if _, err := NewBroker(Options{}, TopicDefinition{Name: "t", NumberOfPartitions: 1, ACL: acl}); err == nil {
+			t.Errorf("created a topic with the ACL %+v listing an empty client ID", acl)
+		}
+	}
+}
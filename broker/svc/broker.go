@@ -1,81 +1,326 @@
 package svc
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
 
+	uuid "github.com/satori/go.uuid"
+
+	"pubsub/broker/schema"
 	commonerrors "pubsub/common/errors"
 )
 
+// A Broker is safe for concurrent use. Locks are always acquired in the order:
+//  1. The Broker's mutex, guarding topicsByName. It's held for writing while subscribing or
+//     creating or deleting a topic, so a subscription sees every topic matching its pattern.
+//     Otherwise it's only held for reading, to look up a topic.
+//  2. A shard of the subscription registry, only held to look up or add a subscription, or while
+//     a topic is being joined or left by every subscription.
+//  3. A subscription, held while polling or acknowledging its topics, which it refers to directly
+//     rather than holding the Broker's mutex.
+//  4. A topic, held for writing while a subscriber's state is read or saved, but not while its
+//     partitions are polled for it, and only for reading while publishing to it, so polls and
+//     publishes to different partitions proceed in parallel. Its retained messages have their own
+//     lock, which publishes take in turn. Payloads are decompressed for polls once every topic's
+//     lock has been released.
+//  5. A partition, guarding its groups' cursors, or its message log, held while committing,
+//     compacting or reclaiming messages. These are never held together: messages are immutable
+//     once committed, so polls read them without a lock. The log's queue of messages waiting to be
+//     committed has its own lock, which is held last.
+//
+// The schema registry has its own lock, which is never held while acquiring another.
 type Broker struct {
-	topicsByName            map[string]*topic
-	topicNameBySubscriberID map[string]string
+	mutex sync.RWMutex
+
+	topicsByName  map[string]*topic
+	subscriptions *subscriptionRegistry
+	schemas       *schema.Registry
+	opts          Options
 }
 
-func NewBroker(topicDefs ...TopicDefinition) Broker {
+// Options configures a Broker.
+type Options struct {
+	// The most bytes a compressed payload can decompress to when it's validated against a schema,
+	// or zero for no limit.
+	MaxDecompressedSize int
+}
+
+// NewBroker creates a Broker with the topics, returning why any of them are invalid.
+func NewBroker(opts Options, topicDefs ...TopicDefinition) (*Broker, error) {
 	topicsByName := make(map[string]*topic, len(topicDefs))
+	defined := make(map[string]bool, len(topicDefs))
 	var errs error
 	for _, topicDef := range topicDefs {
-		topic, err := newTopic(topicDef.Name, topicDef.NumberOfPartitions, topicDef.PartitionStrategy)
+		if defined[topicDef.Name] {
+			errs = errors.Join(errs, errTopicAlreadyExists{topic: topicDef.Name})
+			continue
+		}
+		defined[topicDef.Name] = true
+		topic, err := newTopic(topicDef)
 		if err != nil {
 			errs = errors.Join(errs, err)
+			continue
 		}
 		topicsByName[topicDef.Name] = topic
 	}
-	return Broker{
-		topicsByName:            topicsByName,
-		topicNameBySubscriberID: map[string]string{},
+	if errs != nil {
+		return nil, fmt.Errorf("creating broker: %w", errs)
 	}
+	return &Broker{
+		topicsByName:  topicsByName,
+		subscriptions: newSubscriptionRegistry(),
+		schemas:       schema.NewRegistry(),
+		opts:          opts,
+	}, nil
 }
 
-func (b Broker) Publish(topicName string, newMessages ...Message) error {
+// CreateTopic adds a topic to the broker, subscribing any existing subscriptions whose topic
+// pattern matches it.
+func (b *Broker) CreateTopic(topicDef TopicDefinition) error {
+	_, err := b.createTopic(topicDef)
+	return err
+}
+
+func (b *Broker) createTopic(topicDef TopicDefinition) (*topic, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.topicsByName[topicDef.Name]; ok {
+		return nil, errTopicAlreadyExists{topic: topicDef.Name}
+	}
+	topic, err := newTopic(topicDef)
+	if err != nil {
+		return nil, err
+	}
+	b.topicsByName[topicDef.Name] = topic
+
+	b.subscriptions.forEach(func(subscriberID string, subscription *subscription) {
+		if !subscription.pattern.match(topicDef.Name) || !topic.allows(subscription.opts.ClientID, SubscribeAccess) {
+			return
+		}
+		if err := subscription.join(subscriberID, topicDef.Name, topic); err != nil {
+			// This shouldn't happen, as the topic is new so has no groups to conflict with.
+			slog.Error("Joining new topic", slog.String("topic", topicDef.Name), slog.String("subscriber_id", subscriberID), slog.Any("error", err))
+		}
+	})
+	return topic, nil
+}
+
+// UpdateTopic applies the definition to the existing topic of the same name. Partitions can be
+// added, changing the key split points of KeyRangePartition topics to match, and the message TTL,
+// max message size and ACL changed. Changing anything else returns an error, and none of the
+// changes are applied.
+func (b *Broker) UpdateTopic(topicDef TopicDefinition) error {
+	b.mutex.RLock()
+	topic, ok := b.topicsByName[topicDef.Name]
+	b.mutex.RUnlock()
+	if !ok {
+		return errTopicNotFound{topic: topicDef.Name}
+	}
+	if err := topic.update(topicDef); err != nil {
+		return fmt.Errorf("updating topic %q: %w", topicDef.Name, err)
+	}
+	return nil
+}
+
+// Remove the topic from the broker, and from any subscriptions which had joined it.
+func (b *Broker) deleteTopic(topicName string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.topicsByName, topicName)
+	b.subscriptions.forEach(func(_ string, subscription *subscription) {
+		subscription.leave(topicName)
+	})
+}
+
+func (b *Broker) Publish(topicName string, newMessages ...Message) error {
+	b.mutex.RLock()
 	topic, ok := b.topicsByName[topicName]
+	b.mutex.RUnlock()
 	if !ok {
 		return errTopicNotFound{topic: topicName}
 	}
+	if topic.cleanupPolicy == CompactCleanup {
+		if err := validateKeys(newMessages); err != nil {
+			return err
+		}
+	}
+	if topic.schemaSubject != "" {
+		if err := b.validatePayloads(topic.schemaSubject, newMessages); err != nil {
+			return err
+		}
+	}
 	return topic.publish(newMessages...)
 }
 
-func (b Broker) Subscribe(topicName, group string) (string, error) {
+// TopicInfo describes a topic's configuration which is relevant to its clients.
+type TopicInfo struct {
+	NumberOfPartitions int
+	// The largest a published Message can be, in bytes as encoded, or zero if the broker's limit
+	// applies.
+	MaxMessageSize int
+	Metrics        TopicMetrics
+}
+
+func (b *Broker) TopicInfo(topicName string) (TopicInfo, error) {
+	b.mutex.RLock()
 	topic, ok := b.topicsByName[topicName]
+	b.mutex.RUnlock()
 	if !ok {
-		return "", errTopicNotFound{topic: topicName}
+		return TopicInfo{}, errTopicNotFound{topic: topicName}
 	}
+	return topic.info(), nil
+}
 
-	subscriberID := topic.subscribe(group)
-	b.topicNameBySubscriberID[subscriberID] = topicName
+// Subscribe to the topic, or to every topic matching the pattern if it has wildcards, including
+// topics created later.
+func (b *Broker) Subscribe(topicPattern, group string, opts SubscriptionOptions) (string, error) {
+	pattern, err := parseTopicPattern(topicPattern)
+	if err != nil {
+		return "", err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if pattern.isExact() {
+		topic, ok := b.topicsByName[topicPattern]
+		if !ok {
+			return "", errTopicNotFound{topic: topicPattern}
+		}
+		if !topic.allows(opts.ClientID, SubscribeAccess) {
+			return "", errAccessDenied(topicPattern, opts.ClientID, SubscribeAccess)
+		}
+	}
+
+	var topicNames []string
+	for _, topicName := range slices.Sorted(maps.Keys(b.topicsByName)) {
+		if !pattern.match(topicName) || !b.topicsByName[topicName].allows(opts.ClientID, SubscribeAccess) {
+			continue
+		}
+		// Check every topic before joining any, so none are joined if the subscription fails.
+		if err := b.topicsByName[topicName].checkSubscribe(group, opts); err != nil {
+			return "", err
+		}
+		topicNames = append(topicNames, topicName)
+	}
+
+	subscriberID := uuid.NewV4().String()
+	subscription := &subscription{
+		pattern: pattern,
+		group:   group,
+		opts:    opts,
+	}
+	for _, topicName := range topicNames {
+		if err := subscription.join(subscriberID, topicName, b.topicsByName[topicName]); err != nil {
+			return "", err
+		}
+	}
+	b.subscriptions.add(subscriberID, subscription)
 
 	return subscriberID, nil
 }
 
-func (b Broker) Poll(subscriberID string, maxBufferSize int) ([]Message, error) {
-	topicName, ok := b.topicNameBySubscriberID[subscriberID]
+// PollLimits bound how much a poll returns. The first message is returned however large it is, so
+// the subscriber always makes progress.
+type PollLimits struct {
+	// The most messages returned.
+	MaxMessages int
+	// The most bytes of messages returned, or zero for no limit.
+	MaxBytes int
+	// The most bytes of messages returned from each partition, or zero for no limit.
+	PartitionMaxBytes int
+	// The size of a Message in bytes, as counted by the limits. Defaults to the size of its key,
+	// payload and headers.
+	Size func(Message) int
+}
+
+func (b *Broker) Poll(subscriberID string, limits PollLimits) ([]Message, error) {
+	subscription, ok := b.subscriptions.get(subscriberID)
 	if !ok {
 		return nil, commonerrors.NewFailedPrecondition("invalid polling request", commonerrors.PreconditionFailure{
 			Type:        errSubscriberNotFound,
 			Description: fmt.Sprintf("Subscriber %q is not a registered subscriber of the broker.", subscriberID),
 		})
 	}
-	topic, ok := b.topicsByName[topicName]
+	return subscription.poll(subscriberID, limits)
+}
+
+// Release the messages returned by Poll once they're no longer used, so the buffer holding them can
+// be reused by a later poll. Their payloads and headers are shared with the stored messages, so can
+// be kept but mustn't be modified.
+func (b *Broker) ReleasePoll(messages []Message) {
+	releasePollBuffer(messages)
+}
+
+func (b *Broker) MoveOffset(subscriberID string, delta int) error {
+	subscription, ok := b.subscriptions.get(subscriberID)
 	if !ok {
-		// This shouldn't happen, as the subscriber was found, meaning the topic existed in the past.
-		return nil, errTopicNotFound{topic: topicName}
+		return commonerrors.NewFailedPrecondition("invalid polling request", commonerrors.PreconditionFailure{
+			Type:        errSubscriberNotFound,
+			Description: fmt.Sprintf("Subscriber %q is not a registered subscriber of the broker.", subscriberID),
+		})
 	}
-	return topic.poll(subscriberID, maxBufferSize)
+	return subscription.moveOffset(subscriberID, delta)
 }
 
-func (b Broker) MoveOffset(subscriberID string, delta int) error {
-	topicName, ok := b.topicNameBySubscriberID[subscriberID]
+// Acknowledge individual messages polled by the subscriber.
+func (b *Broker) Acknowledge(subscriberID string, messageIDs ...MessageID) error {
+	subscription, ok := b.subscriptions.get(subscriberID)
 	if !ok {
-		return commonerrors.NewFailedPrecondition("invalid polling request", commonerrors.PreconditionFailure{
+		return commonerrors.NewFailedPrecondition("invalid acknowledge request", commonerrors.PreconditionFailure{
 			Type:        errSubscriberNotFound,
 			Description: fmt.Sprintf("Subscriber %q is not a registered subscriber of the broker.", subscriberID),
 		})
 	}
-	topic, ok := b.topicsByName[topicName]
+	return subscription.acknowledge(subscriberID, messageIDs)
+}
+
+// Heartbeat records that the subscriber is still live without polling, returning whether it's
+// active, i.e. not a standby of a failover group.
+func (b *Broker) Heartbeat(subscriberID string) (bool, error) {
+	subscription, ok := b.subscriptions.get(subscriberID)
 	if !ok {
-		// This shouldn't happen, as the subscriber was found, meaning the topic existed in the past.
-		return errTopicNotFound{topic: topicName}
+		return false, commonerrors.NewFailedPrecondition("invalid heartbeat request", commonerrors.PreconditionFailure{
+			Type:        errSubscriberNotFound,
+			Description: fmt.Sprintf("Subscriber %q is not a registered subscriber of the broker.", subscriberID),
+		})
+	}
+	return subscription.heartbeat(subscriberID)
+}
+
+// A snapshot of the topics, so they can be iterated over without holding the mutex.
+func (b *Broker) topics() map[string]*topic {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return maps.Clone(b.topicsByName)
+}
+
+// RunRetention compacts the topics with the compact cleanup policy and reclaims expired and
+// compacted messages from every topic each interval, until ctx is done.
+func (b *Broker) RunRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for name, topic := range b.topics() {
+			if compacted, reclaimed := topic.cleanUp(); compacted != 0 || reclaimed != 0 {
+				slog.Debug("Cleaned up messages", slog.String("topic", name), slog.Int("compacted", compacted), slog.Int("reclaimed", reclaimed))
+			}
+		}
 	}
-	return topic.moveOffset(subscriberID, delta)
 }
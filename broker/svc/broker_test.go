@@ -0,0 +1,346 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	commonerrors "pubsub/common/errors"
+	"pubsub/common/headers"
+)
+
+func mustNewBroker(tb testing.TB, topicDefs ...TopicDefinition) *Broker {
+	tb.Helper()
+	b, err := NewBroker(Options{}, topicDefs...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+// Receive messages until stop returns true, passing each poll's messages to handle.
+func receive(tb testing.TB, b *Broker, subscriberID string, limits PollLimits, stop func() bool, handle func([]Message) error) {
+	tb.Helper()
+	for {
+		msgs, err := b.Poll(subscriberID, limits)
+		if err != nil {
+			tb.Error(err)
+			return
+		}
+		if len(msgs) != 0 {
+			if err := handle(msgs); err != nil {
+				tb.Error(err)
+				return
+			}
+			continue
+		}
+		if stop() {
+			return
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+// Publishing, polling by partitioned and shared subscribers, requests, and topics being created
+// and updated all at once should neither race nor lose or duplicate messages.
+func TestBrokerConcurrentUse(t *testing.T) {
+	const (
+		topics     = 4
+		publishers = 8
+		batches    = 200
+		batchSize  = 5
+	)
+	var topicDefs []TopicDefinition
+	for i := range topics {
+		topicDefs = append(topicDefs, TopicDefinition{Name: fmt.Sprintf("t.%d", i), NumberOfPartitions: 3, PartitionStrategy: PartitionStrategy(i % 2)})
+	}
+	topicDefs = append(topicDefs, TopicDefinition{Name: "rpc", NumberOfPartitions: 1})
+	b := mustNewBroker(t, topicDefs...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.RunRetention(ctx, time.Millisecond)
+
+	var (
+		published, received atomic.Int64
+		publishing          atomic.Bool
+		subscribers         sync.WaitGroup
+	)
+	publishing.Store(true)
+	total := int64(publishers * batches * batchSize)
+	// Stop once publishing has finished and every subscriber has received everything.
+	drained := func() bool {
+		return !publishing.Load() && received.Load() >= 2*total
+	}
+
+	// A subscriber of its own group per topic, whose payloads are counted per topic.
+	receivedByTopic := make([]map[string]int, topics)
+	for i := range topics {
+		subscriberID, err := b.Subscribe(fmt.Sprintf("t.%d", i), "g", SubscriptionOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		receivedByTopic[i] = map[string]int{}
+		subscribers.Add(1)
+		go func() {
+			defer subscribers.Done()
+			receive(t, b, subscriberID, PollLimits{MaxMessages: 50}, drained, func(msgs []Message) error {
+				for _, m := range msgs {
+					receivedByTopic[i][string(m.Payload)]++
+				}
+				received.Add(int64(len(msgs)))
+				return b.MoveOffset(subscriberID, len(msgs))
+			})
+		}()
+	}
+
+	// Shared subscribers of every topic matching a pattern, acknowledging each message.
+	var sharedMutex sync.Mutex
+	receivedShared := map[string]int{}
+	for range 3 {
+		subscriberID, err := b.Subscribe("t.*", "shared", SubscriptionOptions{Type: SharedSubscription})
+		if err != nil {
+			t.Fatal(err)
+		}
+		subscribers.Add(1)
+		go func() {
+			defer subscribers.Done()
+			receive(t, b, subscriberID, PollLimits{MaxMessages: 20}, drained, func(msgs []Message) error {
+				ids := make([]MessageID, len(msgs))
+				sharedMutex.Lock()
+				for i, m := range msgs {
+					receivedShared[string(m.Payload)]++
+					ids[i] = m.ID
+				}
+				sharedMutex.Unlock()
+				received.Add(int64(len(msgs)))
+				return b.Acknowledge(subscriberID, ids...)
+			})
+		}()
+	}
+
+	// A responder echoing requests.
+	responderID, err := b.Subscribe("rpc", "responders", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribers.Add(1)
+	go func() {
+		defer subscribers.Done()
+		receive(t, b, responderID, PollLimits{MaxMessages: 10}, drained, func(msgs []Message) error {
+			for _, m := range msgs {
+				// The requester may have given up, deleting the reply topic.
+				_ = b.Publish(m.Headers[headers.ReplyTo], Message{Payload: m.Payload, Headers: map[string]string{headers.CorrelationID: m.Headers[headers.CorrelationID]}})
+			}
+			return b.MoveOffset(responderID, len(msgs))
+		})
+	}()
+
+	var publishingWG sync.WaitGroup
+	publishedByTopic := make([]atomic.Int64, topics)
+	for p := range publishers {
+		publishingWG.Add(1)
+		go func() {
+			defer publishingWG.Done()
+			for n := range batches {
+				topicIdx := rand.IntN(topics)
+				batch := make([]Message, batchSize)
+				for i := range batch {
+					batch[i] = Message{Key: fmt.Sprint(rand.IntN(50)), Payload: fmt.Appendf(nil, "%d-%d-%d", p, n, i)}
+				}
+				if err := b.Publish(fmt.Sprintf("t.%d", topicIdx), batch...); err != nil {
+					t.Error(err)
+					return
+				}
+				publishedByTopic[topicIdx].Add(batchSize)
+				published.Add(batchSize)
+			}
+		}()
+	}
+	// Requests creating and deleting reply topics, new topics joined by the shared subscribers,
+	// partitions added, and metrics read.
+	publishingWG.Add(1)
+	go func() {
+		defer publishingWG.Done()
+		for n := range 50 {
+			requestCtx, cancelRequest := context.WithTimeout(ctx, 5*time.Second)
+			reply, err := b.Request(requestCtx, "rpc", Message{Payload: []byte(fmt.Sprint(n))})
+			cancelRequest()
+			if err != nil || string(reply.Payload) != fmt.Sprint(n) {
+				t.Error("request", n, err, string(reply.Payload))
+			}
+			if n%10 == 0 {
+				if err := b.CreateTopic(TopicDefinition{Name: fmt.Sprintf("t.new%d", n), NumberOfPartitions: 1}); err != nil {
+					t.Error(err)
+				}
+				if err := b.UpdateTopic(TopicDefinition{Name: "t.1", NumberOfPartitions: 3 + n/10, PartitionStrategy: RoundRobinPartition}); err != nil {
+					t.Error(err)
+				}
+			}
+			if _, err := b.TopicInfo("t.0"); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	publishingWG.Wait()
+	publishing.Store(false)
+
+	waited := make(chan struct{})
+	go func() {
+		subscribers.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("received %d of %d messages", received.Load(), 2*total)
+	}
+
+	for i := range topics {
+		if got, want := len(receivedByTopic[i]), publishedByTopic[i].Load(); int64(got) != want {
+			t.Errorf("topic %d: received %d distinct messages, want %d", i, got, want)
+		}
+		for payload, count := range receivedByTopic[i] {
+			if count != 1 {
+				t.Errorf("topic %d: received %s %d times", i, payload, count)
+			}
+		}
+	}
+	if got := len(receivedShared); int64(got) != published.Load() {
+		t.Errorf("shared: received %d distinct messages, want %d", got, published.Load())
+	}
+	for payload, count := range receivedShared {
+		if count != 1 {
+			t.Errorf("shared: received %s %d times", payload, count)
+		}
+	}
+}
+
+// Subscribing, polling and acknowledging across many subscribers at once, while topics are created
+// and joined by pattern, should leave every subscription registered and polling.
+func TestBrokerConcurrentSubscribe(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "a.0", NumberOfPartitions: 2})
+	const subscribers = 64
+
+	var wg sync.WaitGroup
+	subscriberIDs := make([]string, subscribers)
+	for i := range subscribers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			subscriberID, err := b.Subscribe("a.*", fmt.Sprintf("g%d", i), SubscriptionOptions{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			subscriberIDs[i] = subscriberID
+			for range 20 {
+				if _, err := b.Poll(subscriberID, PollLimits{MaxMessages: 10}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 10; i++ {
+		if err := b.CreateTopic(TopicDefinition{Name: fmt.Sprintf("a.%d", i), NumberOfPartitions: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	for i := 0; i <= 10; i++ {
+		if err := b.Publish(fmt.Sprintf("a.%d", i), Message{Key: "k"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, subscriberID := range subscriberIDs {
+		msgs, err := b.Poll(subscriberID, PollLimits{MaxMessages: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 11 {
+			t.Errorf("subscriber %s polled %d messages, want one from each of the 11 topics", subscriberID, len(msgs))
+		}
+	}
+}
+
+// Polls by subscribers of separate groups while publishers append and retention compacts and
+// reclaims.
+func BenchmarkPoll(b *testing.B) {
+	for _, subscribers := range []int{1, 4, 16} {
+		for _, publishers := range []int{0, 4} {
+			b.Run(fmt.Sprintf("subscribers=%d/publishers=%d", subscribers, publishers), func(b *testing.B) {
+				br := mustNewBroker(b, TopicDefinition{Name: "t", NumberOfPartitions: 4, CleanupPolicy: CompactCleanup})
+				payload := make([]byte, 100)
+				batch := func(n int) []Message {
+					messages := make([]Message, 10)
+					for i := range messages {
+						messages[i] = Message{Key: strconv.Itoa((n*len(messages) + i) % 10000), Payload: payload}
+					}
+					return messages
+				}
+				for n := range 2000 {
+					if err := br.Publish("t", batch(n)...); err != nil {
+						b.Fatal(err)
+					}
+				}
+				subscriberIDs := make([]string, subscribers)
+				for i := range subscriberIDs {
+					subscriberID, err := br.Subscribe("t", fmt.Sprintf("g%d", i), SubscriptionOptions{})
+					if err != nil {
+						b.Fatal(err)
+					}
+					subscriberIDs[i] = subscriberID
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go br.RunRetention(ctx, 10*time.Millisecond)
+				var wg sync.WaitGroup
+				for p := range publishers {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for n := p; ctx.Err() == nil; n += publishers {
+							_ = br.Publish("t", batch(n)...)
+						}
+					}()
+				}
+
+				var polled atomic.Int64
+				b.ReportAllocs()
+				runConcurrently(b, subscribers, func(subscriber int) {
+					msgs, err := br.Poll(subscriberIDs[subscriber], PollLimits{MaxMessages: 100})
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					polled.Add(int64(len(msgs)))
+					br.ReleasePoll(msgs)
+				})
+				cancel()
+				wg.Wait()
+				b.ReportMetric(float64(polled.Load())/b.Elapsed().Seconds(), "msgs/s")
+			})
+		}
+	}
+}
+
+// Whether the error is a failed precondition of the type.
+func hasPreconditionFailure(err error, failureType string) bool {
+	failedPrecondition := commonerrors.FailedPrecondition{}
+	if !errors.As(err, &failedPrecondition) {
+		return false
+	}
+	return slices.ContainsFunc(failedPrecondition.PreconditionFailures, func(failure commonerrors.PreconditionFailure) bool {
+		return failure.Type == failureType
+	})
+}
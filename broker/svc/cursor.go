@@ -0,0 +1,179 @@
+package svc
+
+import (
+	"time"
+)
+
+// A cursor tracks a group's progress through a partition. Every message before the committed
+// offset has been acknowledged, whereas messages after it may have been acknowledged out of order,
+// or delivered and awaiting acknowledgement.
+type cursor struct {
+	committed int
+	acked     map[int]struct{}
+	inFlight  map[int]delivery
+	// The number of messages in flight for each key, and which subscriber was last delivered one.
+	inFlightByKey map[string]int
+	holderByKey   map[string]string
+	// Likewise for each payload split into chunks, by chunk ID.
+	inFlightByChunk map[string]int
+	holderByChunk   map[string]string
+}
+
+type delivery struct {
+	subscriberID string
+	key          string
+	// Empty if the message isn't a chunk.
+	chunkID string
+	// When the message is redelivered if it hasn't been acknowledged.
+	deadline time.Time
+}
+
+func newCursor(committed int) *cursor {
+	return &cursor{
+		committed:       committed,
+		acked:           map[int]struct{}{},
+		inFlight:        map[int]delivery{},
+		inFlightByKey:   map[string]int{},
+		holderByKey:     map[string]string{},
+		inFlightByChunk: map[string]int{},
+		holderByChunk:   map[string]string{},
+	}
+}
+
+func (c *cursor) isAcked(offset int) bool {
+	if offset < c.committed {
+		return true
+	}
+	_, ok := c.acked[offset]
+	return ok
+}
+
+func (c *cursor) isInFlight(offset int) bool {
+	_, ok := c.inFlight[offset]
+	return ok
+}
+
+// Whether the chunk may be delivered to the subscriber, which it may unless other chunks of its
+// payload are in flight with another subscriber. Messages which aren't chunks always may.
+func (c *cursor) mayDeliverChunk(chunkID, subscriberID string) bool {
+	return chunkID == "" || c.inFlightByChunk[chunkID] == 0 || c.holderByChunk[chunkID] == subscriberID
+}
+
+// Record the message at the offset, which is a chunk if chunkID isn't empty, as delivered to the
+// subscriber until the deadline.
+func (c *cursor) deliver(offset int, key, chunkID, subscriberID string, deadline time.Time) {
+	if _, ok := c.inFlight[offset]; !ok {
+		c.inFlightByKey[key]++
+		if chunkID != "" {
+			c.inFlightByChunk[chunkID]++
+		}
+	}
+	c.inFlight[offset] = delivery{
+		subscriberID: subscriberID,
+		key:          key,
+		chunkID:      chunkID,
+		deadline:     deadline,
+	}
+	c.holderByKey[key] = subscriberID
+	if chunkID != "" {
+		c.holderByChunk[chunkID] = subscriberID
+	}
+}
+
+// A tentativeDelivery records what delivering a message changed, so the delivery can be undone.
+type tentativeDelivery struct {
+	offset                 int
+	key, chunkID           string
+	keyHolder, chunkHolder string
+}
+
+// Record the message as delivered, as deliver does, returning what's needed to undo it. The message
+// mustn't be in flight already.
+func (c *cursor) deliverTentatively(offset int, key, chunkID, subscriberID string, deadline time.Time) tentativeDelivery {
+	delivery := tentativeDelivery{
+		offset:      offset,
+		key:         key,
+		chunkID:     chunkID,
+		keyHolder:   c.holderByKey[key],
+		chunkHolder: c.holderByChunk[chunkID],
+	}
+	c.deliver(offset, key, chunkID, subscriberID, deadline)
+	return delivery
+}
+
+// Undo the tentative delivery, restoring the holders it replaced. Deliveries must be undone in the
+// reverse of the order they were made.
+func (c *cursor) undeliver(delivery tentativeDelivery) {
+	c.settle(delivery.offset)
+	if c.inFlightByKey[delivery.key] != 0 {
+		c.holderByKey[delivery.key] = delivery.keyHolder
+	}
+	if delivery.chunkID != "" && c.inFlightByChunk[delivery.chunkID] != 0 {
+		c.holderByChunk[delivery.chunkID] = delivery.chunkHolder
+	}
+}
+
+// Stop tracking deliveries whose deadline has passed, so their messages can be redelivered.
+func (c *cursor) expire(now time.Time) {
+	for offset, delivery := range c.inFlight {
+		if now.After(delivery.deadline) {
+			c.settle(offset)
+		}
+	}
+}
+
+// Stop tracking the delivery of the message at the offset, if it's in flight.
+func (c *cursor) settle(offset int) {
+	delivery, ok := c.inFlight[offset]
+	if !ok {
+		return
+	}
+	delete(c.inFlight, offset)
+	c.inFlightByKey[delivery.key]--
+	if c.inFlightByKey[delivery.key] == 0 {
+		delete(c.inFlightByKey, delivery.key)
+		delete(c.holderByKey, delivery.key)
+	}
+	if delivery.chunkID == "" {
+		return
+	}
+	c.inFlightByChunk[delivery.chunkID]--
+	if c.inFlightByChunk[delivery.chunkID] == 0 {
+		delete(c.inFlightByChunk, delivery.chunkID)
+		delete(c.holderByChunk, delivery.chunkID)
+	}
+}
+
+// Acknowledge the messages at the offsets, moving the committed offset past every message
+// acknowledged since.
+func (c *cursor) ack(offsets ...int) {
+	for _, offset := range offsets {
+		c.settle(offset)
+		if offset >= c.committed {
+			c.acked[offset] = struct{}{}
+		}
+	}
+	for {
+		if _, ok := c.acked[c.committed]; !ok {
+			break
+		}
+		delete(c.acked, c.committed)
+		c.committed++
+	}
+}
+
+// Move the committed offset forward to the given offset, as if every message before it had been
+// acknowledged.
+func (c *cursor) commit(offset int) {
+	if len(c.acked) == 0 && len(c.inFlight) == 0 {
+		c.committed = max(c.committed, offset)
+		return
+	}
+	for offset > c.committed {
+		c.settle(c.committed)
+		delete(c.acked, c.committed)
+		c.committed++
+	}
+	// Move past any messages acknowledged out of order beyond the offset.
+	c.ack()
+}
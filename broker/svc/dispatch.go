@@ -0,0 +1,93 @@
+package svc
+
+import (
+	"hash/fnv"
+
+	"pubsub/common/headers"
+)
+
+// How a group's messages are dispatched between its subscribers.
+type SubscriptionType int
+
+const (
+	// Each of the topic's partitions is assigned to a single subscriber of the group.
+	PartitionedSubscription SubscriptionType = iota
+	// Every subscriber of the group polls from every partition, with each message delivered to one
+	// of them at a time and acknowledged individually. The chunks of a payload are delivered to the
+	// subscriber already holding any of its chunks, so it can reassemble them.
+	SharedSubscription
+	// As SharedSubscription, except that messages with the same key are delivered to the same
+	// subscriber.
+	KeySharedSubscription
+	// As SharedSubscription, except that only one message with each key is in flight at a time, so
+	// messages with the same key are processed one at a time and in order, by any subscriber. The
+	// chunks of a payload are in flight together, as they're acknowledged once reassembled.
+	KeyOrderedSubscription
+	// Every partition is assigned to the group's only subscriber, and further subscribers are
+	// rejected while it's live.
+	ExclusiveSubscription
+	// Every partition is assigned to the group's active subscriber, the earliest to join of those
+	// still live, while the rest stand by. A standby takes over from the group's committed offsets
+	// once the active subscriber loses its session.
+	FailoverSubscription
+)
+
+// A dispatchRule reports whether the message at the offset may be delivered to the subscriber
+// polling, given the state of its group's cursor.
+type dispatchRule func(c *cursor, offset int, message Message) bool
+
+// The rule for dispatching messages to the subscriber, given the group's live members.
+func (s SubscriptionType) dispatchRule(subscriberID string, members []string) dispatchRule {
+	switch s {
+	case SharedSubscription:
+		return func(c *cursor, offset int, message Message) bool {
+			return !c.isInFlight(offset) && c.mayDeliverChunk(message.Headers[headers.ChunkID], subscriberID)
+		}
+	case KeySharedSubscription:
+		return func(c *cursor, offset int, message Message) bool {
+			if c.isInFlight(offset) || keyOwner(message.Key, members) != subscriberID {
+				return false
+			}
+			// A key's messages still in flight with its previous owner must be acknowledged first,
+			// to keep them in order.
+			return c.inFlightByKey[message.Key] == 0 || c.holderByKey[message.Key] == subscriberID
+		}
+	case KeyOrderedSubscription:
+		return func(c *cursor, offset int, message Message) bool {
+			// Any earlier message with the key and priority is either acknowledged or in flight, as
+			// it would otherwise have been delivered instead.
+			if c.inFlightByKey[message.Key] == 0 {
+				return true
+			}
+			// Unless those in flight are the earlier chunks of the message's payload, held by the
+			// subscriber.
+			chunkID := message.Headers[headers.ChunkID]
+			return chunkID != "" && !c.isInFlight(offset) && c.inFlightByChunk[chunkID] == c.inFlightByKey[message.Key] && c.holderByChunk[chunkID] == subscriberID
+		}
+	default:
+		return func(c *cursor, offset int, message Message) bool {
+			return true
+		}
+	}
+}
+
+// Whether the group's messages are tracked while in flight, so they're delivered to one subscriber
+// at a time.
+func (s SubscriptionType) tracksDeliveries() bool {
+	switch s {
+	case SharedSubscription, KeySharedSubscription, KeyOrderedSubscription:
+		return true
+	default:
+		return false
+	}
+}
+
+// The member which the key's messages are delivered to, given the members sorted by ID.
+func keyOwner(key string, members []string) string {
+	if len(members) == 0 {
+		return ""
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return members[hash.Sum64()%uint64(len(members))]
+}
@@ -0,0 +1,110 @@
+package svc
+
+import (
+	"strconv"
+	"testing"
+
+	"pubsub/common/headers"
+)
+
+func chunk(key, chunkID string, index, count int) Message {
+	return Message{
+		Key:     key,
+		Payload: []byte(chunkID + "/" + strconv.Itoa(index)),
+		Headers: map[string]string{
+			headers.ChunkID:    chunkID,
+			headers.ChunkIndex: strconv.Itoa(index),
+			headers.ChunkCount: strconv.Itoa(count),
+		},
+	}
+}
+
+func payloads(msgs []Message) []string {
+	p := make([]string, len(msgs))
+	for i, m := range msgs {
+		p[i] = string(m.Payload)
+	}
+	return p
+}
+
+func mustPoll(t *testing.T, b *Broker, subscriberID string, limit int) []Message {
+	t.Helper()
+	msgs, err := b.Poll(subscriberID, PollLimits{MaxMessages: limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+// The chunks of a payload are delivered to the subscriber of a shared group already holding any of
+// them, so it can reassemble them.
+func TestSharedDispatchChunks(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 1})
+	first, err := b.Subscribe("t", "g", SubscriptionOptions{Type: SharedSubscription})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.Subscribe("t", "g", SubscriptionOptions{Type: SharedSubscription})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("t", chunk("a", "x", 0, 3), chunk("b", "x", 1, 3), Message{Key: "c", Payload: []byte("m")}, chunk("d", "x", 2, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := payloads(mustPoll(t, b, first, 1)); len(got) != 1 || got[0] != "x/0" {
+		t.Fatalf("first subscriber polled %v, want the first chunk", got)
+	}
+	if got := payloads(mustPoll(t, b, second, 10)); len(got) != 1 || got[0] != "m" {
+		t.Fatalf("second subscriber polled %v, want only the message which isn't a chunk", got)
+	}
+	msgs := mustPoll(t, b, first, 10)
+	if got := payloads(msgs); len(got) != 2 || got[0] != "x/1" || got[1] != "x/2" {
+		t.Fatalf("first subscriber polled %v, want the rest of the chunks", got)
+	}
+
+	// Once acknowledged, another payload with the same chunk ID could go to any subscriber.
+	if err := b.Acknowledge(first, MessageID{Topic: "t", Offset: 0}, msgs[0].ID, msgs[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("t", chunk("a", "x", 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(mustPoll(t, b, second, 10)); len(got) != 1 || got[0] != "x/0" {
+		t.Fatalf("second subscriber polled %v, want the new chunk", got)
+	}
+}
+
+// The chunks of a payload are in flight together in a key ordered group, as they're acknowledged
+// once they've all been received, while later messages with the key wait for them.
+func TestKeyOrderedDispatchChunks(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 1})
+	first, err := b.Subscribe("t", "g", SubscriptionOptions{Type: KeyOrderedSubscription})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.Subscribe("t", "g", SubscriptionOptions{Type: KeyOrderedSubscription})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("t", chunk("k", "x", 0, 2), chunk("k", "x", 1, 2), Message{Key: "k", Payload: []byte("m")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := payloads(mustPoll(t, b, first, 1)); len(got) != 1 || got[0] != "x/0" {
+		t.Fatalf("first subscriber polled %v, want the first chunk", got)
+	}
+	if got := payloads(mustPoll(t, b, second, 10)); len(got) != 0 {
+		t.Fatalf("second subscriber polled %v, want nothing while the key's chunks are in flight", got)
+	}
+	msgs := mustPoll(t, b, first, 10)
+	if got := payloads(msgs); len(got) != 1 || got[0] != "x/1" {
+		t.Fatalf("first subscriber polled %v, want only the second chunk", got)
+	}
+	if err := b.Acknowledge(first, MessageID{Topic: "t", Offset: 0}, msgs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(mustPoll(t, b, second, 10)); len(got) != 1 || got[0] != "m" {
+		t.Fatalf("second subscriber polled %v, want the message after the chunks", got)
+	}
+}
@@ -4,7 +4,15 @@ import (
 	"fmt"
 )
 
-var errSubscriberNotFound = "SUBSCRIBER_NOT_FOUND"
+var (
+	errSubscriberNotFound        = "SUBSCRIBER_NOT_FOUND"
+	errSubscriptionTypeMismatch  = "SUBSCRIPTION_TYPE_MISMATCH"
+	errPartitionNotAssigned      = "PARTITION_NOT_ASSIGNED"
+	errTopicNotSubscribed        = "TOPIC_NOT_SUBSCRIBED"
+	errExclusiveSubscriberExists = "EXCLUSIVE_SUBSCRIBER_EXISTS"
+	errSubscriberNotActive       = "SUBSCRIBER_NOT_ACTIVE"
+	errFilterMismatch            = "FILTER_MISMATCH"
+)
 
 type errTopicNotFound struct {
 	topic string
@@ -14,6 +22,14 @@ func (e errTopicNotFound) Error() string {
 	return fmt.Sprintf("topic %q not found", e.topic)
 }
 
+type errTopicAlreadyExists struct {
+	topic string
+}
+
+func (e errTopicAlreadyExists) Error() string {
+	return fmt.Sprintf("topic %q already exists", e.topic)
+}
+
 type errInvalidOffsetDelta struct {
 	delta int
 }
@@ -0,0 +1,171 @@
+package svc
+
+import (
+	"iter"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// How many messages each chunk of a messageLog holds.
+const chunkSize = 256
+
+// A messageLog holds a partition's messages in fixed size chunks, which are never moved once
+// allocated, so that the messages can be read without a lock while others are appended. Messages are
+// immutable once appended: compacting a message replaces it with a new one rather than changing it.
+//
+// Concurrent appends are committed in groups: those queued while another is being committed are
+// committed together by whichever of them acquires the mutex first.
+type messageLog struct {
+	// Serialises committing, compacting and reclaiming. Reads don't take it.
+	mutex sync.Mutex
+
+	// Guards the queue of messages waiting to be committed, and how many messages have ever been
+	// queued, which is the offset after the last one queued.
+	queueMutex sync.Mutex
+	queue      []*Message
+	queued     int
+	// The queue's previous buffer, reused once its messages have been committed.
+	spare []*Message
+
+	// Offsets of the first message which hasn't been reclaimed, and of the next message appended.
+	start, end atomic.Int64
+	// Replaced rather than changed when chunks are added or dropped.
+	chunks atomic.Pointer[logChunks]
+}
+
+type logChunks struct {
+	// Offset of the first message of the first chunk.
+	baseOffset int
+	chunks     []*logChunk
+}
+
+type logChunk struct {
+	messages [chunkSize]atomic.Pointer[Message]
+}
+
+func newMessageLog() *messageLog {
+	l := &messageLog{}
+	l.chunks.Store(&logChunks{})
+	return l
+}
+
+// Offsets of the first message which hasn't been reclaimed, and of the next message appended.
+func (l *messageLog) bounds() (int, int) {
+	// Load the end first, so that every message before it has been appended, and then the start, so
+	// that it isn't after the end.
+	end := l.end.Load()
+	return int(l.start.Load()), int(end)
+}
+
+// Append the messages, returning the offset of the first once they've been committed, which may be
+// by another append. The messages mustn't be changed afterwards.
+func (l *messageLog) append(newMessages ...*Message) int {
+	l.queueMutex.Lock()
+	l.queue = append(l.queue, newMessages...)
+	l.queued += len(newMessages)
+	// The messages have been committed once the end is past them.
+	queuedEnd := l.queued
+	l.queueMutex.Unlock()
+	offset := queuedEnd - len(newMessages)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if int(l.end.Load()) >= queuedEnd {
+		// Committed by an append which acquired the mutex first.
+		return offset
+	}
+
+	l.queueMutex.Lock()
+	queue := l.queue
+	l.queue, l.spare = l.spare[:0], nil
+	l.queueMutex.Unlock()
+
+	l.commit(queue)
+	clear(queue)
+	l.spare = queue
+	return offset
+}
+
+// Only called with the mutex held.
+func (l *messageLog) commit(newMessages []*Message) {
+	end := int(l.end.Load())
+	for _, message := range newMessages {
+		chunks := l.chunks.Load()
+		chunkIdx, i := chunks.locate(end)
+		if chunkIdx == len(chunks.chunks) {
+			chunks = &logChunks{
+				baseOffset: chunks.baseOffset,
+				chunks:     append(slices.Clip(chunks.chunks), &logChunk{}),
+			}
+			l.chunks.Store(chunks)
+		}
+		chunks.chunks[chunkIdx].messages[i].Store(message)
+		end++
+	}
+	// Readers only read messages before the end, so they're only visible once they've been stored.
+	l.end.Store(int64(end))
+}
+
+// The messages from the offset to the end, as of when it's called, with their offsets. Messages
+// reclaimed before they're reached are skipped.
+func (l *messageLog) from(offset int) iter.Seq2[int, *Message] {
+	return func(yield func(int, *Message) bool) {
+		start, end := l.bounds()
+		chunks := l.chunks.Load()
+		for offset = max(offset, start, chunks.baseOffset); offset < end; offset++ {
+			chunkIdx, i := chunks.locate(offset)
+			message := chunks.chunks[chunkIdx].messages[i].Load()
+			if message == nil {
+				continue
+			}
+			if !yield(offset, message) {
+				return
+			}
+		}
+	}
+}
+
+// The messages from the end back to the start, with their offsets. Only called with the mutex held.
+func (l *messageLog) backward() iter.Seq2[int, *atomic.Pointer[Message]] {
+	return func(yield func(int, *atomic.Pointer[Message]) bool) {
+		start, end := l.bounds()
+		chunks := l.chunks.Load()
+		for offset := end - 1; offset >= start; offset-- {
+			chunkIdx, i := chunks.locate(offset)
+			if !yield(offset, &chunks.chunks[chunkIdx].messages[i]) {
+				return
+			}
+		}
+	}
+}
+
+// Reclaim the messages before the offset, dropping the chunks which only held those. Only called
+// with the mutex held.
+func (l *messageLog) reclaim(offset int) {
+	start := int(l.start.Load())
+	l.start.Store(int64(offset))
+
+	chunks := l.chunks.Load()
+	dropped, i := chunks.locate(offset)
+	// Clear the reclaimed messages of the chunk which is kept, so they can be garbage collected.
+	if dropped < len(chunks.chunks) {
+		for j := max(start-chunks.baseOffset-dropped*chunkSize, 0); j < i; j++ {
+			chunks.chunks[dropped].messages[j].Store(nil)
+		}
+	}
+	if dropped == 0 {
+		return
+	}
+	l.chunks.Store(&logChunks{
+		baseOffset: chunks.baseOffset + dropped*chunkSize,
+		chunks:     slices.Clone(chunks.chunks[dropped:]),
+	})
+}
+
+// The index of the chunk holding the offset, and of the offset within it.
+func (c *logChunks) locate(offset int) (int, int) {
+	i := offset - c.baseOffset
+	return i / chunkSize, i % chunkSize
+}
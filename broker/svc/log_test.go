@@ -0,0 +1,274 @@
+package svc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMessageLog(t *testing.T) {
+	l := newMessageLog()
+	for i := range 1000 {
+		l.append(&Message{Key: strconv.Itoa(i)})
+	}
+	assertLog(t, l, 0, 1000)
+
+	// Reclaiming within a chunk drops the chunks before it and clears the reclaimed messages of it.
+	l.mutex.Lock()
+	l.reclaim(300)
+	l.mutex.Unlock()
+	assertLog(t, l, 300, 1000)
+	chunks := l.chunks.Load()
+	if len(chunks.chunks) != 3 || chunks.baseOffset != chunkSize {
+		t.Errorf("got %d chunks from offset %d, want 3 from offset %d", len(chunks.chunks), chunks.baseOffset, chunkSize)
+	}
+	for i := range 300 - chunkSize {
+		if chunks.chunks[0].messages[i].Load() != nil {
+			t.Fatalf("reclaimed message at offset %d wasn't cleared", chunkSize+i)
+		}
+	}
+
+	// Reclaiming every message keeps the partly filled chunk the next message is appended to.
+	l.mutex.Lock()
+	l.reclaim(1000)
+	l.mutex.Unlock()
+	assertLog(t, l, 1000, 1000)
+	for i := 1000; i < 4*chunkSize; i++ {
+		l.append(&Message{Key: strconv.Itoa(i)})
+	}
+	l.mutex.Lock()
+	l.reclaim(4 * chunkSize)
+	l.mutex.Unlock()
+	if chunks := l.chunks.Load(); len(chunks.chunks) != 0 || chunks.baseOffset != 4*chunkSize {
+		t.Errorf("got %d chunks from offset %d, want none from offset %d", len(chunks.chunks), chunks.baseOffset, 4*chunkSize)
+	}
+	l.append(&Message{Key: strconv.Itoa(4 * chunkSize)})
+	assertLog(t, l, 4*chunkSize, 4*chunkSize+1)
+}
+
+// Assert the log's bounds, and that it holds the messages between them keyed by their offsets.
+func assertLog(t *testing.T, l *messageLog, wantStart, wantEnd int) {
+	t.Helper()
+	if start, end := l.bounds(); start != wantStart || end != wantEnd {
+		t.Fatalf("got bounds [%d, %d), want [%d, %d)", start, end, wantStart, wantEnd)
+	}
+	offset := wantStart
+	for o, message := range l.from(0) {
+		if o != offset || message.Key != strconv.Itoa(o) {
+			t.Fatalf("got message %s at offset %d, want offset %d", message.Key, o, offset)
+		}
+		offset++
+	}
+	if offset != wantEnd {
+		t.Fatalf("read up to offset %d, want %d", offset, wantEnd)
+	}
+}
+
+// Concurrent appends are committed in groups, each by the time its append returns, and each
+// append's messages stay together and in order.
+func TestMessageLogGroupCommit(t *testing.T) {
+	l := newMessageLog()
+	const appenders, appends = 8, 500
+
+	var wg sync.WaitGroup
+	for a := range appenders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := strconv.Itoa(a)
+			for i := range appends {
+				l.queueMutex.Lock()
+				queued := l.queued
+				l.queueMutex.Unlock()
+				l.append(&Message{Key: key, Priority: 2 * i}, &Message{Key: key, Priority: 2*i + 1})
+				// The messages were queued after those counted, so the end must be past them.
+				if _, end := l.bounds(); end < queued+2 {
+					t.Errorf("appender %d: append %d returned before it was committed", a, i)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	previous := map[string]int{}
+	previousOffsets := map[string]int{}
+	n := 0
+	for offset, message := range l.from(0) {
+		if p, ok := previous[message.Key]; ok && message.Priority != p+1 {
+			t.Fatalf("appender %s: message %d after %d", message.Key, message.Priority, p)
+		}
+		if message.Priority%2 == 1 && offset != previousOffsets[message.Key]+1 {
+			t.Fatalf("appender %s: messages of one append at offsets %d and %d", message.Key, previousOffsets[message.Key], offset)
+		}
+		previous[message.Key] = message.Priority
+		previousOffsets[message.Key] = offset
+		n++
+	}
+	if n != appenders*appends*2 || l.queued != n {
+		t.Errorf("read %d messages of %d queued, want %d", n, l.queued, appenders*appends*2)
+	}
+}
+
+// Readers see a consistent log while messages are appended, compacted and reclaimed: offsets only
+// increase, and each message is either as published or a compacted stub of it.
+func TestMessageLogConcurrentCompaction(t *testing.T) {
+	p := newPartition()
+	const (
+		appenders = 4
+		appends   = 2000
+		keys      = 20
+	)
+
+	var (
+		appending sync.WaitGroup
+		others    sync.WaitGroup
+		done      atomic.Bool
+	)
+	for a := range appenders {
+		appending.Add(1)
+		go func() {
+			defer appending.Done()
+			for i := range appends {
+				key := strconv.Itoa((a*appends + i) % keys)
+				p.publish(&Message{Key: key, Payload: []byte(fmt.Sprintf("%s/%d-%d", key, a, i))})
+			}
+		}()
+	}
+	others.Add(1)
+	go func() {
+		defer others.Done()
+		for !done.Load() {
+			p.compact()
+			p.reclaim(time.Now())
+		}
+	}()
+	for range 4 {
+		others.Add(1)
+		go func() {
+			defer others.Done()
+			for !done.Load() {
+				previous := -1
+				for offset, message := range p.messages.from(0) {
+					if offset <= previous {
+						t.Errorf("read offset %d after %d", offset, previous)
+						return
+					}
+					previous = offset
+					if message.compacted {
+						if len(message.Payload) != 0 {
+							t.Errorf("compacted message at offset %d kept its payload", offset)
+							return
+						}
+					} else if !strings.HasPrefix(string(message.Payload), message.Key+"/") {
+						t.Errorf("message at offset %d has key %s but payload %s", offset, message.Key, message.Payload)
+						return
+					}
+				}
+			}
+		}()
+	}
+	appending.Wait()
+	done.Store(true)
+	others.Wait()
+
+	// Once compacted, only the latest message of each key is left.
+	p.compact()
+	p.reclaim(time.Now())
+	latest := map[string]int{}
+	for offset, message := range p.messages.from(0) {
+		if !message.compacted {
+			if _, ok := latest[message.Key]; ok {
+				t.Errorf("key %s has more than one message after compacting", message.Key)
+			}
+			latest[message.Key] = offset
+		}
+	}
+	if len(latest) != keys {
+		t.Errorf("got %d keys after compacting, want %d", len(latest), keys)
+	}
+}
+
+// Appends by concurrent publishers to a single log.
+func BenchmarkMessageLogAppend(b *testing.B) {
+	for _, appenders := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("appenders=%d", appenders), func(b *testing.B) {
+			l := newMessageLog()
+			message := &Message{Payload: make([]byte, 100)}
+			b.ReportAllocs()
+			runConcurrently(b, appenders, func(int) {
+				l.append(message)
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
+
+// Reads of a log while it's appended to, compacted and reclaimed.
+func BenchmarkMessageLogFrom(b *testing.B) {
+	for _, appenders := range []int{0, 4} {
+		b.Run(fmt.Sprintf("appenders=%d", appenders), func(b *testing.B) {
+			p := newPartition()
+			for i := range 10 * chunkSize {
+				p.publish(&Message{Key: strconv.Itoa(i % 1000), Payload: make([]byte, 100)})
+			}
+
+			var (
+				wg   sync.WaitGroup
+				done atomic.Bool
+			)
+			for a := range appenders {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; !done.Load(); i++ {
+						p.publish(&Message{Key: strconv.Itoa((a + i) % 1000), Payload: make([]byte, 100)})
+						if i%chunkSize == 0 {
+							p.compact()
+							p.reclaim(time.Now())
+						}
+					}
+				}()
+			}
+
+			var read atomic.Int64
+			b.ReportAllocs()
+			runConcurrently(b, 4, func(int) {
+				n := 0
+				for range p.messages.from(0) {
+					if n++; n == 100 {
+						break
+					}
+				}
+				read.Add(int64(n))
+			})
+			done.Store(true)
+			wg.Wait()
+			b.ReportMetric(float64(read.Load())/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
+
+// Split b.N calls of f between the number of goroutines, passing each its index, and time them.
+func runConcurrently(b *testing.B, goroutines int, f func(goroutine int)) {
+	var (
+		wg   sync.WaitGroup
+		next atomic.Int64
+	)
+	b.ResetTimer()
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for next.Add(1) <= int64(b.N) {
+				f(g)
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+}
@@ -0,0 +1,29 @@
+package svc
+
+import (
+	"sync/atomic"
+)
+
+// TopicMetrics counts how a topic's messages have been cleaned up since the Broker started.
+type TopicMetrics struct {
+	// Number of times a poll skipped over an expired message.
+	ExpiredSkipped int64
+	// Number of expired messages reclaimed by retention.
+	ExpiredReclaimed int64
+	// Number of messages compacted, having been superseded by a later message with the same key.
+	Compacted int64
+}
+
+type topicMetrics struct {
+	expiredSkipped   atomic.Int64
+	expiredReclaimed atomic.Int64
+	compacted        atomic.Int64
+}
+
+func (m *topicMetrics) snapshot() TopicMetrics {
+	return TopicMetrics{
+		ExpiredSkipped:   m.expiredSkipped.Load(),
+		ExpiredReclaimed: m.expiredReclaimed.Load(),
+		Compacted:        m.compacted.Load(),
+	}
+}
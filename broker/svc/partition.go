@@ -1,43 +1,210 @@
 package svc
 
 import (
+	"slices"
 	"sync"
+	"time"
+
+	"pubsub/common/headers"
 )
 
 type partition struct {
-	mutex sync.RWMutex
+	// Guards the cursors. The messages are read without it.
+	mutex sync.Mutex
+
+	messages       *messageLog
+	cursorsByGroup map[string]*cursor
+}
 
-	messages      *[]Message
-	offsetByGroup map[string]int
+// polledRange records which messages of a partition were delivered by a poll, so that they can be
+// acknowledged by moving the offset afterwards.
+type polledRange struct {
+	partitionIdx int
+	offsets      []int
+}
+
+// A partitionPoll describes which of a partition's messages a poll should deliver.
+type partitionPoll struct {
+	// Identify the messages delivered.
+	topic        string
+	partitionIdx int
+	group        string
+	subscriberID string
+	limit        int
+	// The messages delivered are taken from the poll's budget, and are at most maxBytes from this
+	// partition.
+	budget   *pollBudget
+	maxBytes int
+	// Only messages with the priority are delivered, leaving the rest for polls of their own
+	// priority.
+	priority int
+	// Messages for which skip returns true are never delivered to the subscriber, and are moved past
+	// as if they were acknowledged.
+	skip func(Message) bool
+	// Messages which aren't deliverable to the subscriber are left for a later poll.
+	deliverable dispatchRule
+	// When the messages delivered are redelivered if they haven't been acknowledged. If zero, every
+	// poll redelivers them until they're acknowledged.
+	deadline time.Time
+	now      time.Time
 }
 
 func newPartition() *partition {
 	return &partition{
-		messages:      &[]Message{},
-		offsetByGroup: map[string]int{},
+		messages:       newMessageLog(),
+		cursorsByGroup: map[string]*cursor{},
 	}
 }
 
-func (p *partition) publish(newMessages ...Message) {
+// Publish the messages, returning the offset of the first.
+func (p *partition) publish(newMessages ...*Message) int {
+	return p.messages.append(newMessages...)
+}
+
+// The group's cursor, which must be called with the mutex held.
+func (p *partition) cursor(group string) *cursor {
+	start, _ := p.messages.bounds()
+	c, ok := p.cursorsByGroup[group]
+	if !ok {
+		c = newCursor(start)
+		p.cursorsByGroup[group] = c
+	}
+	// Move past any messages reclaimed since.
+	c.commit(start)
+	return c
+}
+
+// A partitionScan holds the messages of a partition which a poll could deliver, found by scanning
+// it once, by priority and in order.
+type partitionScan struct {
+	byPriority [MaxPriority + 1][]scannedMessage
+}
+
+type scannedMessage struct {
+	offset  int
+	message *Message
+}
+
+// Scan the partition once for up to limit messages of each priority which could be delivered to
+// the subscriber. Messages skipped are moved past as if they were acknowledged. The stop bits are
+// the priorities whose messages are looked for: the scan stops once it has found limit of each.
+func (p *partition) scan(request partitionPoll, stop uint32, limit int) *partitionScan {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	*p.messages = append(*p.messages, newMessages...)
+	c := p.cursor(request.group)
+	if !request.deadline.IsZero() {
+		c.expire(request.now)
+	}
+
+	scan := &partitionScan{}
+	// The messages found are delivered while scanning, so whether later messages could be delivered
+	// accounts for them, e.g. to only find one message of each key for a key ordered group. They're
+	// undelivered afterwards, to be delivered once the poll decides which to return.
+	var tentative []tentativeDelivery
+	for offset, message := range p.messages.from(c.committed) {
+		found := &scan.byPriority[message.Priority]
+		if len(*found) == limit || c.isAcked(offset) || !request.deliverable(c, offset, *message) {
+			continue
+		}
+		if request.skip(*message) {
+			c.ack(offset)
+			continue
+		}
+
+		*found = append(*found, scannedMessage{offset: offset, message: message})
+		if !request.deadline.IsZero() {
+			tentative = append(tentative, c.deliverTentatively(offset, message.Key, message.Headers[headers.ChunkID], request.subscriberID, request.deadline))
+		}
+		if len(*found) == limit {
+			if stop &^= 1 << message.Priority; stop == 0 {
+				break
+			}
+		}
+	}
+	for _, delivery := range slices.Backward(tentative) {
+		c.undeliver(delivery)
+	}
+	return scan
 }
 
-func (p *partition) poll(group string, limit int) []Message {
-	p.mutex.RLock()
-	defer p.mutex.RUnlock()
+// Poll up to the limit of the scanned messages of the request's priority for the group, appending
+// copies of them to polledMessages and their offsets to offsets. Returns how many bytes the messages
+// polled are. Messages which can no longer be delivered, as the group's cursor has changed since
+// the scan, are passed over.
+func (p *partition) poll(request partitionPoll, scan *partitionScan, polledMessages []Message, offsets []int) ([]Message, []int, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	c := p.cursor(request.group)
+	scanned := &scan.byPriority[request.priority]
+	polled, polledBytes := 0, 0
+	for ; len(*scanned) != 0 && polled < request.limit; *scanned = (*scanned)[1:] {
+		offset, message := (*scanned)[0].offset, (*scanned)[0].message
+		if c.isAcked(offset) || !request.deliverable(c, offset, *message) {
+			continue
+		}
 
-	offset := p.offsetByGroup[group]
-	if offset == len(*p.messages) {
-		// Group has polled all messages in this partition.
-		return nil
+		polledMessage := *message
+		polledMessage.ID = MessageID{
+			Topic:     request.topic,
+			Partition: request.partitionIdx,
+			Offset:    offset,
+		}
+		size, ok := request.budget.take(polledMessage, request.maxBytes-polledBytes)
+		if !ok {
+			// Later messages are left too, so they're still delivered in order.
+			break
+		}
+
+		if !request.deadline.IsZero() {
+			c.deliver(offset, message.Key, message.Headers[headers.ChunkID], request.subscriberID, request.deadline)
+		}
+		polledMessages = append(polledMessages, polledMessage)
+		offsets = append(offsets, offset)
+		polled++
+		polledBytes += size
 	}
+	return polledMessages, offsets, polledBytes
+}
 
-	end := min(offset+limit, len(*p.messages))
-	polledMessages := *p.messages
-	return polledMessages[offset:end]
+// Whether the message at the offset is still to be delivered to the group, as it hasn't been
+// acknowledged, reclaimed or compacted.
+func (p *partition) pending(group string, offset int) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.cursor(group).isAcked(offset) {
+		return false
+	}
+	for messageOffset, message := range p.messages.from(offset) {
+		return messageOffset == offset && !message.compacted
+	}
+	return false
+}
+
+func (p *partition) find(match func(Message) bool) (Message, bool) {
+	for _, message := range p.messages.from(0) {
+		if match(*message) {
+			return *message, true
+		}
+	}
+	return Message{}, false
+}
+
+// Acknowledge the group's messages at the given offsets.
+func (p *partition) acknowledge(group string, offsets ...int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	c := p.cursor(group)
+	_, end := p.messages.bounds()
+	for _, offset := range offsets {
+		// Ignore offsets of messages which haven't been published yet.
+		if offset < end {
+			c.ack(offset)
+		}
+	}
 }
 
 // Move the offset by the given delta. The given delta can exceed the current partition, so the
@@ -46,9 +213,76 @@ func (p *partition) moveOffset(group string, delta int) int {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	offset := p.offsetByGroup[group]
-	newOffset := min(offset+delta, len(*p.messages))
-	p.offsetByGroup[group] = newOffset
+	c := p.cursor(group)
+	offset := c.committed
+	_, end := p.messages.bounds()
+	newOffset := min(offset+delta, end)
+	c.commit(newOffset)
 
 	return offset + delta - newOffset
 }
+
+// Reclaim the run of expired and compacted messages at the head of the partition, returning how
+// many were reclaimed, and how many of those had expired. Those behind other messages are kept
+// until they reach the head.
+func (p *partition) reclaim(now time.Time) (int, int) {
+	p.messages.mutex.Lock()
+	defer p.messages.mutex.Unlock()
+
+	start, _ := p.messages.bounds()
+	reclaimed, expired := 0, 0
+	for _, message := range p.messages.from(start) {
+		if !message.compacted && !message.expired(now) {
+			break
+		}
+		if !message.compacted {
+			expired++
+		}
+		reclaimed++
+	}
+	if reclaimed == 0 {
+		return 0, 0
+	}
+
+	// Cursors are moved past the reclaimed messages the next time they're used.
+	p.messages.reclaim(start + reclaimed)
+	return reclaimed, expired
+}
+
+// Compact the messages superseded by a later message with the same key, returning how many were
+// compacted. A compacted message keeps its offset but not its payload, and is skipped by polls
+// until it's reclaimed. The chunks of a payload are superseded together.
+//
+// Messages are replaced rather than changed, so polls can continue to read them meanwhile.
+func (p *partition) compact() int {
+	p.messages.mutex.Lock()
+	defer p.messages.mutex.Unlock()
+
+	// The chunk ID of the latest message with each key, which is empty if it isn't a chunk.
+	latestChunkIDs := map[string]string{}
+	compacted := 0
+	for _, slot := range p.messages.backward() {
+		message := slot.Load()
+		if message == nil || message.compacted {
+			continue
+		}
+		chunkID := message.Headers[headers.ChunkID]
+		latestChunkID, ok := latestChunkIDs[message.Key]
+		if !ok {
+			latestChunkIDs[message.Key] = chunkID
+			continue
+		}
+		if chunkID != "" && chunkID == latestChunkID {
+			continue
+		}
+
+		slot.Store(&Message{
+			Key:       message.Key,
+			Timestamp: message.Timestamp,
+			Priority:  message.Priority,
+			compacted: true,
+		})
+		compacted++
+	}
+	return compacted
+}
@@ -0,0 +1,45 @@
+package svc
+
+import (
+	"slices"
+	"testing"
+)
+
+// Compaction keeps the latest message with each key, along with every chunk of the latest chunked
+// payload, and leaves the messages it supersedes as placeholders which keep their offsets.
+func TestPartitionCompact(t *testing.T) {
+	p := newPartition()
+	for _, message := range []Message{
+		{Key: "a", Payload: []byte("a1")},
+		{Key: "b", Payload: []byte("b1")},
+		chunk("c", "old", 0, 2),
+		chunk("c", "old", 1, 2),
+		{Key: "a", Payload: []byte("a2")},
+		chunk("c", "new", 0, 2),
+		{Key: "a", Payload: []byte("a3"), Priority: 1},
+		chunk("c", "new", 1, 2),
+	} {
+		p.publish(&message)
+	}
+
+	if compacted := p.compact(); compacted != 4 {
+		t.Errorf("compacted %d messages, want 4", compacted)
+	}
+	var got []string
+	for offset, message := range p.messages.from(0) {
+		if message.compacted {
+			if message.Payload != nil || message.Key == "" {
+				t.Errorf("offset %d was compacted to %+v, want only its key, timestamp and priority", offset, *message)
+			}
+			continue
+		}
+		got = append(got, string(message.Payload))
+	}
+	if want := []string{"b1", "new/0", "a3", "new/1"}; !slices.Equal(got, want) {
+		t.Errorf("kept %q, want %q", got, want)
+	}
+
+	if compacted := p.compact(); compacted != 0 {
+		t.Errorf("compacted %d messages again, want none", compacted)
+	}
+}
@@ -1,33 +1,132 @@
 package svc
 
 import (
+	"encoding/binary"
 	"fmt"
 	"hash/fnv"
+	"slices"
 	"sync"
+
+	"pubsub/common/headers"
 )
 
-type partitioner interface {
-	getPartitionIdx(message Message) int
+// A Partitioner chooses which of a topic's partitions each message published to it is published
+// to, unless the message gives its partition.
+type Partitioner interface {
+	// The index of the message's partition, from zero up to the topic's number of partitions. The
+	// chunks of a payload, which share a headers.ChunkID, must be published to the same partition.
+	PartitionIdx(message Message) int
 }
 
-func newPartitioner(partitionStrategy PartitionStrategy, numberOfPartitions int) (partitioner, error) {
-	switch partitionStrategy {
-	case HashPartition:
-		return newHashPartitioner(numberOfPartitions), nil
-	case RoundRobinPartition:
-		return newRoundRobinPartitioner(numberOfPartitions), nil
-	default:
-		return nil, fmt.Errorf("unrecognised partition strategy %d", partitionStrategy)
+// A BatchPartitioner partitions each batch of published messages with a Partitioner of its own, as
+// batches can be published concurrently.
+type BatchPartitioner interface {
+	Partitioner
+	StartBatch() Partitioner
+}
+
+// A PartitionerFactory creates a Partitioner for the topic's partitions, returning why the topic's
+// options for it are invalid. It's called again with the new definition when partitions are added.
+type PartitionerFactory func(topicDef TopicDefinition) (Partitioner, error)
+
+var (
+	partitionersMutex sync.RWMutex
+	// The factory for each strategy.
+	partitioners = map[PartitionStrategy]PartitionerFactory{
+		HashPartition: func(topicDef TopicDefinition) (Partitioner, error) {
+			return newHashPartitioner(topicDef.NumberOfPartitions), nil
+		},
+		RoundRobinPartition: func(topicDef TopicDefinition) (Partitioner, error) {
+			return newRoundRobinPartitioner(topicDef.NumberOfPartitions), nil
+		},
+		StickyPartition: func(topicDef TopicDefinition) (Partitioner, error) {
+			return newStickyPartitioner(topicDef.NumberOfPartitions), nil
+		},
+		KeyRangePartition: func(topicDef TopicDefinition) (Partitioner, error) {
+			return newKeyRangePartitioner(topicDef.NumberOfPartitions, topicDef.KeySplitPoints)
+		},
+		Murmur2Partition: func(topicDef TopicDefinition) (Partitioner, error) {
+			return newMurmur2Partitioner(topicDef.NumberOfPartitions), nil
+		},
+		ConsistentHashPartition: func(topicDef TopicDefinition) (Partitioner, error) {
+			return newJumpHashPartitioner(topicDef.NumberOfPartitions), nil
+		},
 	}
+)
+
+// RegisterPartitioner makes the strategy available to topics created afterwards, replacing any
+// factory already registered for it. Strategies of your own should start from CustomPartition.
+func RegisterPartitioner(strategy PartitionStrategy, factory PartitionerFactory) {
+	partitionersMutex.Lock()
+	defer partitionersMutex.Unlock()
+
+	partitioners[strategy] = factory
+}
+
+func newPartitioner(topicDef TopicDefinition) (Partitioner, error) {
+	partitionersMutex.RLock()
+	factory, ok := partitioners[topicDef.PartitionStrategy]
+	partitionersMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unrecognised partition strategy %d", topicDef.PartitionStrategy)
+	}
+	if topicDef.PartitionStrategy != KeyRangePartition && len(topicDef.KeySplitPoints) != 0 {
+		return nil, fmt.Errorf("key split points are only used by the %s partition strategy", KeyRangePartition)
+	}
+	return factory(topicDef)
 }
 
 type PartitionStrategy int
 
 const (
+	// Messages are partitioned by the FNV-1a hash of their key.
 	HashPartition PartitionStrategy = iota
+	// Messages are spread over the partitions in turn.
 	RoundRobinPartition
+	// Each batch of messages without a key is published to a single partition, moving on to the
+	// next partition for the next batch. Messages with a key are partitioned as by HashPartition.
+	StickyPartition
+	// Messages are partitioned by which of the topic's ranges of keys their key is in.
+	KeyRangePartition
+	// Messages are partitioned by the murmur2 hash of their key, as by Kafka's default partitioner,
+	// so a key is published to the same partition number as in a Kafka topic.
+	Murmur2Partition
+	// Messages are partitioned by the jump consistent hash of their key, so adding partitions only
+	// moves the keys which the new partitions take, rather than nearly every key as with
+	// HashPartition.
+	ConsistentHashPartition
+
+	// The first of the strategies which can be registered with RegisterPartitioner, leaving those
+	// before it for the Broker's own.
+	CustomPartition PartitionStrategy = 64
 )
 
+func (s PartitionStrategy) String() string {
+	switch s {
+	case HashPartition:
+		return "hash"
+	case RoundRobinPartition:
+		return "round robin"
+	case StickyPartition:
+		return "sticky"
+	case KeyRangePartition:
+		return "key range"
+	case Murmur2Partition:
+		return "murmur2"
+	case ConsistentHashPartition:
+		return "consistent hash"
+	default:
+		return fmt.Sprintf("PartitionStrategy(%d)", int(s))
+	}
+}
+
+// Whether the strategy is chosen to publish each key to the same partition, and adding partitions
+// moves keys between the existing partitions. ConsistentHashPartition only moves keys to the new
+// partitions, the least it can, so the keys moved are logged rather than needing to be allowed.
+func (s PartitionStrategy) remapsKeys() bool {
+	return s != RoundRobinPartition && s != StickyPartition && s != ConsistentHashPartition
+}
+
 type hashPartitioner struct {
 	numberOfPartitions int
 }
@@ -38,10 +137,18 @@ func newHashPartitioner(numberOfPartitions int) *hashPartitioner {
 	}
 }
 
-func (p hashPartitioner) getPartitionIdx(message Message) int {
+func (p hashPartitioner) PartitionIdx(message Message) int {
+	return hashPartitionIdx(message.Key, p.numberOfPartitions)
+}
+
+func hashPartitionIdx(s string, numberOfPartitions int) int {
+	return int(fnv64a(s) % uint64(numberOfPartitions))
+}
+
+func fnv64a(s string) uint64 {
 	hash := fnv.New64a()
-	hash.Write([]byte(message.Key))
-	return int(hash.Sum64() % uint64(p.numberOfPartitions))
+	hash.Write([]byte(s))
+	return hash.Sum64()
 }
 
 type roundRobinPartitioner struct {
@@ -55,10 +162,174 @@ func newRoundRobinPartitioner(numberOfPartitions int) *roundRobinPartitioner {
 	}
 }
 
-func (p *roundRobinPartitioner) getPartitionIdx(message Message) int {
+func (p *roundRobinPartitioner) PartitionIdx(message Message) int {
+	// Chunks of the same payload must be stored on the same partition to be reassembled in order.
+	if chunkID, ok := message.Headers[headers.ChunkID]; ok {
+		return hashPartitionIdx(chunkID, p.numberOfPartitions)
+	}
+
 	p.Mutex.Lock()
 	defer p.Mutex.Unlock()
 
 	p.counter = (p.counter + 1) % p.numberOfPartitions
 	return p.counter
 }
+
+type stickyPartitioner struct {
+	sync.Mutex
+	// The partition the last batch's messages without a key were published to.
+	partitionIdx, numberOfPartitions int
+}
+
+func newStickyPartitioner(numberOfPartitions int) *stickyPartitioner {
+	return &stickyPartitioner{
+		numberOfPartitions: numberOfPartitions,
+	}
+}
+
+func (p *stickyPartitioner) StartBatch() Partitioner {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+
+	p.partitionIdx = (p.partitionIdx + 1) % p.numberOfPartitions
+	return stickyBatch{
+		partitionIdx:       p.partitionIdx,
+		numberOfPartitions: p.numberOfPartitions,
+	}
+}
+
+// Messages published outside a batch are partitioned as if they were in the last batch.
+func (p *stickyPartitioner) PartitionIdx(message Message) int {
+	p.Mutex.Lock()
+	batch := stickyBatch{
+		partitionIdx:       p.partitionIdx,
+		numberOfPartitions: p.numberOfPartitions,
+	}
+	p.Mutex.Unlock()
+
+	return batch.PartitionIdx(message)
+}
+
+// A stickyBatch partitions a batch's messages without a key to a single partition.
+type stickyBatch struct {
+	partitionIdx, numberOfPartitions int
+}
+
+func (b stickyBatch) PartitionIdx(message Message) int {
+	if message.Key != "" {
+		return hashPartitionIdx(message.Key, b.numberOfPartitions)
+	}
+	// Chunks of the same payload must be stored on the same partition, even if they're published
+	// in different batches.
+	if chunkID, ok := message.Headers[headers.ChunkID]; ok {
+		return hashPartitionIdx(chunkID, b.numberOfPartitions)
+	}
+	return b.partitionIdx
+}
+
+type keyRangePartitioner struct {
+	// The first key of each partition after the first, in increasing order.
+	splitPoints []string
+}
+
+func newKeyRangePartitioner(numberOfPartitions int, splitPoints []string) (*keyRangePartitioner, error) {
+	if len(splitPoints) != numberOfPartitions-1 {
+		return nil, fmt.Errorf("key range partitioning needs one fewer key split point than partitions, got %d split points for %d partitions", len(splitPoints), numberOfPartitions)
+	}
+	for i := 1; i < len(splitPoints); i++ {
+		if splitPoints[i] <= splitPoints[i-1] {
+			return nil, fmt.Errorf("key split points must be in increasing order, got %q after %q", splitPoints[i], splitPoints[i-1])
+		}
+	}
+	return &keyRangePartitioner{
+		splitPoints: slices.Clone(splitPoints),
+	}, nil
+}
+
+func (p keyRangePartitioner) PartitionIdx(message Message) int {
+	// The number of split points at or before the key is the index of its partition.
+	idx, found := slices.BinarySearch(p.splitPoints, message.Key)
+	if found {
+		idx++
+	}
+	return idx
+}
+
+type murmur2Partitioner struct {
+	numberOfPartitions int
+}
+
+func newMurmur2Partitioner(numberOfPartitions int) *murmur2Partitioner {
+	return &murmur2Partitioner{
+		numberOfPartitions: numberOfPartitions,
+	}
+}
+
+func (p murmur2Partitioner) PartitionIdx(message Message) int {
+	// As Kafka's partitioner, which makes the hash positive by masking off the sign bit.
+	return int(murmur2([]byte(message.Key))&0x7fffffff) % p.numberOfPartitions
+}
+
+// The 32-bit murmur2 hash of the data, as implemented by Kafka.
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+type jumpHashPartitioner struct {
+	numberOfPartitions int
+}
+
+func newJumpHashPartitioner(numberOfPartitions int) *jumpHashPartitioner {
+	return &jumpHashPartitioner{
+		numberOfPartitions: numberOfPartitions,
+	}
+}
+
+func (p jumpHashPartitioner) PartitionIdx(message Message) int {
+	return jumpHash(fnv64a(message.Key), p.numberOfPartitions)
+}
+
+// Lamping and Veach's jump consistent hash of the key, in the range [0, numberOfBuckets). Going
+// from n to n+1 buckets only moves a 1/(n+1) fraction of keys, all to the new bucket.
+func jumpHash(key uint64, numberOfBuckets int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(numberOfBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,133 @@
+package svc
+
+import (
+	"fmt"
+	"testing"
+)
+
+// The murmur2 hash matches Kafka's, from the test vectors of its Utils.murmur2, so keys are
+// published to the same partition numbers as in Kafka.
+func TestMurmur2(t *testing.T) {
+	p := newMurmur2Partitioner(7)
+	for key, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"abc":                        479470107,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+	} {
+		if got := int32(murmur2([]byte(key))); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+
+		// Kafka makes the hash positive by masking off the sign bit, rather than with its absolute
+		// value.
+		if got, want := p.PartitionIdx(Message{Key: key}), int(want&0x7fffffff)%7; got != want {
+			t.Errorf("key %q: got partition %d, want %d", key, got, want)
+		}
+	}
+}
+
+// Going from n to n+1 partitions only moves about 1/(n+1) of keys with consistent hashing, all to
+// the new partition.
+func TestConsistentHashRemap(t *testing.T) {
+	const keys = 100000
+	for _, n := range []int{1, 2, 3, 8, 16, 100} {
+		before, after := newJumpHashPartitioner(n), newJumpHashPartitioner(n+1)
+		moved := 0
+		for i := range keys {
+			message := Message{Key: fmt.Sprintf("key-%d", i)}
+			from, to := before.PartitionIdx(message), after.PartitionIdx(message)
+			if from == to {
+				continue
+			}
+			if to != n {
+				t.Fatalf("%d to %d partitions: key %s moved from partition %d to %d, rather than the new partition", n, n+1, message.Key, from, to)
+			}
+			moved++
+		}
+		if fraction, want := float64(moved)/keys, 1/float64(n+1); fraction < 0.9*want || fraction > 1.1*want {
+			t.Errorf("%d to %d partitions: moved %.4f of keys, want about %.4f", n, n+1, fraction, want)
+		}
+	}
+}
+
+// Keys at a split point start its partition, and those before the first split point are in the
+// first partition.
+func TestKeyRangePartitioner(t *testing.T) {
+	p, err := newPartitioner(TopicDefinition{NumberOfPartitions: 3, PartitionStrategy: KeyRangePartition, KeySplitPoints: []string{"g", "n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]int{
+		"":   0,
+		"a":  0,
+		"fz": 0,
+		"g":  1,
+		"g0": 1,
+		"mz": 1,
+		"n":  2,
+		"z":  2,
+		"~":  2,
+	} {
+		if got := p.PartitionIdx(Message{Key: key}); got != want {
+			t.Errorf("key %q: got partition %d, want %d", key, got, want)
+		}
+	}
+
+	for _, topicDef := range []TopicDefinition{
+		{NumberOfPartitions: 3, PartitionStrategy: KeyRangePartition, KeySplitPoints: []string{"g"}},
+		{NumberOfPartitions: 2, PartitionStrategy: KeyRangePartition, KeySplitPoints: []string{"g", "n"}},
+		{NumberOfPartitions: 3, PartitionStrategy: KeyRangePartition, KeySplitPoints: []string{"n", "g"}},
+		{NumberOfPartitions: 3, PartitionStrategy: KeyRangePartition, KeySplitPoints: []string{"g", "g"}},
+		{NumberOfPartitions: 2, PartitionStrategy: HashPartition, KeySplitPoints: []string{"g"}},
+	} {
+		if _, err := newPartitioner(topicDef); err == nil {
+			t.Errorf("created a %s partitioner for %d partitions with split points %q", topicDef.PartitionStrategy, topicDef.NumberOfPartitions, topicDef.KeySplitPoints)
+		}
+	}
+}
+
+type lastPartitioner struct {
+	numberOfPartitions int
+}
+
+func (p lastPartitioner) PartitionIdx(message Message) int {
+	return p.numberOfPartitions - 1
+}
+
+// Registered strategies are available to topics, and partition them from the topic's current
+// definition as partitions are added.
+func TestRegisterPartitioner(t *testing.T) {
+	strategy := CustomPartition
+	RegisterPartitioner(strategy, func(topicDef TopicDefinition) (Partitioner, error) {
+		return lastPartitioner{numberOfPartitions: topicDef.NumberOfPartitions}, nil
+	})
+	t.Cleanup(func() {
+		partitionersMutex.Lock()
+		defer partitionersMutex.Unlock()
+		delete(partitioners, strategy)
+	})
+
+	topicDef := TopicDefinition{Name: "t", NumberOfPartitions: 2, PartitionStrategy: strategy, AllowKeyRemapping: true}
+	b := mustNewBroker(t, topicDef)
+	topicDef.NumberOfPartitions = 3
+	if err := b.Publish("t", Message{Key: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.UpdateTopic(topicDef); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("t", Message{Key: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriberID, err := b.Subscribe("t", "g", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts := countByPartition(mustPoll(t, b, subscriberID, 10)); len(counts) != 2 || counts[1] != 1 || counts[2] != 1 {
+		t.Errorf("polled %v messages by partition, want one from each topic definition's last partition", counts)
+	}
+}
@@ -0,0 +1,64 @@
+package svc
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// How many shards the subscription registry is split into.
+const subscriptionShards = 64
+
+// A subscriptionRegistry holds the subscriptions by subscriber ID. It's sharded by ID, so that
+// polls and acknowledgements of different subscribers don't contend on a single lock.
+type subscriptionRegistry struct {
+	seed   maphash.Seed
+	shards [subscriptionShards]subscriptionShard
+}
+
+type subscriptionShard struct {
+	mutex sync.RWMutex
+	byID  map[string]*subscription
+}
+
+func newSubscriptionRegistry() *subscriptionRegistry {
+	r := &subscriptionRegistry{
+		seed: maphash.MakeSeed(),
+	}
+	for i := range r.shards {
+		r.shards[i].byID = map[string]*subscription{}
+	}
+	return r
+}
+
+func (r *subscriptionRegistry) shard(subscriberID string) *subscriptionShard {
+	return &r.shards[maphash.String(r.seed, subscriberID)%subscriptionShards]
+}
+
+func (r *subscriptionRegistry) get(subscriberID string) (*subscription, bool) {
+	shard := r.shard(subscriberID)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	s, ok := shard.byID[subscriberID]
+	return s, ok
+}
+
+func (r *subscriptionRegistry) add(subscriberID string, s *subscription) {
+	shard := r.shard(subscriberID)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	shard.byID[subscriberID] = s
+}
+
+// Call f with each subscription, holding the lock of its shard.
+func (r *subscriptionRegistry) forEach(f func(subscriberID string, s *subscription)) {
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mutex.RLock()
+		for subscriberID, s := range shard.byID {
+			f(subscriberID, s)
+		}
+		shard.mutex.RUnlock()
+	}
+}
@@ -0,0 +1,58 @@
+package svc
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	uuid "github.com/satori/go.uuid"
+
+	commonerrors "pubsub/common/errors"
+	"pubsub/common/headers"
+)
+
+const replyTopicPrefix = internalTopicPrefix + "replies."
+
+// Request publishes the message to the topic, with the name of a temporary reply topic and a
+// correlation ID in its headers, then waits for a reply to be published to the reply topic until
+// ctx is done. The reply topic is deleted once the request completes.
+func (b *Broker) Request(ctx context.Context, topicName string, message Message) (Message, error) {
+	correlationID := uuid.NewV4().String()
+	replyTopicName := replyTopicPrefix + correlationID
+	replyTopic, err := b.createTopic(TopicDefinition{
+		Name:               replyTopicName,
+		NumberOfPartitions: 1,
+	})
+	if err != nil {
+		return Message{}, fmt.Errorf("creating reply topic: %w", err)
+	}
+	defer b.deleteTopic(replyTopicName)
+
+	requestHeaders := maps.Clone(message.Headers)
+	if requestHeaders == nil {
+		requestHeaders = make(map[string]string, 2)
+	}
+	requestHeaders[headers.ReplyTo] = replyTopicName
+	requestHeaders[headers.CorrelationID] = correlationID
+	message.Headers = requestHeaders
+	if err := b.Publish(topicName, message); err != nil {
+		return Message{}, err
+	}
+
+	isReply := func(reply Message) bool {
+		return reply.Headers[headers.CorrelationID] == correlationID
+	}
+	for {
+		// Start waiting before looking for the reply, so one published in between isn't missed.
+		published := replyTopic.awaitPublish()
+		if reply, ok := replyTopic.find(isReply); ok {
+			return reply, nil
+		}
+
+		select {
+		case <-published:
+		case <-ctx.Done():
+			return Message{}, commonerrors.NewDeadlineExceeded(fmt.Sprintf("no reply received to request %q: %s", correlationID, ctx.Err()))
+		}
+	}
+}
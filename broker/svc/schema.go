@@ -0,0 +1,100 @@
+package svc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"pubsub/broker/schema"
+	"pubsub/common/compression"
+	commonerrors "pubsub/common/errors"
+	"pubsub/common/headers"
+)
+
+// RegisterSchema registers the definition as the subject's next version, returning its version
+// number. It must be compatible with the previous version according to the compatibility mode,
+// or the subject's existing mode if it's unspecified.
+func (b *Broker) RegisterSchema(subject string, def schema.Definition, compatibility schema.Compatibility) (int, error) {
+	return b.schemas.Register(subject, def, compatibility)
+}
+
+// GetSchema returns the version of the subject's schema, or its latest version if version is
+// zero, with the subject's compatibility mode.
+func (b *Broker) GetSchema(subject string, version int) (schema.Version, schema.Compatibility, error) {
+	return b.schemas.Get(subject, version)
+}
+
+// Validate the payloads of the messages against the version of the subject's schema given by
+// their SchemaVersion header, or any version if they have none. Compressed payloads are decompressed
+// first, up to the max decompressed size. Chunks of a payload can't be validated on their own, so
+// are rejected.
+func (b *Broker) validatePayloads(subject string, messages []Message) error {
+	violations := []commonerrors.FieldViolation{}
+	for i, message := range messages {
+		if _, ok := message.Headers[headers.ChunkID]; ok {
+			violations = append(violations, commonerrors.FieldViolation{
+				Field:       fmt.Sprintf("messages[%d].headers[%q]", i, headers.ChunkID),
+				Reason:      "CHUNKED_PAYLOAD",
+				Description: "Payloads of topics with a schema can't be chunked, as chunks can't be validated on their own",
+			})
+			continue
+		}
+		schemaVersion := 0
+		if value, ok := message.Headers[headers.SchemaVersion]; ok {
+			var err error
+			if schemaVersion, err = strconv.Atoi(value); err != nil || schemaVersion < 1 {
+				violations = append(violations, commonerrors.FieldViolation{
+					Field:       fmt.Sprintf("messages[%d].headers[%q]", i, headers.SchemaVersion),
+					Reason:      "INVALID_SCHEMA_VERSION",
+					Description: "Must be a version number, from 1",
+				})
+				continue
+			}
+		}
+		field := fmt.Sprintf("messages[%d].payload", i)
+
+		payload := message.Payload
+		if message.Compression != "" {
+			maxSize := b.opts.MaxDecompressedSize
+			if maxSize == 0 {
+				maxSize = math.MaxInt
+			}
+			var err error
+			if payload, err = compression.Decompress(message.Compression, payload, maxSize); errors.Is(err, compression.ErrUnknownCodec) {
+				return fmt.Errorf("validating payload: %w", err)
+			} else if errors.Is(err, compression.ErrTooLarge) {
+				violations = append(violations, commonerrors.FieldViolation{
+					Field:       field,
+					Reason:      "ABOVE_MAX_SIZE",
+					Description: fmt.Sprintf("Maximum size %d bytes when decompressed", maxSize),
+				})
+				continue
+			} else if err != nil {
+				violations = append(violations, commonerrors.FieldViolation{
+					Field:       field,
+					Reason:      "INVALID_COMPRESSED_PAYLOAD",
+					Description: err.Error(),
+				})
+				continue
+			}
+		}
+
+		version, payloadViolations, err := b.schemas.Validate(subject, schemaVersion, payload)
+		if err != nil {
+			return fmt.Errorf("validating payload: %w", err)
+		}
+		for _, violation := range payloadViolations {
+			violations = append(violations, commonerrors.FieldViolation{
+				Field:       violation.Field(field),
+				Reason:      "SCHEMA_VIOLATION",
+				Description: fmt.Sprintf("%s (schema %q version %d)", violation.Description, subject, version),
+			})
+		}
+	}
+
+	if len(violations) != 0 {
+		return commonerrors.NewInvalidArgument("invalid publish request", violations...)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package svc
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"pubsub/broker/schema"
+	"pubsub/common/compression"
+	commonerrors "pubsub/common/errors"
+	"pubsub/common/headers"
+)
+
+// Whether the error is an invalid argument with a violation for the reason.
+func hasFieldViolation(err error, reason string) bool {
+	invalidArgument := commonerrors.InvalidArgument{}
+	if !errors.As(err, &invalidArgument) {
+		return false
+	}
+	return slices.ContainsFunc(invalidArgument.FieldViolations, func(violation commonerrors.FieldViolation) bool {
+		return violation.Reason == reason
+	})
+}
+
+// Payloads are validated against the version in their header, or any version without one, and
+// chunks are rejected as they can't be validated on their own.
+func TestPublishSchemaVersions(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 1, SchemaSubject: "s"})
+	for _, definition := range []string{
+		`{"type": "record", "name": "r", "fields": [{"name": "name", "type": "string"}]}`,
+		// Backward compatible, as v1 payloads can be read with the age's default, but they aren't
+		// valid v2 payloads.
+		`{"type": "record", "name": "r", "fields": [{"name": "name", "type": "string"}, {"name": "age", "type": "int", "default": 0}]}`,
+	} {
+		if _, err := b.RegisterSchema("s", schema.Definition{Type: schema.AvroSchema, Definition: []byte(definition)}, schema.BackwardCompatibility); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v1 := []byte{2, 'a'}
+	v2 := []byte{2, 'a', 2}
+	tests := []struct {
+		name    string
+		message Message
+		// The reason the publish is rejected for, if it is.
+		wantReason string
+	}{
+		{
+			name:    "v1 payload without a version",
+			message: Message{Payload: v1},
+		},
+		{
+			name:    "v2 payload without a version",
+			message: Message{Payload: v2},
+		},
+		{
+			name:       "invalid against every version",
+			message:    Message{Payload: []byte{1}},
+			wantReason: "SCHEMA_VIOLATION",
+		},
+		{
+			name:    "v2 payload with v2",
+			message: Message{Payload: v2, Headers: map[string]string{headers.SchemaVersion: "2"}},
+		},
+		{
+			name:       "v2 payload with v1",
+			message:    Message{Payload: v2, Headers: map[string]string{headers.SchemaVersion: "1"}},
+			wantReason: "SCHEMA_VIOLATION",
+		},
+		{
+			name:       "invalid version",
+			message:    Message{Payload: v1, Headers: map[string]string{headers.SchemaVersion: "0"}},
+			wantReason: "INVALID_SCHEMA_VERSION",
+		},
+		{
+			name:       "chunk",
+			message:    chunk("", "c", 0, 2),
+			wantReason: "CHUNKED_PAYLOAD",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := b.Publish("t", test.message)
+			if test.wantReason == "" && err != nil {
+				t.Errorf("got %v, want published", err)
+			}
+			if test.wantReason != "" && !hasFieldViolation(err, test.wantReason) {
+				t.Errorf("got %v, want %s violation", err, test.wantReason)
+			}
+		})
+	}
+
+	// A version which isn't registered can't be validated against.
+	err := b.Publish("t", Message{Payload: v1, Headers: map[string]string{headers.SchemaVersion: "3"}})
+	if !hasPreconditionFailure(err, "SCHEMA_NOT_FOUND") {
+		t.Errorf("publishing with an unregistered version got %v, want SCHEMA_NOT_FOUND", err)
+	}
+}
+
+// Compressed payloads are rejected if they decompress to more than the max decompressed size.
+func TestPublishSchemaMaxDecompressedSize(t *testing.T) {
+	b, err := NewBroker(Options{MaxDecompressedSize: 100}, TopicDefinition{Name: "t", NumberOfPartitions: 1, SchemaSubject: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.RegisterSchema("s", schema.Definition{Type: schema.JSONSchema, Definition: []byte(`{"type": "string"}`)}, schema.UnspecifiedCompatibility); err != nil {
+		t.Fatal(err)
+	}
+	codec, _ := compression.Lookup(compression.Gzip)
+	compress := func(payload string) []byte {
+		compressed, err := codec.Compress([]byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return compressed
+	}
+
+	if err := b.Publish("t", Message{Payload: compress(`"` + strings.Repeat("a", 98) + `"`), Compression: compression.Gzip}); err != nil {
+		t.Errorf("publishing a payload within the max decompressed size: %v", err)
+	}
+	if err := b.Publish("t", Message{Payload: compress(`"` + strings.Repeat("a", 99) + `"`), Compression: compression.Gzip}); !hasFieldViolation(err, "ABOVE_MAX_SIZE") {
+		t.Errorf("publishing a payload beyond the max decompressed size got %v, want a violation", err)
+	}
+}
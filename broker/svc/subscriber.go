@@ -0,0 +1,490 @@
+package svc
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"pubsub/broker/filter"
+	commonerrors "pubsub/common/errors"
+)
+
+const (
+	defaultAckTimeout     = 30 * time.Second
+	defaultSessionTimeout = 30 * time.Second
+)
+
+type SubscriptionOptions struct {
+	// Only messages matching the filter are returned when polling. Every subscriber of a group whose
+	// subscribers share partitions must use the same filter.
+	Filter filter.Filter
+	// Whether the topic's retained messages are returned by the first polls, regardless of the
+	// group's offsets, unless the group is still to be delivered them from their
+	// partitions.
+	ReceiveRetained bool
+	// How the group's messages are dispatched between its subscribers. Every subscriber of a group
+	// must use the same type.
+	Type SubscriptionType
+	// How long messages delivered to a subscriber of a group with tracked deliveries can go
+	// unacknowledged before they're redelivered. Defaults to 30 seconds.
+	AckTimeout time.Duration
+	// How long a subscriber of the group can go without polling, acknowledging or sending a
+	// heartbeat before it's no longer considered live. Defaults to 30 seconds.
+	SessionTimeout time.Duration
+	// Names of the codecs the subscriber can decompress payloads with. Payloads compressed with
+	// any other codec are decompressed by the Broker when they're polled.
+	AcceptCompressions []string
+	// ID of the subscribing client, which the ACL of each topic joined must allow to subscribe.
+	// Topics matching a pattern whose ACL doesn't are skipped.
+	ClientID string
+}
+
+type subscriber struct {
+	group         string
+	partitionIdxs []int
+	filter        filter.Filter
+	// When the subscriber last polled, acknowledged messages or sent a heartbeat.
+	lastSeen time.Time
+	// Retained messages still to be acknowledged by the subscriber.
+	retained []retainedMessage
+	// How many retained messages the subscriber's last poll returned.
+	lastPollRetained int
+	// What the subscriber's last poll returned from each partition.
+	lastPoll []polledRange
+	// Holds the offsets of lastPoll's ranges. It's reused by the next poll, which discards them.
+	offsets []int
+	// Index into partitionIdxs of the partition the next poll starts from, so that each poll starts
+	// where the last left off.
+	nextPartition int
+}
+
+// A group of subscribers which share the topic's messages between them, each message being
+// acknowledged once for the whole group.
+type group struct {
+	subscriptionType SubscriptionType
+	// The filter expression of every subscriber, for groups whose subscribers share partitions. The
+	// messages a filter skips are moved past for the whole group, so a subscriber with another
+	// filter would lose the messages it matches.
+	filter         string
+	ackTimeout     time.Duration
+	sessionTimeout time.Duration
+	// IDs of the group's subscribers, in the order they joined.
+	members []string
+}
+
+// Check the subscriber could join the group, without joining it.
+func (t *topic) checkSubscribe(groupName string, opts SubscriptionOptions) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.checkGroup(groupName, opts)
+}
+
+// Check the options are compatible with the group's, if it exists. The mutex must be held.
+func (t *topic) checkGroup(groupName string, opts SubscriptionOptions) error {
+	g, ok := t.groupsByName[groupName]
+	if !ok {
+		return nil
+	}
+	if g.subscriptionType != opts.Type {
+		return commonerrors.NewFailedPrecondition("invalid subscribe request", commonerrors.PreconditionFailure{
+			Type:        errSubscriptionTypeMismatch,
+			Description: fmt.Sprintf("Group %q of topic %q has subscription type %d, not %d.", groupName, t.name, g.subscriptionType, opts.Type),
+		})
+	}
+	if g.subscriptionType.tracksDeliveries() && g.filter != opts.Filter.String() {
+		return commonerrors.NewFailedPrecondition("invalid subscribe request", commonerrors.PreconditionFailure{
+			Type:        errFilterMismatch,
+			Description: fmt.Sprintf("Group %q of topic %q shares partitions between subscribers with filter %q, not %q.", groupName, t.name, g.filter, opts.Filter.String()),
+		})
+	}
+	if g.subscriptionType == ExclusiveSubscription && len(t.liveMembers(g, time.Now().UTC())) != 0 {
+		return commonerrors.NewFailedPrecondition("invalid subscribe request", commonerrors.PreconditionFailure{
+			Type:        errExclusiveSubscriberExists,
+			Description: fmt.Sprintf("Group %q of topic %q already has a live exclusive subscriber.", groupName, t.name),
+		})
+	}
+	return nil
+}
+
+func (t *topic) subscribe(subscriberID, groupName string, opts SubscriptionOptions) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if err := t.checkGroup(groupName, opts); err != nil {
+		return err
+	}
+	g, ok := t.groupsByName[groupName]
+	if !ok {
+		ackTimeout := opts.AckTimeout
+		if ackTimeout == 0 {
+			ackTimeout = defaultAckTimeout
+		}
+		sessionTimeout := opts.SessionTimeout
+		if sessionTimeout == 0 {
+			sessionTimeout = defaultSessionTimeout
+		}
+		g = &group{
+			subscriptionType: opts.Type,
+			ackTimeout:       ackTimeout,
+			sessionTimeout:   sessionTimeout,
+		}
+		if g.subscriptionType.tracksDeliveries() {
+			g.filter = opts.Filter.String()
+		}
+		t.groupsByName[groupName] = g
+	}
+
+	if g.subscriptionType == PartitionedSubscription || g.subscriptionType == ExclusiveSubscription {
+		// Naive (dumb) assignment of partitions: reassign all of the group's partitions to the new
+		// subscriber. Any existing exclusive subscriber has lost its session, as checked above.
+		for _, id := range slices.Clone(g.members) {
+			t.evict(g, id)
+		}
+	}
+	partitions := make([]int, 0, len(t.partitions))
+	for i := range len(t.partitions) {
+		partitions = append(partitions, i)
+	}
+	var retained []retainedMessage
+	if opts.ReceiveRetained {
+		retained = t.retainedMessages()
+	}
+	t.subscribersByID[subscriberID] = subscriber{
+		group:         groupName,
+		partitionIdxs: partitions,
+		filter:        opts.Filter,
+		lastSeen:      time.Now().UTC(),
+		retained:      retained,
+	}
+	g.members = append(g.members, subscriberID)
+	return nil
+}
+
+// Remove the subscriber from the group, so it must subscribe again to rejoin. The mutex must be
+// held.
+func (t *topic) evict(g *group, subscriberID string) {
+	delete(t.subscribersByID, subscriberID)
+	g.members = slices.DeleteFunc(g.members, func(id string) bool { return id == subscriberID })
+}
+
+func (t *topic) hasSubscriber(subscriberID string) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	_, ok := t.subscribersByID[subscriberID]
+	return ok
+}
+
+// The IDs of the group's subscribers seen within the session timeout, sorted.
+func (t *topic) liveMembers(g *group, now time.Time) []string {
+	var members []string
+	for _, id := range g.members {
+		if now.Sub(t.subscribersByID[id].lastSeen) <= g.sessionTimeout {
+			members = append(members, id)
+		}
+	}
+	slices.Sort(members)
+	return members
+}
+
+// The subscriber which is delivered the group's messages, which for a failover group is the
+// earliest to join of those still live, and otherwise every subscriber. Members of a failover group
+// which joined before the active one have lost their session, so are evicted and must subscribe
+// again to rejoin as standbys. The mutex must be held.
+func (t *topic) isActive(g *group, subscriberID string, now time.Time) bool {
+	if g.subscriptionType != FailoverSubscription {
+		return true
+	}
+	for len(g.members) != 0 {
+		id := g.members[0]
+		if now.Sub(t.subscribersByID[id].lastSeen) <= g.sessionTimeout {
+			return id == subscriberID
+		}
+		t.evict(g, id)
+	}
+	return false
+}
+
+// Record that the subscriber is still live, returning whether it's active.
+func (t *topic) heartbeat(subscriberID string) (bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	subscriber, ok := t.subscribersByID[subscriberID]
+	if !ok {
+		return false, commonerrors.NewFailedPrecondition("invalid heartbeat request", commonerrors.PreconditionFailure{
+			Type:        errSubscriberNotFound,
+			Description: fmt.Sprintf("Subscriber %q is not a registered subscriber of the broker.", subscriberID),
+		})
+	}
+	now := time.Now().UTC()
+	subscriber.lastSeen = now
+	t.subscribersByID[subscriberID] = subscriber
+
+	return t.isActive(t.groupsByName[subscriber.group], subscriberID, now), nil
+}
+
+// Poll the subscriber's messages within the budget, appending them to polledMessages. Returns how
+// many of the messages appended are retained messages, which are appended first.
+//
+// The mutex is only held to read the subscriber's state and to save it afterwards: the partitions
+// are polled under their own locks, so the topic's subscribers poll it in parallel with each other
+// and with publishes. The subscriber's own state is only changed by the subscription polling it.
+func (t *topic) poll(subscriberID string, budget *pollBudget, polledMessages []Message) ([]Message, int, error) {
+	t.mutex.Lock()
+	subscriber, ok := t.subscribersByID[subscriberID]
+	if !ok {
+		t.mutex.Unlock()
+		return nil, 0, commonerrors.NewFailedPrecondition("invalid polling request", commonerrors.PreconditionFailure{
+			Type:        errSubscriberNotFound,
+			Description: fmt.Sprintf("Subscriber %q is not a registered subscriber of the broker.", subscriberID),
+		})
+	}
+	g := t.groupsByName[subscriber.group]
+
+	now := time.Now().UTC()
+	subscriber.lastSeen = now
+	subscriber.lastPollRetained = 0
+	subscriber.lastPoll = subscriber.lastPoll[:0]
+	subscriber.offsets = subscriber.offsets[:0]
+	t.subscribersByID[subscriberID] = subscriber
+	if !t.isActive(g, subscriberID, now) {
+		t.mutex.Unlock()
+		// Standbys are delivered nothing until the active subscriber loses its session.
+		return polledMessages, 0, nil
+	}
+	deliverable := g.subscriptionType.dispatchRule(subscriberID, t.liveMembers(g, now))
+	tracksDeliveries, ackTimeout := g.subscriptionType.tracksDeliveries(), g.ackTimeout
+	// Partitions are only ever added, so those polled stay the same once the mutex is released.
+	partitions := t.partitions
+	priorities := t.priorities.Load()
+	t.mutex.Unlock()
+
+	skip := func(message Message) bool {
+		if message.compacted {
+			return true
+		}
+		if message.expired(now) {
+			t.metrics.expiredSkipped.Add(1)
+			return true
+		}
+		return !subscriber.filter.Match(message.Key, message.Headers)
+	}
+	request := partitionPoll{
+		topic:        t.name,
+		group:        subscriber.group,
+		subscriberID: subscriberID,
+		skip:         skip,
+		deliverable:  deliverable,
+		budget:       budget,
+		now:          now,
+	}
+	if tracksDeliveries {
+		request.deadline = now.Add(ackTimeout)
+	}
+
+	// Retained messages are returned first, regardless of the group's offsets, unless the group is
+	// still to be delivered them from their partitions.
+	subscriber.retained = slices.DeleteFunc(subscriber.retained, func(r retainedMessage) bool {
+		return skip(r.message) || partitions[r.partitionIdx].pending(subscriber.group, r.offset)
+	})
+	for _, r := range subscriber.retained {
+		message := r.message
+		if budget.messages == 0 {
+			break
+		}
+		if _, ok := budget.take(message, math.MaxInt); !ok {
+			break
+		}
+		polledMessages = append(polledMessages, message)
+		subscriber.lastPollRetained++
+	}
+
+	// Each partition is scanned once for the messages it could deliver, by priority. Then higher
+	// priority messages are polled first from every partition, before moving on to lower
+	// priorities. Each priority's messages are shared fairly between the partitions, so one with a
+	// backlog can't starve the others: they're polled in rounds, each sharing what's left of the
+	// budget's messages between the partitions which may have more, starting after the partition
+	// the last poll ended with.
+	numberOfPartitions := len(subscriber.partitionIdxs)
+	scans := make([]*partitionScan, numberOfPartitions)
+	for j, partitionIdx := range subscriber.partitionIdxs {
+		scans[j] = &partitionScan{}
+		if !budget.spent() {
+			scans[j] = partitions[partitionIdx].scan(request, priorities, budget.messages)
+		}
+	}
+	lastPolled := subscriber.nextPartition - 1
+	// Whether each partition has no more messages of the priority, or has reached its byte limit.
+	exhausted := make([]bool, numberOfPartitions)
+	// How many bytes of messages each partition has returned, across every priority.
+	partitionBytes := make([]int, numberOfPartitions)
+	for priority := MaxPriority; priority >= 0; priority-- {
+		request.priority = priority
+
+		remaining := 0
+		for j, scan := range scans {
+			exhausted[j] = len(scan.byPriority[priority]) == 0
+			if !exhausted[j] {
+				remaining++
+			}
+		}
+		for remaining > 0 && !budget.spent() {
+			share := max(budget.messages/remaining, 1)
+			remaining = 0
+			for i := range numberOfPartitions {
+				if budget.spent() {
+					break
+				}
+				j := (subscriber.nextPartition + i) % numberOfPartitions
+				if exhausted[j] {
+					continue
+				}
+
+				request.partitionIdx = subscriber.partitionIdxs[j]
+				request.limit = min(share, budget.messages)
+				request.maxBytes = budget.partitionMaxBytes - partitionBytes[j]
+				var offsets []int
+				var bytes int
+				polledMessages, offsets, bytes = pollPartition(&subscriber, partitions[request.partitionIdx], scans[j], request, polledMessages)
+				partitionBytes[j] += bytes
+				if len(offsets) != 0 {
+					lastPolled = j
+				}
+				if len(offsets) < request.limit {
+					exhausted[j] = true
+					continue
+				}
+				remaining++
+			}
+		}
+	}
+	subscriber.nextPartition = (lastPolled + 1) % max(numberOfPartitions, 1)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Unless the subscriber has been evicted meanwhile, in which case the messages polled are left to
+	// be delivered again.
+	if saved, ok := t.subscribersByID[subscriberID]; ok {
+		saved.retained = subscriber.retained
+		saved.lastPollRetained = subscriber.lastPollRetained
+		saved.lastPoll = subscriber.lastPoll
+		saved.offsets = subscriber.offsets
+		saved.nextPartition = subscriber.nextPartition
+		t.subscribersByID[subscriberID] = saved
+	}
+	return polledMessages, subscriber.lastPollRetained, nil
+}
+
+// Poll the partition for the subscriber, appending its messages to polledMessages and recording them
+// as returned by the subscriber's last poll. Returns their offsets, and how many bytes they are.
+func pollPartition(subscriber *subscriber, p *partition, scan *partitionScan, request partitionPoll, polledMessages []Message) ([]Message, []int, int) {
+	offsetsBefore := len(subscriber.offsets)
+	var bytes int
+	polledMessages, subscriber.offsets, bytes = p.poll(request, scan, polledMessages, subscriber.offsets)
+	offsets := subscriber.offsets[offsetsBefore:]
+	if len(offsets) == 0 {
+		return polledMessages, nil, 0
+	}
+
+	subscriber.lastPoll = append(subscriber.lastPoll, polledRange{
+		partitionIdx: request.partitionIdx,
+		offsets:      offsets,
+	})
+	return polledMessages, offsets, bytes
+}
+
+// Move the subscriber's offsets by the given delta. The given delta can exceed the messages
+// available, so the remainder is returned.
+func (t *topic) moveOffset(subscriberID string, delta int) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	subscriber, ok := t.subscribersByID[subscriberID]
+	if !ok {
+		return 0, commonerrors.NewFailedPrecondition("invalid polling request", commonerrors.PreconditionFailure{
+			Type:        errSubscriberNotFound,
+			Description: fmt.Sprintf("Subscriber %q is not a registered subscriber of the broker.", subscriberID),
+		})
+	}
+	now := time.Now().UTC()
+	subscriber.lastSeen = now
+	t.subscribersByID[subscriberID] = subscriber
+	g := t.groupsByName[subscriber.group]
+	if !t.isActive(g, subscriberID, now) {
+		return 0, t.errNotActive(subscriberID)
+	}
+
+	// Acknowledge the messages returned by the last poll first, starting with any retained
+	// messages.
+	acknowledgedRetained := min(delta, subscriber.lastPollRetained)
+	subscriber.retained = subscriber.retained[acknowledgedRetained:]
+	subscriber.lastPollRetained = 0
+	remainingDelta := delta - acknowledgedRetained
+	for _, polled := range subscriber.lastPoll {
+		if remainingDelta == 0 {
+			break
+		}
+		acknowledged := min(remainingDelta, len(polled.offsets))
+		t.partitions[polled.partitionIdx].acknowledge(subscriber.group, polled.offsets[:acknowledged]...)
+		remainingDelta -= acknowledged
+	}
+	subscriber.lastPoll = nil
+	t.subscribersByID[subscriberID] = subscriber
+
+	if g.subscriptionType.tracksDeliveries() {
+		// Moving offsets past messages which weren't delivered would take them from the rest of the
+		// group.
+		return remainingDelta, nil
+	}
+
+	// Any delta beyond that moves the offsets through the partitions in order.
+	for _, partitionIdx := range subscriber.partitionIdxs {
+		if remainingDelta == 0 {
+			break
+		}
+		remainingDelta = t.partitions[partitionIdx].moveOffset(subscriber.group, remainingDelta)
+	}
+	return remainingDelta, nil
+}
+
+// Acknowledge the messages, which must be from the topic.
+func (t *topic) acknowledge(subscriberID string, messageIDs ...MessageID) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	subscriber, ok := t.subscribersByID[subscriberID]
+	if !ok {
+		return commonerrors.NewFailedPrecondition("invalid acknowledge request", commonerrors.PreconditionFailure{
+			Type:        errSubscriberNotFound,
+			Description: fmt.Sprintf("Subscriber %q is not a registered subscriber of the broker.", subscriberID),
+		})
+	}
+	now := time.Now().UTC()
+	subscriber.lastSeen = now
+	t.subscribersByID[subscriberID] = subscriber
+	if !t.isActive(t.groupsByName[subscriber.group], subscriberID, now) {
+		return t.errNotActive(subscriberID)
+	}
+
+	for _, messageID := range messageIDs {
+		if !slices.Contains(subscriber.partitionIdxs, messageID.Partition) {
+			return commonerrors.NewFailedPrecondition("invalid acknowledge request", commonerrors.PreconditionFailure{
+				Type:        errPartitionNotAssigned,
+				Description: fmt.Sprintf("Partition %d of topic %q is not assigned to subscriber %q.", messageID.Partition, t.name, subscriberID),
+			})
+		}
+		t.partitions[messageID.Partition].acknowledge(subscriber.group, messageID.Offset)
+	}
+	return nil
+}
+
+func (t *topic) errNotActive(subscriberID string) error {
+	return commonerrors.NewFailedPrecondition("invalid request", commonerrors.PreconditionFailure{
+		Type:        errSubscriberNotActive,
+		Description: fmt.Sprintf("Subscriber %q is a standby of its failover group of topic %q.", subscriberID, t.name),
+	})
+}
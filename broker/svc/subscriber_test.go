@@ -0,0 +1,337 @@
+package svc
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"pubsub/broker/filter"
+)
+
+func mustParseFilter(t *testing.T, expression string) filter.Filter {
+	t.Helper()
+	f, err := filter.Parse(expression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// Subscribers sharing a group's partitions must use the same filter, as the messages it skips are
+// moved past for the whole group.
+func TestSubscribeFilterMismatch(t *testing.T) {
+	eu, us := mustParseFilter(t, `headers.region == "eu"`), mustParseFilter(t, `headers.region == "us"`)
+	for _, subscriptionType := range []SubscriptionType{SharedSubscription, KeySharedSubscription, KeyOrderedSubscription} {
+		b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 1})
+		if _, err := b.Subscribe("t", "g", SubscriptionOptions{Type: subscriptionType, Filter: eu}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Subscribe("t", "g", SubscriptionOptions{Type: subscriptionType, Filter: mustParseFilter(t, ` headers.region == "eu" `)}); err != nil {
+			t.Errorf("type %d: subscribing with the same filter: %v", subscriptionType, err)
+		}
+		if _, err := b.Subscribe("t", "g", SubscriptionOptions{Type: subscriptionType, Filter: us}); !hasPreconditionFailure(err, errFilterMismatch) {
+			t.Errorf("type %d: subscribing with another filter: got %v, want %s", subscriptionType, err, errFilterMismatch)
+		}
+		if _, err := b.Subscribe("t", "g", SubscriptionOptions{Type: subscriptionType}); !hasPreconditionFailure(err, errFilterMismatch) {
+			t.Errorf("type %d: subscribing without a filter: got %v, want %s", subscriptionType, err, errFilterMismatch)
+		}
+	}
+
+	// Each partition of a partitioned group is polled by a single subscriber, so its filter decides.
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 1})
+	if _, err := b.Subscribe("t", "g", SubscriptionOptions{Filter: eu}); err != nil {
+		t.Fatal(err)
+	}
+	subscriberID, err := b.Subscribe("t", "g", SubscriptionOptions{Filter: us})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("t", Message{Headers: map[string]string{"region": "eu"}}, Message{Headers: map[string]string{"region": "us"}}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := b.Poll(subscriberID, PollLimits{MaxMessages: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Headers["region"] != "us" {
+		t.Errorf("polled %v, want the message from us", msgs)
+	}
+}
+
+// Publish n messages to the topic's partition.
+func publishTo(t *testing.T, b *Broker, topicName string, partition, n int) {
+	t.Helper()
+	msgs := make([]Message, n)
+	for i := range msgs {
+		msgs[i] = Message{Partition: &partition}
+	}
+	if err := b.Publish(topicName, msgs...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countByPartition(msgs []Message) map[int]int {
+	counts := map[int]int{}
+	for _, m := range msgs {
+		counts[m.ID.Partition]++
+	}
+	return counts
+}
+
+// A poll shares its limit between the partitions, so a backlogged partition can't starve the
+// others, and the share of partitions without enough messages goes to those with more.
+func TestPollFairShare(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 4})
+	publishTo(t, b, "t", 0, 1000)
+	for partition := 1; partition < 4; partition++ {
+		publishTo(t, b, "t", partition, 10)
+	}
+	subscriberID, err := b.Subscribe("t", "g", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := mustPoll(t, b, subscriberID, 8)
+	if counts := countByPartition(msgs); len(counts) != 4 || counts[0] != 2 || counts[1] != 2 || counts[2] != 2 || counts[3] != 2 {
+		t.Fatalf("polled %v messages by partition, want 2 from each", counts)
+	}
+	if err := b.MoveOffset(subscriberID, len(msgs)); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs = mustPoll(t, b, subscriberID, 100)
+	if counts := countByPartition(msgs); counts[0] != 76 || counts[1] != 8 || counts[2] != 8 || counts[3] != 8 {
+		t.Fatalf("polled %v messages by partition, want the rest of the sparse partitions and 76 from the backlog", counts)
+	}
+	seen := map[MessageID]bool{}
+	for _, m := range msgs {
+		if seen[m.ID] {
+			t.Fatalf("polled message %v twice", m.ID)
+		}
+		seen[m.ID] = true
+	}
+}
+
+// With a limit below the number of partitions, each poll starts after the partition the last one
+// ended with, so every partition with messages is polled at least every ⌈partitions/limit⌉ polls.
+func TestPollRotation(t *testing.T) {
+	const partitions, limit = 5, 2
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: partitions})
+	publishTo(t, b, "t", 0, 1000)
+	for partition := 1; partition < partitions; partition++ {
+		publishTo(t, b, "t", partition, 20)
+	}
+	subscriberID, err := b.Subscribe("t", "g", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const bound = (partitions + limit - 1) / limit
+	lastPolled := map[int]int{}
+	next := 0
+	for poll := range 30 {
+		msgs := mustPoll(t, b, subscriberID, limit)
+		if len(msgs) != limit {
+			t.Fatalf("poll %d: polled %d messages, want %d", poll, len(msgs), limit)
+		}
+		for i, m := range msgs {
+			if want := (next + i) % partitions; m.ID.Partition != want {
+				t.Fatalf("poll %d: polled partition %d, want %d after the last poll's", poll, m.ID.Partition, want)
+			}
+			lastPolled[m.ID.Partition] = poll
+		}
+		next = (msgs[len(msgs)-1].ID.Partition + 1) % partitions
+		if err := b.MoveOffset(subscriberID, len(msgs)); err != nil {
+			t.Fatal(err)
+		}
+
+		for partition := range partitions {
+			if last, ok := lastPolled[partition]; poll >= bound && (!ok || poll-last >= bound) {
+				t.Fatalf("poll %d: partition %d last polled by poll %d, want within %d polls", poll, partition, last, bound)
+			}
+		}
+	}
+}
+
+// Higher priority messages are polled first from every partition, wherever they are in their
+// partitions, and a priority's messages are shared fairly between the partitions.
+func TestPollPriorities(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 2})
+	for partition := range 2 {
+		msgs := []Message{}
+		for i := range 10 {
+			msgs = append(msgs, Message{Payload: []byte(fmt.Sprintf("%d/low%d", partition, i)), Partition: &partition})
+		}
+		for i := range 3 {
+			msgs = append(msgs, Message{Payload: []byte(fmt.Sprintf("%d/high%d", partition, i)), Priority: 5, Partition: &partition})
+		}
+		if err := b.Publish("t", msgs...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subscriberID, err := b.Subscribe("t", "g", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := mustPoll(t, b, subscriberID, 8)
+	want := []string{"0/high0", "0/high1", "0/high2", "1/high0", "1/high1", "1/high2", "0/low0", "1/low0"}
+	if got := payloads(msgs); !slices.Equal(got, want) {
+		t.Errorf("polled %q, want %q", got, want)
+	}
+}
+
+// A key ordered group's partitions are scanned past the key's later messages, which wait for its
+// first to be acknowledged, for other keys' messages.
+func TestPollKeyOrderedScan(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 1})
+	var msgs []Message
+	for i := range 5 {
+		msgs = append(msgs, Message{Key: "a", Payload: []byte(fmt.Sprintf("a%d", i))})
+	}
+	msgs = append(msgs, Message{Key: "b", Payload: []byte("b0")}, Message{Key: "c", Payload: []byte("c0")})
+	if err := b.Publish("t", msgs...); err != nil {
+		t.Fatal(err)
+	}
+	subscriberID, err := b.Subscribe("t", "g", SubscriptionOptions{Type: KeyOrderedSubscription})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	polled := mustPoll(t, b, subscriberID, 3)
+	if got, want := payloads(polled), []string{"a0", "b0", "c0"}; !slices.Equal(got, want) {
+		t.Fatalf("polled %q, want %q", got, want)
+	}
+	if err := b.Acknowledge(subscriberID, polled[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := payloads(mustPoll(t, b, subscriberID, 3)), []string{"a1"}; !slices.Equal(got, want) {
+		t.Errorf("polled %q after acknowledging the key's first message, want %q", got, want)
+	}
+}
+
+// Make the subscriber's last contact with the topic the duration ago.
+func lastSeenAgo(b *Broker, topicName, subscriberID string, ago time.Duration) {
+	topic := b.topicsByName[topicName]
+	topic.mutex.Lock()
+	defer topic.mutex.Unlock()
+
+	subscriber := topic.subscribersByID[subscriberID]
+	subscriber.lastSeen = time.Now().UTC().Add(-ago)
+	topic.subscribersByID[subscriberID] = subscriber
+}
+
+// A failover group's messages are delivered to its earliest live member. Once that member loses its
+// session the next takes over, and the members before it are evicted.
+func TestFailoverHandover(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 2})
+	publishTo(t, b, "t", 0, 2)
+	publishTo(t, b, "t", 1, 2)
+	opts := SubscriptionOptions{Type: FailoverSubscription, SessionTimeout: time.Minute}
+	var members []string
+	for range 3 {
+		subscriberID, err := b.Subscribe("t", "g", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, subscriberID)
+	}
+	first, second, third := members[0], members[1], members[2]
+
+	for _, standby := range []string{second, third} {
+		if msgs := mustPoll(t, b, standby, 10); len(msgs) != 0 {
+			t.Errorf("standby polled %d messages, want none while the earliest member is live", len(msgs))
+		}
+		if active, err := b.Heartbeat(standby); err != nil || active {
+			t.Errorf("standby's heartbeat got %t, %v, want inactive", active, err)
+		}
+	}
+	if msgs := mustPoll(t, b, first, 1); len(msgs) != 1 {
+		t.Fatalf("active member polled %d messages, want 1", len(msgs))
+	}
+	if err := b.MoveOffset(first, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The standbys keep their sessions by polling, so only the first loses its session.
+	lastSeenAgo(b, "t", first, 2*time.Minute)
+	if active, err := b.Heartbeat(second); err != nil || !active {
+		t.Errorf("next member's heartbeat got %t, %v, want active", active, err)
+	}
+	if msgs := mustPoll(t, b, second, 10); len(msgs) != 3 {
+		t.Errorf("new active member polled %d messages, want the 3 its predecessor didn't acknowledge", len(msgs))
+	}
+	if msgs := mustPoll(t, b, third, 10); len(msgs) != 0 {
+		t.Errorf("remaining standby polled %d messages, want none", len(msgs))
+	}
+
+	// The evicted member must subscribe again, rejoining as the last standby.
+	if _, err := b.Poll(first, PollLimits{MaxMessages: 10}); !hasPreconditionFailure(err, errSubscriberNotFound) {
+		t.Errorf("evicted member's poll got %v, want subscriber not found", err)
+	}
+	if _, err := b.Heartbeat(first); !hasPreconditionFailure(err, errSubscriberNotFound) {
+		t.Errorf("evicted member's heartbeat got %v, want subscriber not found", err)
+	}
+	rejoined, err := b.Subscribe("t", "g", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active, err := b.Heartbeat(rejoined); err != nil || active {
+		t.Errorf("rejoined member's heartbeat got %t, %v, want inactive", active, err)
+	}
+}
+
+// isActive evicts every member which has lost its session up to the first which hasn't, and only
+// applies to failover groups.
+func TestFailoverIsActive(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 1})
+	var members []string
+	for range 3 {
+		subscriberID, err := b.Subscribe("t", "failover", SubscriptionOptions{Type: FailoverSubscription, SessionTimeout: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, subscriberID)
+	}
+	shared, err := b.Subscribe("t", "shared", SubscriptionOptions{Type: SharedSubscription, SessionTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := b.topicsByName["t"]
+	topic.mutex.Lock()
+	defer topic.mutex.Unlock()
+	g := topic.groupsByName["failover"]
+	now := time.Now().UTC()
+
+	// The later members' sessions lapsing neither affects the active first nor evicts them.
+	later := now.Add(90 * time.Second)
+	subscriber := topic.subscribersByID[members[0]]
+	subscriber.lastSeen = later
+	topic.subscribersByID[members[0]] = subscriber
+	if !topic.isActive(g, members[0], later) || topic.isActive(g, members[2], later) {
+		t.Errorf("the earliest live member isn't the only active one")
+	}
+	if !slices.Equal(g.members, members) {
+		t.Errorf("got members %q, want none evicted behind the active member", g.members)
+	}
+
+	// Once every member's session has lapsed none are active, and all are evicted.
+	muchLater := later.Add(2 * time.Minute)
+	if topic.isActive(g, members[2], muchLater) {
+		t.Errorf("a member whose session has lapsed is active")
+	}
+	if len(g.members) != 0 {
+		t.Errorf("got members %q, want every member evicted", g.members)
+	}
+	for _, id := range members {
+		if _, ok := topic.subscribersByID[id]; ok {
+			t.Errorf("evicted member %q is still a subscriber of the topic", id)
+		}
+	}
+
+	if !topic.isActive(topic.groupsByName["shared"], shared, muchLater) {
+		t.Errorf("a shared group's member isn't active")
+	}
+}
@@ -0,0 +1,327 @@
+package svc
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+
+	"pubsub/common/compression"
+	commonerrors "pubsub/common/errors"
+)
+
+// A subscription is a subscriber's membership of every topic matching its topic pattern.
+type subscription struct {
+	mutex sync.Mutex
+
+	pattern topicPattern
+	group   string
+	opts    SubscriptionOptions
+	// The topics joined, in the order they were joined. They're referred to directly, so the
+	// Broker's mutex needn't be held to look them up.
+	topics []joinedTopic
+	// How many messages, and retained messages, the last poll returned from each topic.
+	lastPoll []polledTopic
+}
+
+type joinedTopic struct {
+	name  string
+	topic *topic
+}
+
+type polledTopic struct {
+	topic           *topic
+	count, retained int
+}
+
+func (s *subscription) join(subscriberID, topicName string, topic *topic) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := topic.subscribe(subscriberID, s.group, s.opts); err != nil {
+		return err
+	}
+	s.topics = append(s.topics, joinedTopic{name: topicName, topic: topic})
+	return nil
+}
+
+func (s *subscription) leave(topicName string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.topics = slices.DeleteFunc(s.topics, func(joined joinedTopic) bool { return joined.name == topicName })
+	s.lastPoll = slices.DeleteFunc(s.lastPoll, func(polled polledTopic) bool { return polled.topic.name == topicName })
+}
+
+func (s *subscription) poll(subscriberID string, limits PollLimits) ([]Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	budget := newPollBudget(limits)
+	polledMessages := getPollBuffer(limits.MaxMessages)
+	s.lastPoll = s.lastPoll[:0]
+	for _, joined := range s.topics {
+		topic := joined.topic
+		if !topic.allows(s.opts.ClientID, SubscribeAccess) {
+			// The topic's ACL has changed since it was joined. Topics matching a pattern are
+			// skipped while it doesn't allow the client.
+			if s.pattern.isExact() {
+				releasePollBuffer(polledMessages)
+				return nil, errAccessDenied(joined.name, s.opts.ClientID, SubscribeAccess)
+			}
+			continue
+		}
+		if !s.pattern.isExact() && !topic.hasSubscriber(subscriberID) {
+			// A newer subscriber of the group has since been assigned the topic's partitions, but
+			// the others matching the pattern can still be polled.
+			continue
+		}
+
+		polledBefore := len(polledMessages)
+		var (
+			retained int
+			err      error
+		)
+		polledMessages, retained, err = topic.poll(subscriberID, budget, polledMessages)
+		if err != nil {
+			releasePollBuffer(polledMessages)
+			return nil, err
+		}
+		if len(polledMessages) == polledBefore {
+			continue
+		}
+
+		s.lastPoll = append(s.lastPoll, polledTopic{topic: topic, count: len(polledMessages) - polledBefore, retained: retained})
+
+		if budget.spent() {
+			break
+		}
+	}
+	retainedFirst(polledMessages, s.lastPoll)
+	// Payloads are decompressed once every topic has been polled, so no topic's lock is held while
+	// they are.
+	budget.prepare(polledMessages, s.decompress)
+	return polledMessages, nil
+}
+
+// Reorder the messages polled from each topic in turn so the retained messages of every topic come
+// before the rest, keeping their order otherwise. Retained messages have no IDs, so are acknowledged
+// by moving the offset past them, which mustn't move it past another topic's messages as well.
+func retainedFirst(polledMessages []Message, lastPoll []polledTopic) {
+	if len(lastPoll) < 2 {
+		return
+	}
+	var rest []Message
+	next, start := 0, 0
+	for _, polled := range lastPoll {
+		next += copy(polledMessages[next:], polledMessages[start:start+polled.retained])
+		rest = append(rest, polledMessages[start+polled.retained:start+polled.count]...)
+		start += polled.count
+	}
+	copy(polledMessages[next:], rest)
+}
+
+// A pollBudget tracks how much more a poll can return.
+type pollBudget struct {
+	// How many more messages, and bytes of messages, can be returned.
+	messages, bytes int
+	// The most bytes of messages returned, and returned from each partition.
+	maxBytes, partitionMaxBytes int
+	size                        func(Message) int
+	// Whether a message has been taken, as the first is taken however large it is.
+	taken bool
+	// Whether a message didn't fit in the bytes left, so no more can be returned.
+	full bool
+}
+
+func newPollBudget(limits PollLimits) *pollBudget {
+	b := &pollBudget{
+		messages:          limits.MaxMessages,
+		maxBytes:          limits.MaxBytes,
+		partitionMaxBytes: limits.PartitionMaxBytes,
+		size:              limits.Size,
+	}
+	if b.maxBytes == 0 {
+		b.maxBytes = math.MaxInt
+	}
+	if b.partitionMaxBytes == 0 {
+		b.partitionMaxBytes = math.MaxInt
+	}
+	if b.size == nil {
+		b.size = Message.size
+	}
+	b.bytes = b.maxBytes
+	return b
+}
+
+// Prepare the messages taken, e.g. decompressing their payloads, as long as the poll stays within
+// its byte limit. Messages which would take it beyond the limit are left as they are.
+func (b *pollBudget) prepare(messages []Message, prepare func(message *Message, maxSize int)) {
+	for i := range messages {
+		unprepared := messages[i]
+		size := b.size(unprepared)
+		prepare(&messages[i], max(b.bytes+size, 0))
+		if grown := b.size(messages[i]) - size; grown > b.bytes {
+			messages[i] = unprepared
+		} else {
+			b.bytes -= grown
+		}
+	}
+}
+
+// Whether no more messages can be returned.
+func (b *pollBudget) spent() bool {
+	return b.messages == 0 || b.full
+}
+
+// Take the message from the budget, returning its size, unless it's larger than the bytes left or
+// than maxBytes.
+func (b *pollBudget) take(message Message, maxBytes int) (int, bool) {
+	size := b.size(message)
+	if b.taken && (size > b.bytes || size > maxBytes) {
+		b.full = size > b.bytes
+		return 0, false
+	}
+	b.taken = true
+	b.messages--
+	b.bytes -= size
+	return size, true
+}
+
+// Buffers for the messages returned by polls, which are reused once they're released.
+var pollBuffers sync.Pool
+
+// An empty buffer with capacity for at least size messages.
+func getPollBuffer(size int) []Message {
+	if buffer, ok := pollBuffers.Get().(*[]Message); ok && cap(*buffer) >= size {
+		return (*buffer)[:0]
+	}
+	return make([]Message, 0, size)
+}
+
+func releasePollBuffer(messages []Message) {
+	// Don't keep the messages' payloads from being garbage collected.
+	clear(messages[:cap(messages)])
+	messages = messages[:0]
+	pollBuffers.Put(&messages)
+}
+
+// Decompress the payload if it's compressed with a codec the subscriber doesn't accept. Payloads
+// which fail to decompress, or would decompress to more than maxSize bytes, are left compressed, so
+// the subscriber can decide what to do with them.
+func (s *subscription) decompress(message *Message, maxSize int) {
+	if message.Compression == "" || slices.Contains(s.opts.AcceptCompressions, message.Compression) {
+		return
+	}
+
+	payload, err := compression.Decompress(message.Compression, message.Payload, maxSize)
+	if errors.Is(err, compression.ErrTooLarge) {
+		return
+	}
+	if err != nil {
+		slog.Warn("Decompressing payload", slog.Any("error", err), slog.Any("message_id", message.ID))
+		return
+	}
+	message.Payload = payload
+	message.Compression = ""
+}
+
+func (s *subscription) moveOffset(subscriberID string, delta int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Acknowledge the messages returned by the last poll in the order they were returned: the
+	// retained messages of every topic, then the rest from each topic in turn. Any delta beyond that
+	// moves the offsets through the topics in order.
+	remainingDelta := delta
+	topicDeltas := make([]int, len(s.lastPoll))
+	for i, polled := range s.lastPoll {
+		topicDeltas[i] = min(remainingDelta, polled.retained)
+		remainingDelta -= topicDeltas[i]
+	}
+	for i, polled := range s.lastPoll {
+		acknowledged := min(remainingDelta, polled.count-polled.retained)
+		topicDeltas[i] += acknowledged
+		remainingDelta -= acknowledged
+	}
+	for i, polled := range s.lastPoll {
+		if topicDeltas[i] == 0 {
+			continue
+		}
+		if _, err := polled.topic.moveOffset(subscriberID, topicDeltas[i]); err != nil {
+			return fmt.Errorf("moving offset: %w", err)
+		}
+	}
+	s.lastPoll = nil
+
+	for _, joined := range s.topics {
+		if remainingDelta == 0 {
+			break
+		}
+		topic := joined.topic
+		if !s.pattern.isExact() && !topic.hasSubscriber(subscriberID) {
+			continue
+		}
+
+		var err error
+		remainingDelta, err = topic.moveOffset(subscriberID, remainingDelta)
+		if err != nil {
+			return fmt.Errorf("moving offset: %w", err)
+		}
+	}
+
+	if remainingDelta > 0 {
+		return fmt.Errorf("moving offset: %w", errInvalidOffsetDelta{delta: delta})
+	}
+	return nil
+}
+
+// Acknowledge the messages, which may be from any of the topics joined.
+func (s *subscription) acknowledge(subscriberID string, messageIDs []MessageID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messageIDsByTopic := map[*topic][]MessageID{}
+	for _, messageID := range messageIDs {
+		i := slices.IndexFunc(s.topics, func(joined joinedTopic) bool { return joined.name == messageID.Topic })
+		if i == -1 {
+			return commonerrors.NewFailedPrecondition("invalid acknowledge request", commonerrors.PreconditionFailure{
+				Type:        errTopicNotSubscribed,
+				Description: fmt.Sprintf("Topic %q is not subscribed to by subscriber %q.", messageID.Topic, subscriberID),
+			})
+		}
+		topic := s.topics[i].topic
+		messageIDsByTopic[topic] = append(messageIDsByTopic[topic], messageID)
+	}
+
+	for topic, topicMessageIDs := range messageIDsByTopic {
+		if err := topic.acknowledge(subscriberID, topicMessageIDs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Record that the subscriber is still live, returning whether it's active in any of the topics
+// joined.
+func (s *subscription) heartbeat(subscriberID string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	active := false
+	for _, joined := range s.topics {
+		topic := joined.topic
+		if !s.pattern.isExact() && !topic.hasSubscriber(subscriberID) {
+			continue
+		}
+
+		topicActive, err := topic.heartbeat(subscriberID)
+		if err != nil {
+			return false, err
+		}
+		active = active || topicActive
+	}
+	return active, nil
+}
@@ -0,0 +1,274 @@
+package svc
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pubsub/common/compression"
+	commonerrors "pubsub/common/errors"
+)
+
+// The retained messages of every topic matching a subscription's pattern are returned first, so
+// acknowledging them by moving the offset past them leaves the rest of the topics' messages.
+func TestSubscriptionRetainedFirst(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "a.x", NumberOfPartitions: 1}, TopicDefinition{Name: "a.y", NumberOfPartitions: 1})
+	for _, name := range []string{"a.x", "a.y"} {
+		if err := b.Publish(name, Message{Key: name, Payload: []byte("retained"), Retain: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The group has been delivered the retained messages from their partitions already.
+	subscriberID, err := b.Subscribe("a.*", "g", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.MoveOffset(subscriberID, len(mustPoll(t, b, subscriberID, 10))); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.x", "a.y"} {
+		if err := b.Publish(name, Message{Key: name, Payload: []byte("regular")}, Message{Key: name, Payload: []byte("regular")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subscriberID, err = b.Subscribe("a.*", "g", SubscriptionOptions{ReceiveRetained: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := mustPoll(t, b, subscriberID, 10)
+	if len(msgs) != 6 {
+		t.Fatalf("polled %d messages, want 6", len(msgs))
+	}
+	for i, m := range msgs {
+		if retained := i < 2; m.Retain != retained {
+			t.Fatalf("polled %v, want the retained messages first", msgs)
+		}
+	}
+	if err := b.MoveOffset(subscriberID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(mustPoll(t, b, subscriberID, 10)); len(got) != 4 {
+		t.Errorf("polled %v after acknowledging the retained messages, want the 4 others again", got)
+	}
+}
+
+// Retained messages which a group is still to be delivered from their partitions, such as those of
+// a new group, are only delivered from there.
+func TestSubscriptionRetainedOnce(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 1, CleanupPolicy: CompactCleanup})
+	if err := b.Publish("t",
+		Message{Key: "a", Payload: []byte("a1")},
+		Message{Key: "b", Payload: []byte("retained"), Retain: true},
+		Message{Key: "a", Payload: []byte("a2")},
+	); err != nil {
+		t.Fatal(err)
+	}
+	subscriberID, err := b.Subscribe("t", "g", SubscriptionOptions{ReceiveRetained: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := mustPoll(t, b, subscriberID, 10)
+	if got := payloads(msgs); len(got) != 3 || slices.ContainsFunc(msgs, func(m Message) bool { return m.Retain }) {
+		t.Fatalf("polled %v, want the 3 messages once, from their partitions", got)
+	}
+
+	// Once the partition's copy is compacted, the retained copy is delivered.
+	if err := b.Publish("t", Message{Key: "b", Payload: []byte("b2")}); err != nil {
+		t.Fatal(err)
+	}
+	b.topicsByName["t"].cleanUp()
+	subscriberID, err = b.Subscribe("t", "other", SubscriptionOptions{ReceiveRetained: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs = mustPoll(t, b, subscriberID, 10)
+	if len(msgs) == 0 || !msgs[0].Retain || string(msgs[0].Payload) != "retained" {
+		t.Errorf("polled %v, want the retained message first", payloads(msgs))
+	}
+}
+
+// Subscriptions to a pattern join the matching topics created after subscribing, with offsets
+// kept per topic.
+func TestSubscriptionJoinsCreatedTopics(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "animals.cats", NumberOfPartitions: 2}, TopicDefinition{Name: "animals.dogs", NumberOfPartitions: 1})
+	oneToken, err := b.Subscribe("animals.*", "g", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anyTokens, err := b.Subscribe("animals.>", "other", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"animals.birds", "animals.birds.young", "plants.trees"} {
+		if err := b.CreateTopic(TopicDefinition{Name: name, NumberOfPartitions: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"animals.cats", "animals.dogs", "animals.birds", "animals.birds.young", "plants.trees"} {
+		if err := b.Publish(name, Message{Payload: []byte(name)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := payloads(mustPoll(t, b, anyTokens, 10)); len(got) != 4 || got[3] != "animals.birds.young" {
+		t.Errorf("polled %v with animals.>, want every animal topic's message", got)
+	}
+	got := payloads(mustPoll(t, b, oneToken, 10))
+	if len(got) != 3 || got[2] != "animals.birds" {
+		t.Fatalf("polled %v with animals.*, want the messages of animals.cats, animals.dogs and animals.birds", got)
+	}
+	if err := b.MoveOffset(oneToken, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(mustPoll(t, b, oneToken, 10)); len(got) != 1 || got[0] != "animals.birds" {
+		t.Errorf("polled %v after moving past 2 messages, want only the created topic's", got)
+	}
+}
+
+// Payloads compressed with codecs the subscriber doesn't accept are decompressed, as long as the
+// poll stays within its byte limit.
+func TestPollDecompress(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 1})
+	payload := strings.Repeat("a", 100)
+	codec, _ := compression.Lookup(compression.Gzip)
+	compressed, err := codec.Compress([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("t", Message{Payload: compressed, Compression: compression.Gzip}, Message{Payload: compressed, Compression: compression.Gzip}); err != nil {
+		t.Fatal(err)
+	}
+
+	accepting, err := b.Subscribe("t", "accepting", SubscriptionOptions{AcceptCompressions: []string{compression.Gzip}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mustPoll(t, b, accepting, 10) {
+		if m.Compression != compression.Gzip {
+			t.Errorf("polled a payload with compression %q, want it left compressed", m.Compression)
+		}
+	}
+
+	// Only the first payload fits decompressed.
+	subscriberID, err := b.Subscribe("t", "g", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := b.Poll(subscriberID, PollLimits{MaxMessages: 10, MaxBytes: len(payload) + len(compressed)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || string(msgs[0].Payload) != payload || msgs[0].Compression != "" || msgs[1].Compression != compression.Gzip {
+		t.Errorf("polled %+v, want the first payload decompressed and the second not", msgs)
+	}
+}
+
+// The topic's subscribers poll it in parallel with each other and with publishes, and each message
+// of a shared group is still delivered once.
+func TestPollConcurrently(t *testing.T) {
+	const messages = 1000
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 4})
+	subscriberIDs := make([]string, 4)
+	for i := range subscriberIDs {
+		var err error
+		if subscriberIDs[i], err = b.Subscribe("t", "g", SubscriptionOptions{Type: SharedSubscription}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range messages {
+			if err := b.Publish("t", Message{Key: strconv.Itoa(i), Payload: []byte(strconv.Itoa(i))}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	var mutex sync.Mutex
+	delivered := map[string]int{}
+	for _, subscriberID := range subscriberIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+				msgs, err := b.Poll(subscriberID, PollLimits{MaxMessages: 10})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids := make([]MessageID, len(msgs))
+				mutex.Lock()
+				for i, m := range msgs {
+					delivered[string(m.Payload)]++
+					ids[i] = m.ID
+				}
+				done := len(delivered) == messages
+				mutex.Unlock()
+				if err := b.Acknowledge(subscriberID, ids...); err != nil {
+					t.Error(err)
+					return
+				}
+				if done {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(delivered) != messages {
+		t.Errorf("delivered %d messages, want %d", len(delivered), messages)
+	}
+	for payload, count := range delivered {
+		if count != 1 {
+			t.Errorf("delivered message %s %d times, want once", payload, count)
+		}
+	}
+}
+
+// A topic's changed ACL applies to its existing subscribers at their next poll: exact subscriptions
+// fail, and pattern subscriptions skip the topic until it allows them again.
+func TestPollACLChanged(t *testing.T) {
+	topicDefs := []TopicDefinition{{Name: "a.x", NumberOfPartitions: 1}, {Name: "a.y", NumberOfPartitions: 1}}
+	b := mustNewBroker(t, topicDefs...)
+	for _, topicDef := range topicDefs {
+		if err := b.Publish(topicDef.Name, Message{Payload: []byte(topicDef.Name)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exact, err := b.Subscribe("a.x", "exact", SubscriptionOptions{ClientID: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pattern, err := b.Subscribe("a.*", "pattern", SubscriptionOptions{ClientID: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denied := topicDefs[0]
+	denied.ACL = ACL{Subscribers: []string{"other"}}
+	if err := b.UpdateTopic(denied); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Poll(exact, PollLimits{MaxMessages: 10}); !errors.As(err, &commonerrors.PermissionDenied{}) {
+		t.Errorf("polling a topic which no longer allows the client got %v, want permission denied", err)
+	}
+	if got := payloads(mustPoll(t, b, pattern, 10)); !slices.Equal(got, []string{"a.y"}) {
+		t.Errorf("polled %q, want only the topic still allowing the client", got)
+	}
+
+	if err := b.UpdateTopic(topicDefs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(mustPoll(t, b, exact, 10)); !slices.Equal(got, []string{"a.x"}) {
+		t.Errorf("polled %q once the topic allows the client again, want its message", got)
+	}
+}
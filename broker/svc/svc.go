@@ -4,9 +4,51 @@ import (
 	"time"
 )
 
+// The highest priority a Message can have, with zero the lowest.
+const MaxPriority = 9
+
 type Message struct {
+	// Where the Message is stored, set when it's polled.
+	ID  MessageID
 	Key string
 	// When the Message was first processed by the Broker.
 	Timestamp time.Time
 	Payload   []byte
+	Headers   map[string]string
+	// How long after its Timestamp the Message remains deliverable. Zero means it never expires.
+	TTL time.Duration
+	// When publishing, whether the Message should be retained for subscribers joining later. When
+	// polling, whether the Message was delivered because it was retained.
+	Retain bool
+	// Messages with a higher priority are polled first, from zero up to MaxPriority. Messages with
+	// the same key and priority are still polled in order.
+	Priority int
+	// Name of the codec the Payload is compressed with, if it is. Payloads are stored compressed.
+	Compression string
+	// When publishing, the partition to publish the Message to instead of the one chosen by the
+	// topic's partitioner, if not nil.
+	Partition *int
+
+	// Whether the Message was superseded by a later one with the same key and removed by
+	// compaction, leaving its offset to be skipped by polls.
+	compacted bool
+}
+
+func (m Message) expired(now time.Time) bool {
+	return m.TTL > 0 && now.After(m.Timestamp.Add(m.TTL))
+}
+
+// The size of the Message's key, payload and headers in bytes.
+func (m Message) size() int {
+	size := len(m.Key) + len(m.Payload)
+	for name, value := range m.Headers {
+		size += len(name) + len(value)
+	}
+	return size
+}
+
+type MessageID struct {
+	Topic     string
+	Partition int
+	Offset    int
 }
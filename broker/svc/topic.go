@@ -1,138 +1,412 @@
 package svc
 
 import (
+	"errors"
 	"fmt"
-
-	commonerrors "pubsub/common/errors"
+	"log/slog"
+	"maps"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	uuid "github.com/satori/go.uuid"
+	commonerrors "pubsub/common/errors"
 )
 
 type TopicDefinition struct {
 	Name               string
 	NumberOfPartitions int
 	PartitionStrategy  PartitionStrategy
+	// For KeyRangePartition, the key each partition after the first starts from, in increasing
+	// order, so there's one fewer than the number of partitions. Keys before the first split point
+	// are published to the first partition.
+	KeySplitPoints []string
+	// Default TTL for Messages published without one. Zero means they never expire.
+	MessageTTL time.Duration
+	// Whether the last retained Message is kept for each key, rather than for the whole topic.
+	RetainPerKey bool
+	// Subject of the schema which published payloads must be valid against, if any.
+	SchemaSubject string
+	// The largest a published Message can be, in bytes as encoded. Zero means the broker's limit.
+	MaxMessageSize int
+	CleanupPolicy  CleanupPolicy
+	// How many copies of each partition are kept. Only a single copy is supported, so it must be 0
+	// or 1.
+	ReplicationFactor int
+	// Which clients can publish and subscribe to the topic.
+	ACL ACL
+	// Whether partitions can be added to a topic partitioned by key, which moves keys to other
+	// partitions, so a key's later messages can be delivered before its earlier ones. Partitions can
+	// always be added to ConsistentHashPartition topics, which only move keys to the new partitions.
+	AllowKeyRemapping bool
+}
+
+// How a topic's messages are removed, besides being reclaimed once they expire.
+type CleanupPolicy int
+
+const (
+	// Messages are only removed once they expire.
+	DeleteCleanup CleanupPolicy = iota
+	// Messages are also removed once superseded by a later message with the same key, so the
+	// topic holds the latest message for each key. Every message must have a key.
+	CompactCleanup
+)
+
+func (c CleanupPolicy) String() string {
+	switch c {
+	case DeleteCleanup:
+		return "delete"
+	case CompactCleanup:
+		return "compact"
+	default:
+		return fmt.Sprintf("CleanupPolicy(%d)", int(c))
+	}
 }
 
 type topic struct {
+	// Held for writing to change the topic or its subscribers, but only for reading while
+	// publishing, so messages are published to different partitions in parallel.
 	mutex sync.RWMutex
 
-	name            string
-	partitions      []*partition
-	partitioner     partitioner
+	name        string
+	partitions  []*partition
+	partitioner Partitioner
+	// Only the partitioner's number of partitions can change, not its strategy.
+	partitionStrategy PartitionStrategy
+	keySplitPoints    []string
+	messageTTL        time.Duration
+	retainPerKey      bool
+	schemaSubject     string
+	maxMessageSize    int
+	cleanupPolicy     CleanupPolicy
+	acl               ACL
+	// Guards the retained messages while publishing, as the mutex is only held for reading.
+	retainedMutex   sync.Mutex
+	retainedByKey   map[string]retainedMessage
+	retainedCount   int
 	subscribersByID map[string]subscriber
+	groupsByName    map[string]*group
+	metrics         topicMetrics
+	// The priorities of the messages published, as a set of bits, so polls only look for those.
+	priorities atomic.Uint32
+	// Holds a chan struct{} which is closed and replaced each time messages are published.
+	published atomic.Value
 }
 
-type subscriber struct {
-	group         string
-	partitionIdxs []int
+type retainedMessage struct {
+	message Message
+	// Orders retained messages by when they were retained.
+	sequence int
+	// Where the message was published, so it isn't delivered again to groups which are still to be
+	// delivered it from its partition.
+	partitionIdx, offset int
 }
 
-func newTopic(name string, numberOfPartitions int, partitionStrategy PartitionStrategy) (*topic, error) {
-	if numberOfPartitions < 1 {
-		return nil, fmt.Errorf("creating topic %q: number of partitions must be greater than zero, got %d", name, numberOfPartitions)
+func newTopic(topicDef TopicDefinition) (*topic, error) {
+	if err := topicDef.validate(); err != nil {
+		return nil, fmt.Errorf("creating topic %q: %w", topicDef.Name, err)
 	}
 
-	partitioner, err := newPartitioner(partitionStrategy, numberOfPartitions)
+	partitioner, err := newPartitioner(topicDef)
 	if err != nil {
-		return nil, fmt.Errorf("creating topic %q: %w", name, err)
+		return nil, fmt.Errorf("creating topic %q: %w", topicDef.Name, err)
 	}
-	partitions := make([]*partition, 0, numberOfPartitions)
-	for range numberOfPartitions {
+	partitions := make([]*partition, 0, topicDef.NumberOfPartitions)
+	for range topicDef.NumberOfPartitions {
 		partitions = append(partitions, newPartition())
 	}
-	return &topic{
-		name:        name,
-		partitions:  partitions,
-		partitioner: partitioner,
-	}, nil
+	t := &topic{
+		name:              topicDef.Name,
+		partitions:        partitions,
+		partitioner:       partitioner,
+		partitionStrategy: topicDef.PartitionStrategy,
+		keySplitPoints:    topicDef.KeySplitPoints,
+		messageTTL:        topicDef.MessageTTL,
+		retainPerKey:      topicDef.RetainPerKey,
+		schemaSubject:     topicDef.SchemaSubject,
+		maxMessageSize:    topicDef.MaxMessageSize,
+		cleanupPolicy:     topicDef.CleanupPolicy,
+		acl:               topicDef.ACL,
+		retainedByKey:     map[string]retainedMessage{},
+		subscribersByID:   map[string]subscriber{},
+		groupsByName:      map[string]*group{},
+	}
+	t.published.Store(make(chan struct{}))
+	return t, nil
 }
 
-func (t *topic) publish(newMessages ...Message) error {
+func (d TopicDefinition) validate() error {
+	if d.NumberOfPartitions < 1 {
+		return fmt.Errorf("number of partitions must be greater than zero, got %d", d.NumberOfPartitions)
+	}
+	if d.MessageTTL < 0 {
+		return fmt.Errorf("message TTL must not be negative, got %s", d.MessageTTL)
+	}
+	if d.MaxMessageSize < 0 {
+		return fmt.Errorf("max message size must not be negative, got %d", d.MaxMessageSize)
+	}
+	if d.CleanupPolicy != DeleteCleanup && d.CleanupPolicy != CompactCleanup {
+		return fmt.Errorf("unknown cleanup policy %d", d.CleanupPolicy)
+	}
+	if d.ReplicationFactor < 0 || d.ReplicationFactor > 1 {
+		return fmt.Errorf("replication isn't supported, so the replication factor must be 0 or 1, got %d", d.ReplicationFactor)
+	}
+	return d.ACL.validate()
+}
+
+// Apply the definition to the topic, as described by Broker.UpdateTopic.
+//
+// Adding partitions changes which partition keys are hashed to, so a key's later messages can be
+// delivered before its earlier ones. Only consistent hashing limits which keys move.
+func (t *topic) update(topicDef TopicDefinition) error {
+	if err := topicDef.validate(); err != nil {
+		return err
+	}
+
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	now := time.Now().UTC()
-	for _, message := range newMessages {
-		message.Timestamp = now
-		partition := t.partitions[t.partitioner.getPartitionIdx(message)]
-		partition.publish(message)
+	var errs []error
+	if topicDef.NumberOfPartitions < len(t.partitions) {
+		errs = append(errs, fmt.Errorf("number of partitions can't be decreased from %d to %d", len(t.partitions), topicDef.NumberOfPartitions))
+	}
+	if topicDef.RetainPerKey != t.retainPerKey {
+		errs = append(errs, fmt.Errorf("retain per key can't be changed from %t to %t", t.retainPerKey, topicDef.RetainPerKey))
+	}
+	if topicDef.SchemaSubject != t.schemaSubject {
+		errs = append(errs, fmt.Errorf("schema subject can't be changed from %q to %q", t.schemaSubject, topicDef.SchemaSubject))
+	}
+	if topicDef.CleanupPolicy != t.cleanupPolicy {
+		errs = append(errs, fmt.Errorf("cleanup policy can't be changed from %s to %s", t.cleanupPolicy, topicDef.CleanupPolicy))
+	}
+	partitioner := t.partitioner
+	if topicDef.PartitionStrategy != t.partitionStrategy {
+		errs = append(errs, fmt.Errorf("partition strategy can't be changed from %s to %s", t.partitionStrategy, topicDef.PartitionStrategy))
+	} else if topicDef.NumberOfPartitions > len(t.partitions) && t.partitionStrategy.remapsKeys() && !topicDef.AllowKeyRemapping {
+		errs = append(errs, fmt.Errorf("partitions can't be added to a topic partitioned by %s, which would move keys to other partitions, unless key remapping is allowed", t.partitionStrategy))
+	} else if topicDef.NumberOfPartitions > len(t.partitions) {
+		var err error
+		if partitioner, err = newPartitioner(topicDef); err != nil {
+			errs = append(errs, err)
+		}
+	} else if !slices.Equal(topicDef.KeySplitPoints, t.keySplitPoints) {
+		errs = append(errs, errors.New("key split points can only be changed when adding partitions"))
+	}
+	if len(errs) != 0 {
+		return errors.Join(errs...)
+	}
+
+	if t.partitionStrategy == ConsistentHashPartition && topicDef.NumberOfPartitions > len(t.partitions) {
+		// The new partitions take an even share of the keys, from every existing partition.
+		moved := float64(topicDef.NumberOfPartitions-len(t.partitions)) / float64(topicDef.NumberOfPartitions)
+		slog.Info("Adding partitions, moving keys to them", slog.String("topic", t.name), slog.Int("partitions", topicDef.NumberOfPartitions), slog.Float64("keys_moved", moved))
 	}
+	for i := len(t.partitions); i < topicDef.NumberOfPartitions; i++ {
+		t.partitions = append(t.partitions, newPartition())
+		// Every subscriber is assigned every partition.
+		for subscriberID, subscriber := range t.subscribersByID {
+			subscriber.partitionIdxs = append(subscriber.partitionIdxs, i)
+			t.subscribersByID[subscriberID] = subscriber
+		}
+	}
+	t.partitioner = partitioner
+	t.keySplitPoints = topicDef.KeySplitPoints
+	t.messageTTL = topicDef.MessageTTL
+	t.maxMessageSize = topicDef.MaxMessageSize
+	t.acl = topicDef.ACL
 	return nil
 }
 
-func (t *topic) subscribe(group string) string {
-	subscriberID := uuid.NewV4().String()
+// Whether the topic's ACL allows the client the access.
+func (t *topic) allows(clientID string, access Access) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
 
-	// Naive (dumb) assignment of partitions: reassign all to new subscriber.
-	partitions := make([]int, 0, len(t.partitions))
-	for i := range len(t.partitions) {
-		partitions = append(partitions, i)
-	}
-	t.subscribersByID = map[string]subscriber{
-		subscriberID: {
-			group:         group,
-			partitionIdxs: partitions,
-		},
+	return t.acl.allows(clientID, access)
+}
+
+func (t *topic) info() TopicInfo {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return TopicInfo{
+		NumberOfPartitions: len(t.partitions),
+		MaxMessageSize:     t.maxMessageSize,
+		Metrics:            t.metrics.snapshot(),
 	}
-	return subscriberID
 }
 
-func (t *topic) poll(subscriberID string, maxBufferSize int) ([]Message, error) {
+func (t *topic) publish(newMessages ...Message) error {
 	t.mutex.RLock()
 	defer t.mutex.RUnlock()
 
-	subscriber, ok := t.subscribersByID[subscriberID]
-	if !ok {
-		return nil, commonerrors.NewFailedPrecondition("invalid polling request", commonerrors.PreconditionFailure{
-			Type:        errSubscriberNotFound,
-			Description: fmt.Sprintf("Subscriber %q is not a registered subscriber of the broker.", subscriberID),
-		})
+	if err := t.validatePartitions(newMessages); err != nil {
+		return err
+	}
+	partitioner := t.partitioner
+	if p, ok := partitioner.(BatchPartitioner); ok {
+		partitioner = p.StartBatch()
+	}
+	now := time.Now().UTC()
+	// Each run of messages for the same partition is appended together, and then those to be
+	// retained are retained, with their offsets.
+	var runBuffer [16]*Message
+	run, runPartitionIdx := runBuffer[:0], 0
+	var runRetained []int
+	publishRun := func() {
+		offset := t.partitions[runPartitionIdx].publish(run...)
+		for _, i := range runRetained {
+			message := *run[i]
+			message.Retain = true
+			t.retain(message, runPartitionIdx, offset+i)
+		}
+		run, runRetained = run[:0], runRetained[:0]
+	}
+	for _, message := range newMessages {
+		message.Timestamp = now
+		if message.TTL == 0 {
+			message.TTL = t.messageTTL
+		}
+		t.priorities.Or(1 << message.Priority)
+		var partitionIdx int
+		if message.Partition != nil {
+			partitionIdx = *message.Partition
+			// The partition is only set on Messages being published.
+			message.Partition = nil
+		} else {
+			partitionIdx = partitioner.PartitionIdx(message)
+		}
+
+		if len(run) != 0 && partitionIdx != runPartitionIdx {
+			publishRun()
+		}
+		if message.Retain {
+			runRetained = append(runRetained, len(run))
+			// Only copies delivered because they were retained are flagged as such.
+			message.Retain = false
+		}
+		run = append(run, &message)
+		runPartitionIdx = partitionIdx
 	}
+	if len(run) != 0 {
+		publishRun()
+	}
+
+	close(t.published.Swap(make(chan struct{})).(chan struct{}))
+	return nil
+}
 
-	polledMessages := make([]Message, 0, maxBufferSize)
-	limit := maxBufferSize
-	for _, partitionIdx := range subscriber.partitionIdxs {
-		partition := t.partitions[partitionIdx]
-		messages := partition.poll(subscriber.group, limit)
+// Returns a channel which is closed the next time messages are published.
+func (t *topic) awaitPublish() <-chan struct{} {
+	return t.published.Load().(chan struct{})
+}
 
-		polledMessages = append(polledMessages, messages...)
-		limit -= len(messages)
+// Find the first message in any partition for which match returns true.
+func (t *topic) find(match func(Message) bool) (Message, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
 
-		if len(polledMessages) == maxBufferSize {
-			break
+	for _, partition := range t.partitions {
+		if message, ok := partition.find(match); ok {
+			return message, true
 		}
 	}
-	return polledMessages, nil
+	return Message{}, false
 }
 
-func (t *topic) moveOffset(subscriberID string, delta int) error {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
+// Keep the message, published at the partition's offset, as the topic's last retained message, or
+// its key's if retaining per key.
+func (t *topic) retain(message Message, partitionIdx, offset int) {
+	key := ""
+	if t.retainPerKey {
+		key = message.Key
+	}
+
+	t.retainedMutex.Lock()
+	defer t.retainedMutex.Unlock()
+
+	t.retainedCount++
+	t.retainedByKey[key] = retainedMessage{
+		message:      message,
+		sequence:     t.retainedCount,
+		partitionIdx: partitionIdx,
+		offset:       offset,
+	}
+}
+
+// The topic's retained messages, oldest first. The mutex must be held for writing.
+func (t *topic) retainedMessages() []retainedMessage {
+	return slices.SortedFunc(maps.Values(t.retainedByKey), func(a, b retainedMessage) int {
+		return a.sequence - b.sequence
+	})
+}
+
+// Compact the topic if its cleanup policy is to, then reclaim expired and compacted messages from
+// the head of each partition. Returns how many messages were compacted, and how many reclaimed.
+func (t *topic) cleanUp() (int, int) {
+	t.mutex.RLock()
+	partitions := slices.Clone(t.partitions)
+	t.mutex.RUnlock()
 
-	subscriber, ok := t.subscribersByID[subscriberID]
-	if !ok {
-		return commonerrors.NewFailedPrecondition("invalid polling request", commonerrors.PreconditionFailure{
-			Type:        errSubscriberNotFound,
-			Description: fmt.Sprintf("Subscriber %q is not a registered subscriber of the broker.", subscriberID),
-		})
+	now := time.Now().UTC()
+	compacted, reclaimed := 0, 0
+	for _, partition := range partitions {
+		if t.cleanupPolicy == CompactCleanup {
+			compacted += partition.compact()
+		}
+		partitionReclaimed, expired := partition.reclaim(now)
+		reclaimed += partitionReclaimed
+		t.metrics.expiredReclaimed.Add(int64(expired))
 	}
+	t.metrics.compacted.Add(int64(compacted))
+	return compacted, reclaimed
+}
 
-	remainingDelta := delta
+// Messages published to an explicit partition must give one of the topic's partitions. The mutex
+// must be held.
+func (t *topic) validatePartitions(messages []Message) error {
+	violations := []commonerrors.FieldViolation{}
+	for i, message := range messages {
+		if message.Partition == nil {
+			continue
+		}
+		if *message.Partition < 0 {
+			violations = append(violations, commonerrors.FieldViolation{
+				Field:       fmt.Sprintf("messages[%d].partition", i),
+				Reason:      "BELOW_MIN_VALUE",
+				Description: "Minimum value 0",
+			})
+		} else if *message.Partition >= len(t.partitions) {
+			violations = append(violations, commonerrors.FieldViolation{
+				Field:       fmt.Sprintf("messages[%d].partition", i),
+				Reason:      "ABOVE_MAX_VALUE",
+				Description: fmt.Sprintf("Maximum value %d, as topic %q has %d partitions", len(t.partitions)-1, t.name, len(t.partitions)),
+			})
+		}
+	}
 
-	for _, partitionIdx := range subscriber.partitionIdxs {
-		partition := t.partitions[partitionIdx]
+	if len(violations) != 0 {
+		return commonerrors.NewInvalidArgument("invalid publish request", violations...)
+	}
+	return nil
+}
 
-		remainingDelta = partition.moveOffset(subscriber.group, remainingDelta)
-		if remainingDelta == 0 {
-			break
+// Every message published to a compacted topic must have a key, as compaction keeps the latest
+// message for each.
+func validateKeys(messages []Message) error {
+	violations := []commonerrors.FieldViolation{}
+	for i, message := range messages {
+		if message.Key == "" {
+			violations = append(violations, commonerrors.FieldViolation{
+				Field:       fmt.Sprintf("messages[%d].key", i),
+				Reason:      "REQUIRED_FIELD",
+				Description: "Required by compacted topics",
+			})
 		}
 	}
 
-	if remainingDelta > 0 {
-		return fmt.Errorf("moving offset: %w", errInvalidOffsetDelta{delta: delta})
+	if len(violations) != 0 {
+		return commonerrors.NewInvalidArgument("invalid publish request", violations...)
 	}
 	return nil
 }
@@ -0,0 +1,75 @@
+package svc
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// Matches exactly one token of a topic name.
+	singleTokenWildcard = "*"
+	// Matches one or more tokens at the end of a topic name.
+	multiTokenWildcard = ">"
+	// Topics whose names start with the prefix are internal to the broker, so are never matched by
+	// wildcards.
+	internalTopicPrefix = "_"
+)
+
+// A topicPattern matches the dot separated tokens of topic names, e.g. "animals.*" matches
+// "animals.cats" but not "animals.cats.big", whereas "animals.>" matches both.
+type topicPattern struct {
+	tokens []string
+}
+
+func parseTopicPattern(pattern string) (topicPattern, error) {
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return topicPattern{}, fmt.Errorf("topic pattern %q has an empty token", pattern)
+		case token == multiTokenWildcard && i != len(tokens)-1:
+			return topicPattern{}, fmt.Errorf("topic pattern %q has %q before its last token", pattern, multiTokenWildcard)
+		case token != singleTokenWildcard && token != multiTokenWildcard && strings.ContainsAny(token, singleTokenWildcard+multiTokenWildcard):
+			return topicPattern{}, fmt.Errorf("topic pattern %q has a wildcard within token %q", pattern, token)
+		}
+	}
+	return topicPattern{tokens: tokens}, nil
+}
+
+// ValidateTopicPattern returns an error describing why the pattern isn't a valid topic name or
+// pattern, if it isn't.
+func ValidateTopicPattern(pattern string) error {
+	_, err := parseTopicPattern(pattern)
+	return err
+}
+
+func (p topicPattern) String() string {
+	return strings.Join(p.tokens, ".")
+}
+
+// Whether the pattern has no wildcards, so names exactly one topic.
+func (p topicPattern) isExact() bool {
+	for _, token := range p.tokens {
+		if token == singleTokenWildcard || token == multiTokenWildcard {
+			return false
+		}
+	}
+	return true
+}
+
+func (p topicPattern) match(topicName string) bool {
+	if !p.isExact() && strings.HasPrefix(topicName, internalTopicPrefix) {
+		return false
+	}
+
+	nameTokens := strings.Split(topicName, ".")
+	for i, token := range p.tokens {
+		if token == multiTokenWildcard {
+			return len(nameTokens) > i
+		}
+		if i >= len(nameTokens) || (token != singleTokenWildcard && token != nameTokens[i]) {
+			return false
+		}
+	}
+	return len(nameTokens) == len(p.tokens)
+}
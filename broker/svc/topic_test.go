@@ -0,0 +1,213 @@
+package svc
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	commonerrors "pubsub/common/errors"
+)
+
+// Each batch published to a sticky topic goes to a single partition, even while other batches are
+// published concurrently.
+func TestTopicPublishStickyBatches(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 4, PartitionStrategy: StickyPartition})
+	const publishers, batches, batchSize = 8, 200, 5
+
+	var wg sync.WaitGroup
+	for p := range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range batches {
+				batch := make([]Message, batchSize)
+				for i := range batch {
+					batch[i] = Message{Payload: fmt.Appendf(nil, "%d-%d", p, n)}
+				}
+				if err := b.Publish("t", batch...); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	subscriberID, err := b.Subscribe("t", "g", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := b.Poll(subscriberID, PollLimits{MaxMessages: publishers * batches * batchSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != publishers*batches*batchSize {
+		t.Fatalf("polled %d messages, want %d", len(msgs), publishers*batches*batchSize)
+	}
+	partitionsByBatch := map[string]map[int]bool{}
+	for _, m := range msgs {
+		batch := string(m.Payload)
+		if partitionsByBatch[batch] == nil {
+			partitionsByBatch[batch] = map[int]bool{}
+		}
+		partitionsByBatch[batch][m.ID.Partition] = true
+	}
+	for batch, partitions := range partitionsByBatch {
+		if len(partitions) != 1 {
+			t.Errorf("batch %s was published to partitions %v", batch, partitions)
+		}
+	}
+}
+
+// Partitions can only be added to topics partitioned by key, which moves most keys, once it's
+// allowed. Consistent hashing only moves keys to the new partitions, so is always allowed.
+func TestUpdateTopicPartitions(t *testing.T) {
+	for _, strategy := range []PartitionStrategy{HashPartition, RoundRobinPartition, StickyPartition, KeyRangePartition, Murmur2Partition, ConsistentHashPartition} {
+		topicDef := TopicDefinition{Name: "t", NumberOfPartitions: 1, PartitionStrategy: strategy}
+		b := mustNewBroker(t, topicDef)
+		topicDef.NumberOfPartitions = 2
+		if strategy == KeyRangePartition {
+			topicDef.KeySplitPoints = []string{"m"}
+		}
+		err := b.UpdateTopic(topicDef)
+		if allowed := strategy == RoundRobinPartition || strategy == StickyPartition || strategy == ConsistentHashPartition; (err == nil) != allowed {
+			t.Errorf("%s: adding partitions got %v, want allowed %t", strategy, err, allowed)
+		}
+
+		topicDef.AllowKeyRemapping = true
+		if err := b.UpdateTopic(topicDef); err != nil {
+			t.Errorf("%s: adding partitions with key remapping allowed: %v", strategy, err)
+		}
+		if info, err := b.TopicInfo("t"); err != nil || info.NumberOfPartitions != 2 {
+			t.Errorf("%s: got %d partitions (%v), want 2", strategy, info.NumberOfPartitions, err)
+		}
+	}
+}
+
+// Publishes of single messages and batches to a hash partitioned topic by concurrent publishers.
+func BenchmarkPublish(b *testing.B) {
+	for _, partitions := range []int{1, 4, 16, 64} {
+		for _, publishers := range []int{1, 4, 16} {
+			for _, batchSize := range []int{1, 10} {
+				b.Run(fmt.Sprintf("partitions=%d/publishers=%d/batch=%d", partitions, publishers, batchSize), func(b *testing.B) {
+					br := mustNewBroker(b, TopicDefinition{Name: "t", NumberOfPartitions: partitions})
+					payload := make([]byte, 100)
+					batches := make([][]Message, publishers)
+					published := make([]int, publishers)
+					for p := range batches {
+						batches[p] = make([]Message, batchSize)
+					}
+					b.ReportAllocs()
+					runConcurrently(b, publishers, func(publisher int) {
+						batch := batches[publisher]
+						for i := range batch {
+							batch[i] = Message{Key: strconv.Itoa(publisher<<32 + published[publisher] + i), Payload: payload}
+						}
+						published[publisher] += batchSize
+						if err := br.Publish("t", batch...); err != nil {
+							b.Error(err)
+						}
+					})
+					b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "msgs/s")
+				})
+			}
+		}
+	}
+}
+
+// Every message published to a compacted topic needs a key, and a batch with any missing is
+// rejected whole.
+func TestPublishCompactedKeys(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 1, CleanupPolicy: CompactCleanup})
+	err := b.Publish("t", Message{Key: "a"}, Message{}, Message{Key: "b"}, Message{Payload: []byte("p")})
+	invalidArgument := commonerrors.InvalidArgument{}
+	if !errors.As(err, &invalidArgument) {
+		t.Fatalf("publishing messages without keys got %v, want invalid argument", err)
+	}
+	var fields []string
+	for _, violation := range invalidArgument.FieldViolations {
+		fields = append(fields, violation.Field)
+	}
+	if want := []string{"messages[1].key", "messages[3].key"}; !slices.Equal(fields, want) || !hasFieldViolation(err, "REQUIRED_FIELD") {
+		t.Errorf("got violations of %q, want %q", fields, want)
+	}
+
+	subscriberID, err := b.Subscribe("t", "g", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs := mustPoll(t, b, subscriberID, 10); len(msgs) != 0 {
+		t.Errorf("polled %d messages of the rejected batch, want none", len(msgs))
+	}
+}
+
+// Messages published to an explicit partition go to it whatever the topic's partitioner would
+// choose, and those giving a partition the topic doesn't have reject the batch.
+func TestPublishExplicitPartitions(t *testing.T) {
+	b := mustNewBroker(t, TopicDefinition{Name: "t", NumberOfPartitions: 3, PartitionStrategy: KeyRangePartition, KeySplitPoints: []string{"g", "n"}})
+	first, last := 0, 2
+	if err := b.Publish("t",
+		Message{Key: "z", Payload: []byte("explicit"), Partition: &first},
+		Message{Key: "a", Payload: []byte("explicit"), Partition: &last},
+		Message{Key: "z", Payload: []byte("partitioned")},
+	); err != nil {
+		t.Fatal(err)
+	}
+	subscriberID, err := b.Subscribe("t", "g", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := mustPoll(t, b, subscriberID, 10)
+	if len(msgs) != 3 {
+		t.Fatalf("polled %d messages, want 3", len(msgs))
+	}
+	for _, message := range msgs {
+		want := first
+		if message.Key == "a" || string(message.Payload) == "partitioned" {
+			want = last
+		}
+		if message.ID.Partition != want {
+			t.Errorf("%s message with key %q published to partition %d, want %d", message.Payload, message.Key, message.ID.Partition, want)
+		}
+		if message.Partition != nil {
+			t.Errorf("polled a message with the partition it was published to set")
+		}
+	}
+
+	if err := b.MoveOffset(subscriberID, len(msgs)); err != nil {
+		t.Fatal(err)
+	}
+
+	negative, beyond := -1, 3
+	err = b.Publish("t",
+		Message{Key: "a", Partition: &negative},
+		Message{Key: "a", Partition: &last},
+		Message{Key: "a", Partition: &beyond},
+		Message{Key: "a"},
+	)
+	invalidArgument := commonerrors.InvalidArgument{}
+	if !errors.As(err, &invalidArgument) {
+		t.Fatalf("publishing to partitions the topic doesn't have got %v, want invalid argument", err)
+	}
+	var violations []string
+	for _, violation := range invalidArgument.FieldViolations {
+		violations = append(violations, violation.Field+" "+violation.Reason)
+	}
+	if want := []string{"messages[0].partition BELOW_MIN_VALUE", "messages[2].partition ABOVE_MAX_VALUE"}; !slices.Equal(violations, want) {
+		t.Errorf("got violations %q, want %q", violations, want)
+	}
+	if msgs := mustPoll(t, b, subscriberID, 10); len(msgs) != 0 {
+		t.Errorf("polled %d messages of the rejected batch, want none", len(msgs))
+	}
+
+	// The partitions are validated against the topic's current number of partitions.
+	if err := b.UpdateTopic(TopicDefinition{Name: "t", NumberOfPartitions: 4, PartitionStrategy: KeyRangePartition, KeySplitPoints: []string{"g", "n", "t"}, AllowKeyRemapping: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("t", Message{Key: "a", Partition: &beyond}); err != nil {
+		t.Errorf("publishing to an added partition: %v", err)
+	}
+}
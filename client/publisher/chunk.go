@@ -0,0 +1,58 @@
+package publisher
+
+import (
+	"errors"
+	"maps"
+	"strconv"
+
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/proto"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/common/headers"
+)
+
+var errRetainedTooLarge = errors.New("retained message is larger than the maximum message size, so can't be chunked")
+
+// Split the message into chunks no larger than the Broker's maximum message size, if it's larger.
+// Chunks share the message's key and a chunk ID, so they're stored on the same partition.
+func (p *Publisher) split(message *brokerpb.Message) ([]*brokerpb.Message, error) {
+	if proto.Size(message) <= p.maxMessageSize {
+		return []*brokerpb.Message{message}, nil
+	}
+	if message.GetRetain() {
+		return nil, errRetainedTooLarge
+	}
+
+	payload := message.GetPayload()
+	chunkHeaders := maps.Clone(message.GetHeaders())
+	if chunkHeaders == nil {
+		chunkHeaders = make(map[string]string, 3)
+	}
+	chunkHeaders[headers.ChunkID] = uuid.NewV4().String()
+
+	// Measure a chunk without its payload, with the largest index and count it could have, to
+	// find how much of the payload fits in each.
+	chunkHeaders[headers.ChunkIndex] = strconv.Itoa(len(payload))
+	chunkHeaders[headers.ChunkCount] = strconv.Itoa(len(payload))
+	template := proto.CloneOf(message)
+	template.SetHeaders(chunkHeaders)
+	template.ClearPayload()
+	chunkSize := p.maxMessageSize - proto.Size(template) - messageOverhead
+	if chunkSize <= 0 {
+		return nil, errors.New("message is larger than the maximum message size without its payload")
+	}
+
+	count := (len(payload) + chunkSize - 1) / chunkSize
+	chunks := make([]*brokerpb.Message, count)
+	for i := range count {
+		indexHeaders := maps.Clone(chunkHeaders)
+		indexHeaders[headers.ChunkIndex] = strconv.Itoa(i)
+		indexHeaders[headers.ChunkCount] = strconv.Itoa(count)
+
+		chunks[i] = proto.CloneOf(template)
+		chunks[i].SetHeaders(indexHeaders)
+		chunks[i].SetPayload(payload[i*chunkSize : min((i+1)*chunkSize, len(payload))])
+	}
+	return chunks, nil
+}
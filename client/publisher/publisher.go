@@ -0,0 +1,450 @@
+// Package publisher publishes messages to a topic of the Broker asynchronously, batching them
+// together and compressing the batches.
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/common/compression"
+	commonerrors "pubsub/common/errors"
+)
+
+const (
+	defaultBatchSize    = 100
+	defaultLinger       = 10 * time.Millisecond
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 100 * time.Millisecond
+	// How many full batches can wait to be sent before Publish blocks.
+	maxQueuedBatches = 16
+	// Bytes of a publish request besides its topic and messages, and of each message besides its
+	// encoded fields.
+	requestOverhead = 64
+	messageOverhead = 6
+)
+
+var errPublisherClosed = errors.New("publisher is closed")
+
+type Config struct {
+	// A batch is sent once it holds this many messages, or would exceed the Broker's maximum request
+	// size. Defaults to 100.
+	BatchSize int `koanf:"batch_size"`
+	// How long a batch waits for more messages before it's sent. Defaults to 10ms.
+	Linger time.Duration `koanf:"linger"`
+	// Name of the codec batches are compressed with, if the Broker supports it. Batches are sent
+	// uncompressed if it's empty or unsupported.
+	Compression string `koanf:"compression"`
+	// Whether each message's payload is compressed with the codec instead of the whole batch, so
+	// the Broker stores the payloads compressed.
+	CompressPayloads bool `koanf:"compress_payloads"`
+	// How many times a batch is resent while the Broker is unavailable. Defaults to 3.
+	MaxRetries int `koanf:"max_retries"`
+	// How long to wait before resending a batch, doubling after each retry. Defaults to 100ms.
+	RetryBackoff time.Duration `koanf:"retry_backoff"`
+}
+
+// A Publisher publishes messages to a topic. Messages are sent in the order they're published.
+type Publisher struct {
+	client      brokerpb.BrokerClient
+	topic       string
+	cfg         Config
+	compression string
+	codec       compression.Codec
+	// Limits of the Broker, in bytes.
+	maxMessageSize int
+	maxRequestSize int
+
+	mutex      sync.Mutex
+	batch      []pending
+	batchBytes int
+	timer      *time.Timer
+	closed     bool
+	// Incremented each time a batch is started, so a linger timer only sends its own batch.
+	generation int
+	// Batches flushed but not yet queued to be sent, oldest first. They're queued without holding
+	// the mutex, so waiting for a batch to be sent doesn't block adding messages to the next.
+	flushed [][]pending
+
+	batches chan []pending
+	// Held while queueing the flushed batches, so they're queued in order.
+	queueing chan struct{}
+	// Closed once closing, so batches are left for Close to queue.
+	closing chan struct{}
+	// Cancels sends still in progress when closing times out.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type pending struct {
+	message *brokerpb.Message
+	result  *Result
+}
+
+// A Result reports whether a message was published.
+type Result struct {
+	done chan struct{}
+
+	mutex sync.Mutex
+	// How many of the message's chunks are still to be sent.
+	remaining int
+	err       error
+}
+
+func newResult(chunks int) *Result {
+	return &Result{
+		done:      make(chan struct{}),
+		remaining: chunks,
+	}
+}
+
+// Done is closed once the message has been published or has failed to be.
+func (r *Result) Done() <-chan struct{} {
+	return r.done
+}
+
+// Get waits for the message to be published, returning why it wasn't if it failed.
+func (r *Result) Get(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+		return r.err
+	}
+}
+
+// Record that one of the message's chunks was sent, or failed to be.
+func (r *Result) complete(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err == nil {
+		r.err = err
+	}
+	r.remaining--
+	if r.remaining == 0 {
+		close(r.done)
+	}
+}
+
+// New creates a Publisher of the topic, negotiating its limits and compression with the Broker.
+// The client should
+// convert errors with the grpcerrors.UnaryClientInterceptor, so unavailable errors are retried.
+func New(ctx context.Context, client brokerpb.BrokerClient, topic string, cfg Config) (*Publisher, error) {
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.Linger == 0 {
+		cfg.Linger = defaultLinger
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = defaultRetryBackoff
+	}
+
+	sendCtx, cancel := context.WithCancel(context.Background())
+	p := &Publisher{
+		client:   client,
+		topic:    topic,
+		cfg:      cfg,
+		batches:  make(chan []pending, maxQueuedBatches),
+		queueing: make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		ctx:      sendCtx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	if err := p.negotiate(ctx); err != nil {
+		cancel()
+		return nil, fmt.Errorf("creating publisher: %w", err)
+	}
+
+	go p.send()
+	return p, nil
+}
+
+// Adopt the Broker's and topic's limits, and use the configured codec if both the Broker and the Publisher
+// support it.
+func (p *Publisher) negotiate(ctx context.Context) error {
+	info, err := p.client.GetServerInfo(ctx, &emptypb.Empty{})
+	if err != nil {
+		return fmt.Errorf("negotiating with broker: %w", err)
+	}
+	p.maxRequestSize = int(info.GetMaxRequestSize())
+	topicInfo, err := p.client.GetTopicInfo(ctx, brokerpb.GetTopicInfoRequest_builder{
+		Topic: &p.topic,
+	}.Build())
+	if err != nil {
+		return fmt.Errorf("negotiating with broker: %w", err)
+	}
+	p.maxMessageSize = int(topicInfo.GetMaxMessageSize())
+
+	if p.cfg.Compression == "" {
+		return nil
+	}
+	codec, ok := compression.Lookup(p.cfg.Compression)
+	if !ok || !slices.Contains(info.GetCompressions(), p.cfg.Compression) {
+		slog.Warn("Compression unsupported, publishing uncompressed", slog.String("compression", p.cfg.Compression), slog.Any("broker_compressions", info.GetCompressions()))
+		return nil
+	}
+	p.compression = p.cfg.Compression
+	p.codec = codec
+	return nil
+}
+
+// Publish adds the message to the current batch, returning a Result which reports once it's been
+// published. Messages larger than the Broker's maximum message size are split into chunks, which
+// subscribers reassemble. Publish blocks while too many batches are waiting to be sent, until the
+// context is done, in which case the message is still sent with a later batch.
+func (p *Publisher) Publish(ctx context.Context, message *brokerpb.Message) *Result {
+	if err := ctx.Err(); err != nil {
+		result := newResult(1)
+		result.complete(err)
+		return result
+	}
+
+	chunks, err := p.prepare(message)
+	if err != nil {
+		result := newResult(1)
+		result.complete(fmt.Errorf("publishing: %w", err))
+		return result
+	}
+	result := newResult(len(chunks))
+
+	p.mutex.Lock()
+	for _, chunk := range chunks {
+		if p.closed {
+			result.complete(errPublisherClosed)
+			continue
+		}
+		p.add(pending{message: chunk, result: result})
+	}
+	p.mutex.Unlock()
+
+	p.queue(ctx)
+	return result
+}
+
+// Compress the message's payload if configured to, then split it into chunks if it's too large.
+func (p *Publisher) prepare(message *brokerpb.Message) ([]*brokerpb.Message, error) {
+	if p.codec != nil && p.cfg.CompressPayloads && !message.HasCompression() {
+		payload, err := p.codec.Compress(message.GetPayload())
+		if err != nil {
+			return nil, fmt.Errorf("compressing payload: %w", err)
+		}
+		message = proto.CloneOf(message)
+		message.SetPayload(payload)
+		message.SetCompression(p.compression)
+	}
+	return p.split(message)
+}
+
+// Add the message to the current batch, sending the batch first if the message wouldn't fit in
+// the request. The mutex must be held.
+func (p *Publisher) add(pending pending) {
+	size := proto.Size(pending.message) + messageOverhead
+	if len(p.batch) != 0 && p.batchBytes+size > p.maxRequestSize-len(p.topic)-requestOverhead {
+		p.flush()
+	}
+
+	p.batch = append(p.batch, pending)
+	p.batchBytes += size
+	switch {
+	case len(p.batch) >= p.cfg.BatchSize:
+		p.flush()
+	case len(p.batch) == 1:
+		p.generation++
+		generation := p.generation
+		p.timer = time.AfterFunc(p.cfg.Linger, func() {
+			p.mutex.Lock()
+			if p.generation == generation && !p.closed {
+				p.flush()
+			}
+			p.mutex.Unlock()
+
+			p.queue(p.ctx)
+		})
+	}
+}
+
+// Flush the current batch, for queue to send. The mutex must be held.
+func (p *Publisher) flush() {
+	if len(p.batch) == 0 {
+		return
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.generation++
+	p.flushed = append(p.flushed, p.batch)
+	p.batch = nil
+	p.batchBytes = 0
+}
+
+// Queue the flushed batches to be sent, oldest first, waiting while too many batches are queued
+// until ctx is done or the publisher is closing. Any batches left are queued by the next call, or
+// by Close. The mutex mustn't be held.
+func (p *Publisher) queue(ctx context.Context) {
+	select {
+	case p.queueing <- struct{}{}:
+	case <-ctx.Done():
+		return
+	case <-p.closing:
+		return
+	}
+	defer func() { <-p.queueing }()
+
+	for {
+		p.mutex.Lock()
+		if len(p.flushed) == 0 {
+			p.mutex.Unlock()
+			return
+		}
+		batch := p.flushed[0]
+		p.mutex.Unlock()
+
+		select {
+		case p.batches <- batch:
+		case <-ctx.Done():
+			return
+		case <-p.closing:
+			return
+		}
+
+		p.mutex.Lock()
+		p.flushed = p.flushed[1:]
+		p.mutex.Unlock()
+	}
+}
+
+// Send the queued batches one at a time, so messages are published in order.
+func (p *Publisher) send() {
+	defer close(p.done)
+
+	for batch := range p.batches {
+		err := p.sendBatch(batch)
+		for _, pending := range batch {
+			pending.result.complete(err)
+		}
+	}
+}
+
+func (p *Publisher) sendBatch(batch []pending) error {
+	request, err := p.buildRequest(batch)
+	if err != nil {
+		return fmt.Errorf("publishing: %w", err)
+	}
+
+	backoff := p.cfg.RetryBackoff
+	for retry := 0; ; retry++ {
+		_, err := p.client.Publish(p.ctx, request)
+		if err == nil {
+			return nil
+		}
+		unavailable := commonerrors.Unavailable{}
+		if !errors.As(err, &unavailable) || retry == p.cfg.MaxRetries {
+			return fmt.Errorf("publishing: %w", err)
+		}
+
+		slog.Debug("Broker unavailable, retrying publish", slog.Any("error", err), slog.Duration("backoff", backoff))
+		select {
+		case <-p.ctx.Done():
+			return fmt.Errorf("publishing: %w", p.ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (p *Publisher) buildRequest(batch []pending) (*brokerpb.PublishRequest, error) {
+	messages := make([]*brokerpb.Message, len(batch))
+	for i, pending := range batch {
+		messages[i] = pending.message
+	}
+	if p.codec == nil || p.cfg.CompressPayloads {
+		return brokerpb.PublishRequest_builder{
+			Topic:    &p.topic,
+			Messages: messages,
+		}.Build(), nil
+	}
+
+	data, err := proto.Marshal(brokerpb.MessageBatch_builder{
+		Messages: messages,
+	}.Build())
+	if err != nil {
+		return nil, fmt.Errorf("marshalling batch: %w", err)
+	}
+	compressed, err := p.codec.Compress(data)
+	if err != nil {
+		return nil, fmt.Errorf("compressing batch: %w", err)
+	}
+	return brokerpb.PublishRequest_builder{
+		Topic:              &p.topic,
+		Compression:        &p.compression,
+		CompressedMessages: compressed,
+	}.Build(), nil
+}
+
+// Close sends the current batch and waits for every batch to be sent. If the context is done
+// first, the batches still being sent are cancelled, and those not yet queued fail.
+func (p *Publisher) Close(ctx context.Context) error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return errPublisherClosed
+	}
+	p.closed = true
+	p.flush()
+	p.mutex.Unlock()
+
+	// Once any Publish queueing batches has given up, queue the rest. Nothing is flushed once
+	// closed.
+	close(p.closing)
+	p.queueing <- struct{}{}
+	p.mutex.Lock()
+	flushed := p.flushed
+	p.flushed = nil
+	p.mutex.Unlock()
+	err := ctx.Err()
+	for _, batch := range flushed {
+		if err == nil {
+			select {
+			case p.batches <- batch:
+				continue
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		for _, pending := range batch {
+			pending.result.complete(fmt.Errorf("closing publisher: %w", err))
+		}
+	}
+	close(p.batches)
+
+	defer p.cancel()
+	if err != nil {
+		p.cancel()
+		<-p.done
+		return fmt.Errorf("closing publisher: %w", err)
+	}
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-p.done
+		return fmt.Errorf("closing publisher: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,96 @@
+package publisher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	brokerpb "pubsub/broker/proto/broker"
+)
+
+// A brokerClient records the payloads published, blocking each publish until released.
+type brokerClient struct {
+	brokerpb.BrokerClient
+
+	release chan struct{}
+
+	mutex     sync.Mutex
+	published []string
+}
+
+func (c *brokerClient) GetServerInfo(context.Context, *emptypb.Empty, ...grpc.CallOption) (*brokerpb.ServerInfo, error) {
+	return brokerpb.ServerInfo_builder{MaxRequestSize: proto.Int32(4 << 20)}.Build(), nil
+}
+
+func (c *brokerClient) GetTopicInfo(context.Context, *brokerpb.GetTopicInfoRequest, ...grpc.CallOption) (*brokerpb.TopicInfo, error) {
+	return brokerpb.TopicInfo_builder{MaxMessageSize: proto.Int32(1 << 20)}.Build(), nil
+}
+
+func (c *brokerClient) Publish(ctx context.Context, request *brokerpb.PublishRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	select {
+	case <-c.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, message := range request.GetMessages() {
+		c.published = append(c.published, string(message.GetPayload()))
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// Publish stops waiting for a batch to be queued once its context is done, without holding up
+// other publishes, and the batch is still sent in order.
+func TestPublishQueueFull(t *testing.T) {
+	client := &brokerClient{release: make(chan struct{})}
+	p, err := New(context.Background(), client, "t", Config{BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One batch being sent, and the rest queued.
+	var results []*Result
+	var want []string
+	publish := func(ctx context.Context) {
+		payload := string(rune('a' + len(want)))
+		results = append(results, p.Publish(ctx, brokerpb.Message_builder{Payload: []byte(payload)}.Build()))
+		want = append(want, payload)
+	}
+	for range maxQueuedBatches + 1 {
+		publish(context.Background())
+	}
+	for range 2 {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		publish(ctx)
+		cancel()
+	}
+	select {
+	case <-results[len(results)-1].Done():
+		t.Fatal("message published while the queue was full")
+	default:
+	}
+
+	close(client.release)
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if err := result.Get(context.Background()); err != nil {
+			t.Errorf("message %d: %v", i, err)
+		}
+	}
+	if len(client.published) != len(want) {
+		t.Fatalf("published %v, want %v", client.published, want)
+	}
+	for i := range want {
+		if client.published[i] != want[i] {
+			t.Fatalf("published %v, want %v", client.published, want)
+		}
+	}
+}
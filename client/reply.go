@@ -0,0 +1,41 @@
+// Package client provides helpers for clients of the Broker.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+
+	"google.golang.org/protobuf/proto"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/common/headers"
+)
+
+var errNotARequest = errors.New("message has no reply topic, so wasn't sent as a request")
+
+// Reply publishes the reply to the reply topic of the request, which must have been sent using the
+// Broker's Request RPC. The request's correlation ID is added to the reply's headers.
+func Reply(ctx context.Context, client brokerpb.BrokerClient, request, reply *brokerpb.Message) error {
+	replyTo, ok := request.GetHeaders()[headers.ReplyTo]
+	if !ok {
+		return errNotARequest
+	}
+
+	replyHeaders := maps.Clone(reply.GetHeaders())
+	if replyHeaders == nil {
+		replyHeaders = make(map[string]string, 1)
+	}
+	replyHeaders[headers.CorrelationID] = request.GetHeaders()[headers.CorrelationID]
+
+	reply = proto.Clone(reply).(*brokerpb.Message)
+	reply.SetHeaders(replyHeaders)
+	if _, err := client.Publish(ctx, brokerpb.PublishRequest_builder{
+		Topic:    &replyTo,
+		Messages: []*brokerpb.Message{reply},
+	}.Build()); err != nil {
+		return fmt.Errorf("replying: %w", err)
+	}
+	return nil
+}
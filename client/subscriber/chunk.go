@@ -0,0 +1,111 @@
+package subscriber
+
+import (
+	"bytes"
+	"log/slog"
+	"maps"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/common/headers"
+)
+
+// The chunks received of a payload which was too large for a single message.
+type chunkedMessage struct {
+	chunks   []*brokerpb.Message
+	received int
+	// Bytes of the payload received.
+	bytes int
+	// When the first chunk was received.
+	started time.Time
+}
+
+// Add the chunk to those received of its payload, returning the reassembled message and the IDs
+// of its chunks once every chunk has been received. Messages which aren't chunks, or have invalid
+// chunk headers, are returned as they are.
+func (sess *session) assemble(message *brokerpb.Message) (*brokerpb.Message, []*brokerpb.MessageId, bool) {
+	ids := []*brokerpb.MessageId{}
+	if message.HasId() {
+		ids = append(ids, message.GetId())
+	}
+	chunkID, ok := message.GetHeaders()[headers.ChunkID]
+	if !ok {
+		return message, ids, true
+	}
+
+	index, indexErr := strconv.Atoi(message.GetHeaders()[headers.ChunkIndex])
+	count, countErr := strconv.Atoi(message.GetHeaders()[headers.ChunkCount])
+	chunked, ok := sess.chunks[chunkID]
+	if !ok && countErr == nil && count > 0 {
+		chunked = &chunkedMessage{
+			chunks:  make([]*brokerpb.Message, count),
+			started: time.Now(),
+		}
+		sess.chunks[chunkID] = chunked
+	}
+	if indexErr != nil || countErr != nil || chunked == nil || count != len(chunked.chunks) || index < 0 || index >= count {
+		slog.Warn("Invalid chunk headers, handling the chunk as it is", slog.Any("message_id", message.GetId()), slog.Any("headers", message.GetHeaders()))
+		return message, ids, true
+	}
+
+	if chunked.chunks[index] == nil {
+		chunked.received++
+		chunked.bytes += len(message.GetPayload())
+		sess.chunkBytes += len(message.GetPayload())
+	}
+	chunked.chunks[index] = message
+	if chunked.received != count {
+		return nil, nil, false
+	}
+	delete(sess.chunks, chunkID)
+	sess.chunkBytes -= chunked.bytes
+
+	var payload bytes.Buffer
+	ids = ids[:0]
+	for _, chunk := range chunked.chunks {
+		payload.Write(chunk.GetPayload())
+		ids = append(ids, chunk.GetId())
+	}
+	messageHeaders := maps.Clone(message.GetHeaders())
+	delete(messageHeaders, headers.ChunkID)
+	delete(messageHeaders, headers.ChunkIndex)
+	delete(messageHeaders, headers.ChunkCount)
+
+	reassembled := proto.CloneOf(chunked.chunks[0])
+	reassembled.SetPayload(payload.Bytes())
+	reassembled.SetHeaders(messageHeaders)
+	return reassembled, ids, true
+}
+
+// Drop the payloads whose chunks have been held for longer than the chunk timeout, and then the
+// oldest until the chunks held are within the maximum. Their chunks are released, so they're
+// reassembled if they're redelivered: by the next poll of a partitioned subscriber, or once the
+// ack timeout passes for a shared one. The mutex must be held.
+func (sess *session) evictChunks(now time.Time) {
+	for len(sess.chunks) != 0 {
+		var (
+			oldestID string
+			oldest   *chunkedMessage
+		)
+		for chunkID, chunked := range sess.chunks {
+			if oldest == nil || chunked.started.Before(oldest.started) {
+				oldestID, oldest = chunkID, chunked
+			}
+		}
+		if now.Sub(oldest.started) < sess.cfg.ChunkTimeout && sess.chunkBytes <= sess.cfg.MaxChunkBytes {
+			return
+		}
+
+		slog.Warn("Dropping incomplete chunked payload, leaving its chunks for redelivery", slog.String("chunk_id", oldestID), slog.Int("received", oldest.received), slog.Int("count", len(oldest.chunks)))
+		delete(sess.chunks, oldestID)
+		sess.chunkBytes -= oldest.bytes
+		for _, chunk := range oldest.chunks {
+			if chunk != nil && chunk.HasId() {
+				delete(sess.pending, keyOf(chunk.GetId()))
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package subscriber
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/common/headers"
+)
+
+func newTestSession(cfg Config) *session {
+	return &session{
+		Subscriber: New(nil, "t", "g", cfg),
+		pending:    map[messageKey]struct{}{},
+		chunks:     map[string]*chunkedMessage{},
+	}
+}
+
+// A chunk of the payload, as polled and so held as pending.
+func pollChunk(sess *session, chunkID string, offset int64, index, count int, payload string) *brokerpb.Message {
+	message := brokerpb.Message_builder{
+		Id: brokerpb.MessageId_builder{
+			Topic:  toPtr("t"),
+			Offset: &offset,
+		}.Build(),
+		Payload: []byte(payload),
+		Headers: map[string]string{
+			headers.ChunkID:    chunkID,
+			headers.ChunkIndex: strconv.Itoa(index),
+			headers.ChunkCount: strconv.Itoa(count),
+		},
+	}.Build()
+	sess.pending[keyOf(message.GetId())] = struct{}{}
+	return message
+}
+
+func TestAssemble(t *testing.T) {
+	sess := newTestSession(Config{})
+	if _, _, ok := sess.assemble(pollChunk(sess, "x", 1, 1, 2, "world")); ok {
+		t.Fatal("assembled a payload missing its first chunk")
+	}
+	message, ids, ok := sess.assemble(pollChunk(sess, "x", 0, 0, 2, "hello "))
+	if !ok {
+		t.Fatal("didn't assemble a complete payload")
+	}
+	if string(message.GetPayload()) != "hello world" || len(message.GetHeaders()) != 0 {
+		t.Errorf("assembled %q with headers %v, want %q without chunk headers", message.GetPayload(), message.GetHeaders(), "hello world")
+	}
+	if len(ids) != 2 || ids[0].GetOffset() != 0 || ids[1].GetOffset() != 1 {
+		t.Errorf("got chunk IDs %v, want offsets 0 and 1", ids)
+	}
+	if len(sess.chunks) != 0 || sess.chunkBytes != 0 {
+		t.Errorf("still holding %d payloads of %d bytes", len(sess.chunks), sess.chunkBytes)
+	}
+}
+
+// Incomplete payloads are dropped once they're too old, or the chunks held are too large, and their
+// chunks released so they're reassembled if redelivered.
+func TestEvictChunks(t *testing.T) {
+	sess := newTestSession(Config{ChunkTimeout: time.Minute, MaxChunkBytes: 10})
+	sess.assemble(pollChunk(sess, "old", 0, 0, 2, "12345"))
+	sess.chunks["old"].started = time.Now().Add(-2 * time.Minute)
+	sess.assemble(pollChunk(sess, "a", 1, 0, 2, "12345"))
+	sess.chunks["a"].started = time.Now().Add(-time.Second)
+	sess.assemble(pollChunk(sess, "b", 2, 0, 3, "12345"))
+
+	// The payload held for longer than the timeout is dropped, which leaves the rest within the
+	// maximum bytes.
+	sess.evictChunks(time.Now())
+	if _, ok := sess.chunks["old"]; ok || len(sess.chunks) != 2 || sess.chunkBytes != 10 {
+		t.Fatalf("holding payloads %v of %d bytes, want a and b of 10 bytes", sess.chunks, sess.chunkBytes)
+	}
+	if _, ok := sess.pending[messageKey{topic: "t", offset: 0}]; ok {
+		t.Error("dropped chunk still pending")
+	}
+
+	// The oldest payload is dropped once the chunks held exceed the maximum bytes.
+	sess.assemble(pollChunk(sess, "b", 3, 1, 3, "1"))
+	sess.evictChunks(time.Now())
+	if _, ok := sess.chunks["a"]; ok || len(sess.chunks) != 1 || sess.chunkBytes != 6 {
+		t.Fatalf("holding payloads %v of %d bytes, want b of 6 bytes", sess.chunks, sess.chunkBytes)
+	}
+	if _, ok := sess.pending[messageKey{topic: "t", offset: 1}]; ok {
+		t.Error("dropped chunk still pending")
+	}
+	if _, ok := sess.pending[messageKey{topic: "t", offset: 2}]; !ok {
+		t.Error("held chunk no longer pending")
+	}
+}
@@ -0,0 +1,352 @@
+package subscriber
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/common/compression"
+)
+
+// A session is a single subscription, lasting until the Receive context is done or the
+// subscription is lost.
+type session struct {
+	*Subscriber
+	subscriberID string
+	// Options of each poll.
+	pollOptions []grpc.CallOption
+
+	// Held while the subscriber becomes active or a standby, and the rebalance callbacks called.
+	transitionMutex sync.Mutex
+
+	mutex sync.Mutex
+	// Whether the subscriber is delivered messages, rather than standing by in a failover group.
+	active bool
+	// IDs of the messages handled but not yet acknowledged.
+	handled []*brokerpb.MessageId
+	// The messages received but not yet acknowledged, so they aren't handled again if they're
+	// redelivered in the meantime.
+	pending map[messageKey]struct{}
+	// Chunks received of payloads not yet reassembled, by chunk ID, and how many bytes they are.
+	chunks     map[string]*chunkedMessage
+	chunkBytes int
+}
+
+type messageKey struct {
+	topic     string
+	partition int32
+	offset    int64
+}
+
+func keyOf(id *brokerpb.MessageId) messageKey {
+	return messageKey{
+		topic:     id.GetTopic(),
+		partition: id.GetPartition(),
+		offset:    id.GetOffset(),
+	}
+}
+
+// A message to be handled, with the IDs of the messages acknowledged once it has been, which are
+// its chunks if it was reassembled.
+type delivery struct {
+	message *brokerpb.Message
+	ids     []*brokerpb.MessageId
+}
+
+// Receive messages for a single session, returning whether it subscribed and why it ended.
+func (s *Subscriber) receive(ctx context.Context, handler Handler) (bool, error) {
+	subscriberID, err := s.subscribe(ctx)
+	if err != nil {
+		return false, err
+	}
+	sess := &session{
+		Subscriber:   s,
+		subscriberID: subscriberID,
+		pending:      map[messageKey]struct{}{},
+		chunks:       map[string]*chunkedMessage{},
+	}
+
+	sessionCtx, cancel := context.WithCancelCause(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel(nil)
+		wg.Wait()
+		sess.shutdown(ctx)
+	}()
+
+	if err := sess.heartbeat(sessionCtx); err != nil {
+		return true, err
+	}
+	maxResponseSize, err := s.maxResponseSize(sessionCtx)
+	if err != nil {
+		return true, err
+	}
+	if maxResponseSize != 0 {
+		sess.pollOptions = append(sess.pollOptions, grpc.MaxCallRecvMsgSize(maxResponseSize))
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sess.every(sessionCtx, s.cfg.HeartbeatInterval, func() {
+			if err := sess.heartbeat(sessionCtx); err != nil {
+				cancel(err)
+			}
+		})
+	}()
+
+	// Committing between polls, rather than concurrently, means a message is never redelivered by
+	// a poll after it's been acknowledged and forgotten.
+	lastCommit := time.Now()
+	for sessionCtx.Err() == nil {
+		if time.Since(lastCommit) >= s.cfg.AutoCommitInterval {
+			if err := sess.commit(sessionCtx); err != nil {
+				cancel(err)
+				break
+			}
+			lastCommit = time.Now()
+		}
+
+		// Messages still pending may be redelivered, so poll enough to receive new messages too.
+		sess.mutex.Lock()
+		limit := s.cfg.MaxMessages + len(sess.pending)
+		sess.mutex.Unlock()
+
+		resp, err := s.client.Poll(sessionCtx, brokerpb.PollRequest_builder{
+			SubscriberId:      &subscriberID,
+			Limit:             toPtr(int32(limit)),
+			MaxBytes:          toPtr(int32(s.cfg.MaxBytes)),
+			PartitionMaxBytes: toPtr(int32(s.cfg.PartitionMaxBytes)),
+		}.Build(), sess.pollOptions...)
+		if err != nil {
+			cancel(fmt.Errorf("polling: %w", err))
+			break
+		}
+		if len(resp.GetMessages()) == 0 {
+			select {
+			case <-sessionCtx.Done():
+			case <-time.After(s.cfg.PollInterval):
+			}
+			continue
+		}
+
+		// Handlers are passed the Receive context rather than the session's, so they can finish
+		// when the session is lost.
+		retained := sess.handle(ctx, handler, resp.GetMessages())
+		if retained != 0 {
+			// Retained messages have no ID, so are acknowledged by moving the offset past them.
+			if _, err := s.client.MoveOffset(sessionCtx, brokerpb.MoveOffsetRequest_builder{
+				SubscriberId: &subscriberID,
+				Delta:        toPtr(int32(retained)),
+			}.Build()); err != nil {
+				cancel(fmt.Errorf("moving offset: %w", err))
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return true, nil
+	}
+	err = context.Cause(sessionCtx)
+	if s.partitioned() && hasPreconditionFailure(err, subscriberNotFound) {
+		return true, fmt.Errorf("%w: %w", errPartitionsReassigned, err)
+	}
+	return true, err
+}
+
+// Call f each interval until ctx is done.
+func (sess *session) every(ctx context.Context, interval time.Duration, f func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f()
+		}
+	}
+}
+
+// Handle the messages, running those with different keys concurrently and those with the same
+// key in order, and record which were handled. Chunks are held until their payload can be
+// reassembled. Returns how many of the retained messages the poll started with were handled.
+func (sess *session) handle(ctx context.Context, handler Handler, messages []*brokerpb.Message) int {
+	var keys []string
+	deliveriesByKey := map[string][]delivery{}
+	retained := 0
+	sess.mutex.Lock()
+	for _, message := range messages {
+		if message.HasId() {
+			if _, ok := sess.pending[keyOf(message.GetId())]; ok {
+				continue
+			}
+			sess.pending[keyOf(message.GetId())] = struct{}{}
+		} else if message.GetRetain() {
+			retained++
+		}
+
+		message, ids, ok := sess.assemble(message)
+		if !ok {
+			continue
+		}
+		if _, ok := deliveriesByKey[message.GetKey()]; !ok {
+			keys = append(keys, message.GetKey())
+		}
+		deliveriesByKey[message.GetKey()] = append(deliveriesByKey[message.GetKey()], delivery{message: message, ids: ids})
+	}
+	sess.evictChunks(time.Now())
+	sess.mutex.Unlock()
+
+	semaphore := make(chan struct{}, sess.cfg.Concurrency)
+	var wg sync.WaitGroup
+	var retainedMutex sync.Mutex
+	retainedFailed := false
+	for _, key := range keys {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			deliveries := deliveriesByKey[key]
+			for i, delivery := range deliveries {
+				if err := handler(ctx, decompress(delivery.message, sess.cfg.MaxChunkBytes)); err != nil {
+					slog.Warn("Handling message, leaving it for redelivery", slog.Any("error", err), slog.Any("message_id", delivery.message.GetId()))
+					if !delivery.message.HasId() {
+						retainedMutex.Lock()
+						retainedFailed = true
+						retainedMutex.Unlock()
+					}
+					// Later messages with the key are left too, to keep them in order.
+					sess.release(deliveries[i:])
+					return
+				}
+				sess.mutex.Lock()
+				sess.handled = append(sess.handled, delivery.ids...)
+				sess.mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if retainedFailed {
+		// Which retained messages were handled can't be acknowledged individually, so they're all
+		// redelivered.
+		return 0
+	}
+	return retained
+}
+
+// Stop holding the messages delivered, so they're handled again if they're redelivered.
+func (sess *session) release(deliveries []delivery) {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	for _, delivery := range deliveries {
+		for _, id := range delivery.ids {
+			delete(sess.pending, keyOf(id))
+		}
+	}
+}
+
+// The message with its payload decompressed, if it's compressed. Payloads which fail to decompress,
+// or would decompress to more than maxSize bytes, are left compressed, so the handler can decide
+// what to do with them.
+func decompress(message *brokerpb.Message, maxSize int) *brokerpb.Message {
+	if message.GetCompression() == "" {
+		return message
+	}
+
+	payload, err := compression.Decompress(message.GetCompression(), message.GetPayload(), maxSize)
+	if err != nil {
+		slog.Warn("Decompressing payload", slog.Any("error", err), slog.Any("message_id", message.GetId()))
+		return message
+	}
+	message = proto.CloneOf(message)
+	message.SetPayload(payload)
+	message.ClearCompression()
+	return message
+}
+
+// Acknowledge the messages handled since the last commit.
+func (sess *session) commit(ctx context.Context) error {
+	sess.mutex.Lock()
+	handled := sess.handled
+	sess.handled = nil
+	sess.mutex.Unlock()
+
+	if len(handled) == 0 {
+		return nil
+	}
+	_, err := sess.client.Acknowledge(ctx, brokerpb.AcknowledgeRequest_builder{
+		SubscriberId: &sess.subscriberID,
+		MessageIds:   handled,
+	}.Build())
+
+	// Whether or not the messages were acknowledged, they're handled again if redelivered.
+	sess.mutex.Lock()
+	for _, id := range handled {
+		delete(sess.pending, keyOf(id))
+	}
+	sess.mutex.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("acknowledging: %w", err)
+	}
+	return nil
+}
+
+// Send a heartbeat, calling the rebalance callbacks if the subscriber has become active or a
+// standby.
+func (sess *session) heartbeat(ctx context.Context) error {
+	resp, err := sess.client.Heartbeat(ctx, brokerpb.HeartbeatRequest_builder{
+		SubscriberId: &sess.subscriberID,
+	}.Build())
+	if err != nil {
+		return fmt.Errorf("sending heartbeat: %w", err)
+	}
+	sess.setActive(ctx, resp.GetActive())
+	return nil
+}
+
+func (sess *session) setActive(ctx context.Context, active bool) {
+	// Transitions are recorded and their callbacks called in turn, so the callbacks are called in
+	// the order of the transitions. The session's mutex isn't held while they're called, so they
+	// can wait on messages being handled.
+	sess.transitionMutex.Lock()
+	defer sess.transitionMutex.Unlock()
+
+	sess.mutex.Lock()
+	changed := active != sess.active
+	sess.active = active
+	sess.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+	if active && sess.cfg.OnAssigned != nil {
+		sess.cfg.OnAssigned(ctx)
+	} else if !active && sess.cfg.OnRevoked != nil {
+		sess.cfg.OnRevoked(ctx)
+	}
+}
+
+// Acknowledge any messages still to be, then revoke the subscriber.
+func (sess *session) shutdown(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sess.cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := sess.commit(ctx); err != nil {
+		slog.Warn("Acknowledging handled messages on shutdown", slog.Any("error", err))
+	}
+	sess.setActive(ctx, false)
+}
+
+func toPtr[P *T, T any](t T) P { return &t }
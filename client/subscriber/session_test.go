@@ -0,0 +1,31 @@
+package subscriber
+
+import (
+	"context"
+	"testing"
+)
+
+// The rebalance callbacks are called once per transition, without holding the session's mutex, so
+// they can wait on messages being handled.
+func TestSetActive(t *testing.T) {
+	var sess *session
+	var calls []string
+	sess = newTestSession(Config{
+		OnAssigned: func(context.Context) {
+			sess.mutex.Lock()
+			defer sess.mutex.Unlock()
+			calls = append(calls, "assigned")
+		},
+		OnRevoked: func(context.Context) {
+			sess.mutex.Lock()
+			defer sess.mutex.Unlock()
+			calls = append(calls, "revoked")
+		},
+	})
+	for _, active := range []bool{true, true, false, false, true} {
+		sess.setActive(context.Background(), active)
+	}
+	if len(calls) != 3 || calls[0] != "assigned" || calls[1] != "revoked" || calls[2] != "assigned" {
+		t.Errorf("got calls %v, want assigned, revoked then assigned", calls)
+	}
+}
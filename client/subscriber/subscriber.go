@@ -0,0 +1,233 @@
+// Package subscriber receives messages from the Broker, passing them to a handler and
+// acknowledging those handled, while keeping the subscriber's session alive.
+package subscriber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/common/compression"
+	commonerrors "pubsub/common/errors"
+)
+
+const (
+	defaultConcurrency         = 1
+	defaultMaxMessages         = 10
+	defaultPollInterval        = 100 * time.Millisecond
+	defaultHeartbeatInterval   = 10 * time.Second
+	defaultReconnectBackoff    = 100 * time.Millisecond
+	defaultMaxReconnectBackoff = 10 * time.Second
+	defaultShutdownTimeout     = 10 * time.Second
+	defaultChunkTimeout        = time.Minute
+	defaultMaxChunkBytes       = 64 << 20
+
+	// Precondition failures reported by the Broker.
+	subscriberNotFound        = "SUBSCRIBER_NOT_FOUND"
+	exclusiveSubscriberExists = "EXCLUSIVE_SUBSCRIBER_EXISTS"
+)
+
+var errPartitionsReassigned = errors.New("partitions reassigned to a newer subscriber of the group")
+
+// A Handler processes a message, which is acknowledged if it returns nil and redelivered
+// otherwise.
+type Handler func(ctx context.Context, message *brokerpb.Message) error
+
+type Config struct {
+	Filter          string                    `koanf:"filter"`
+	ReceiveRetained bool                      `koanf:"receive_retained"`
+	Type            brokerpb.SubscriptionType `koanf:"type"`
+	AckTimeout      time.Duration             `koanf:"ack_timeout"`
+	SessionTimeout  time.Duration             `koanf:"session_timeout"`
+	// Whether the Broker decompresses compressed payloads before they're polled, rather than the
+	// subscriber before they're handled.
+	BrokerDecompression bool `koanf:"broker_decompression"`
+
+	// How many messages are handled at once. Messages with the same key are always handled one at
+	// a time, in order. Defaults to 1.
+	Concurrency int `koanf:"concurrency"`
+	// The most messages each poll returns. Defaults to 10.
+	MaxMessages int `koanf:"max_messages"`
+	// The most bytes of messages each poll returns, and returns from each partition, though a poll
+	// always returns at least one message. If zero, they're only limited by the Broker's maximum
+	// response size.
+	MaxBytes          int `koanf:"max_bytes"`
+	PartitionMaxBytes int `koanf:"partition_max_bytes"`
+	// How long to wait before polling again after a poll returns nothing. Defaults to 100ms.
+	PollInterval time.Duration `koanf:"poll_interval"`
+	// How often a heartbeat is sent, so the session stays alive while messages are being handled.
+	// Defaults to a third of the session timeout, or 10 seconds.
+	HeartbeatInterval time.Duration `koanf:"heartbeat_interval"`
+	// How often handled messages are acknowledged, checked between polls. If zero, they're
+	// acknowledged after handling each poll's messages.
+	AutoCommitInterval time.Duration `koanf:"auto_commit_interval"`
+	// How long to wait before subscribing again after losing the connection or session, doubling
+	// each attempt up to MaxReconnectBackoff. Defaults to 100ms, and 10 seconds.
+	ReconnectBackoff    time.Duration `koanf:"reconnect_backoff"`
+	MaxReconnectBackoff time.Duration `koanf:"max_reconnect_backoff"`
+	// How long to wait to acknowledge handled messages when shutting down. Defaults to 10 seconds.
+	ShutdownTimeout time.Duration `koanf:"shutdown_timeout"`
+	// How long the chunks of a payload are held waiting for the rest, and the most bytes of chunks
+	// held, before the oldest incomplete payloads are dropped and their chunks left for redelivery.
+	// MaxChunkBytes must be at least the largest payload, and payloads which would decompress to
+	// more are left compressed. Defaults to 1 minute, and 64MiB.
+	ChunkTimeout  time.Duration `koanf:"chunk_timeout"`
+	MaxChunkBytes int           `koanf:"max_chunk_bytes"`
+
+	// Called when the subscriber starts being delivered messages, after subscribing or taking over
+	// as the active subscriber of a failover group.
+	OnAssigned func(ctx context.Context) `koanf:"-"`
+	// Called when the subscriber stops being delivered messages, after shutting down, losing its
+	// session, having its partitions reassigned or becoming a standby.
+	OnRevoked func(ctx context.Context) `koanf:"-"`
+}
+
+// A Subscriber receives the messages of a topic, or topics matching a pattern, as a member of a
+// group.
+type Subscriber struct {
+	client brokerpb.BrokerClient
+	topic  string
+	group  string
+	cfg    Config
+}
+
+// New creates a Subscriber of the topic. The client should convert errors with the
+// grpcerrors.UnaryClientInterceptor, so the Subscriber can tell which are retriable.
+func New(client brokerpb.BrokerClient, topic, group string, cfg Config) *Subscriber {
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = defaultConcurrency
+	}
+	if cfg.MaxMessages == 0 {
+		cfg.MaxMessages = defaultMaxMessages
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = defaultHeartbeatInterval
+		if cfg.SessionTimeout != 0 {
+			cfg.HeartbeatInterval = cfg.SessionTimeout / 3
+		}
+	}
+	if cfg.ReconnectBackoff == 0 {
+		cfg.ReconnectBackoff = defaultReconnectBackoff
+	}
+	if cfg.MaxReconnectBackoff == 0 {
+		cfg.MaxReconnectBackoff = defaultMaxReconnectBackoff
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if cfg.ChunkTimeout == 0 {
+		cfg.ChunkTimeout = defaultChunkTimeout
+	}
+	if cfg.MaxChunkBytes == 0 {
+		cfg.MaxChunkBytes = defaultMaxChunkBytes
+	}
+	return &Subscriber{
+		client: client,
+		topic:  topic,
+		group:  group,
+		cfg:    cfg,
+	}
+}
+
+// Receive subscribes and passes each message received to the handler until ctx is done, then
+// waits for the handlers to return and acknowledges the messages they handled. Subscribing again
+// after losing the connection or session is retried with backoff.
+//
+// A partitioned subscriber whose partitions are reassigned to a newer subscriber of the group
+// stops receiving and returns an error, as subscribing again would take them back.
+func (s *Subscriber) Receive(ctx context.Context, handler Handler) error {
+	backoff := s.cfg.ReconnectBackoff
+	for {
+		subscribed, err := s.receive(ctx, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !s.reconnectable(err) {
+			return fmt.Errorf("receiving: %w", err)
+		}
+		if subscribed {
+			backoff = s.cfg.ReconnectBackoff
+		}
+
+		slog.Warn("Subscriber disconnected, reconnecting", slog.Any("error", err), slog.Duration("backoff", backoff))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.cfg.MaxReconnectBackoff)
+	}
+}
+
+// Whether subscribing again might recover from the error.
+func (s *Subscriber) reconnectable(err error) bool {
+	if errors.Is(err, errPartitionsReassigned) {
+		return false
+	}
+	unavailable := commonerrors.Unavailable{}
+	if errors.As(err, &unavailable) {
+		return true
+	}
+	return hasPreconditionFailure(err, subscriberNotFound) || hasPreconditionFailure(err, exclusiveSubscriberExists)
+}
+
+func (s *Subscriber) partitioned() bool {
+	return s.cfg.Type == brokerpb.SubscriptionType_SUBSCRIPTION_TYPE_UNSPECIFIED || s.cfg.Type == brokerpb.SubscriptionType_SUBSCRIPTION_TYPE_PARTITIONED
+}
+
+func hasPreconditionFailure(err error, failureType string) bool {
+	failedPrecon := commonerrors.FailedPrecondition{}
+	if !errors.As(err, &failedPrecon) {
+		return false
+	}
+	for _, failure := range failedPrecon.PreconditionFailures {
+		if failure.Type == failureType {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Subscriber) subscribe(ctx context.Context) (string, error) {
+	request := brokerpb.SubscribeRequest_builder{
+		Topic:           &s.topic,
+		Group:           &s.group,
+		Filter:          &s.cfg.Filter,
+		ReceiveRetained: &s.cfg.ReceiveRetained,
+		Type:            &s.cfg.Type,
+	}.Build()
+	if s.cfg.AckTimeout != 0 {
+		request.SetAckTimeout(durationpb.New(s.cfg.AckTimeout))
+	}
+	if s.cfg.SessionTimeout != 0 {
+		request.SetSessionTimeout(durationpb.New(s.cfg.SessionTimeout))
+	}
+	if !s.cfg.BrokerDecompression {
+		request.SetAcceptCompressions(compression.Names())
+	}
+
+	resp, err := s.client.Subscribe(ctx, request)
+	if err != nil {
+		return "", fmt.Errorf("subscribing: %w", err)
+	}
+	return resp.GetSubscriberId(), nil
+}
+
+// The Broker's maximum response size, so polls accept responses of up to that size rather than
+// gRPC's default maximum. Zero if the Broker doesn't report it.
+func (s *Subscriber) maxResponseSize(ctx context.Context) (int, error) {
+	info, err := s.client.GetServerInfo(ctx, &emptypb.Empty{})
+	if err != nil {
+		return 0, fmt.Errorf("getting server info: %w", err)
+	}
+	return int(info.GetMaxResponseSize()), nil
+}
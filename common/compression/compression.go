@@ -0,0 +1,87 @@
+// Package compression provides the codecs which messages can be compressed with, by name, so
+// that clients and the Broker agree on them.
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"sync"
+)
+
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	// Decompress the data, returning an error wrapping ErrTooLarge if it decompresses to more than
+	// maxSize bytes.
+	Decompress(data []byte, maxSize int) ([]byte, error)
+}
+
+var (
+	// ErrTooLarge is wrapped by the errors of codecs decompressing data larger than the max size.
+	ErrTooLarge = errors.New("decompressed data too large")
+	// ErrUnknownCodec is wrapped by the errors of Decompress for names with no codec registered.
+	ErrUnknownCodec = errors.New("unknown codec")
+)
+
+var (
+	mutex        sync.RWMutex
+	codecsByName = map[string]Codec{
+		Gzip:   gzipCodec{},
+		Snappy: snappyCodec{},
+		Zstd:   zstdCodec{},
+	}
+)
+
+// Register makes the codec available by name, replacing any codec already registered with it.
+func Register(name string, codec Codec) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	codecsByName[name] = codec
+}
+
+// Lookup returns the codec registered with the name, if there is one.
+func Lookup(name string) (Codec, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	codec, ok := codecsByName[name]
+	return codec, ok
+}
+
+// Decompress the data with the codec registered with the name, returning an error wrapping
+// ErrUnknownCodec if there isn't one, or ErrTooLarge if it decompresses to more than maxSize bytes.
+func Decompress(name string, data []byte, maxSize int) ([]byte, error) {
+	codec, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCodec, name)
+	}
+	return codec.Decompress(data, maxSize)
+}
+
+// Names returns the names of every registered codec, sorted.
+func Names() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return slices.Sorted(maps.Keys(codecsByName))
+}
+
+// Read the decompressed data from the reader, without reading more than one byte beyond maxSize.
+func readAtMost(reader io.Reader, maxSize int) ([]byte, error) {
+	limit := int64(maxSize)
+	if limit < math.MaxInt64 {
+		limit++
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, limit))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("%w, more than %d bytes", ErrTooLarge, maxSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,53 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 1000)
+	for _, name := range Names() {
+		t.Run(name, func(t *testing.T) {
+			codec, _ := Lookup(name)
+			compressed, err := codec.Compress(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decompressed, err := codec.Decompress(compressed, len(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decompressed, data) {
+				t.Errorf("decompressed %d bytes which differ from the %d compressed", len(decompressed), len(data))
+			}
+
+			if _, err := codec.Decompress(compressed, len(data)-1); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("decompressing beyond the max size got %v, want %v", err, ErrTooLarge)
+			}
+			if _, err := codec.Decompress([]byte("not compressed"), len(data)); err == nil || errors.Is(err, ErrTooLarge) {
+				t.Errorf("decompressing invalid data got %v, want an error", err)
+			}
+		})
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	data := []byte("abcdefgh")
+	compressed, err := gzipCodec{}.Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decompressed, err := Decompress(Gzip, compressed, len(data)); err != nil || !bytes.Equal(decompressed, data) {
+		t.Errorf("decompressed %q, %v, want %q", decompressed, err, data)
+	}
+	if _, err := Decompress(Gzip, compressed, len(data)-1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("decompressing beyond the max size got %v, want %v", err, ErrTooLarge)
+	}
+	if _, err := Decompress("lz4", compressed, len(data)); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("decompressing with an unregistered codec got %v, want %v", err, ErrUnknownCodec)
+	}
+}
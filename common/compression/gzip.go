@@ -0,0 +1,37 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+)
+
+const Gzip = "gzip"
+
+type gzipCodec struct{}
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, fmt.Errorf("gzip compressing: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("gzip compressing: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte, maxSize int) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("gzip decompressing: %w", err)
+	}
+	defer reader.Close()
+
+	decompressed, err := readAtMost(reader, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("gzip decompressing: %w", err)
+	}
+	return decompressed, nil
+}
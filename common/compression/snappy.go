@@ -0,0 +1,31 @@
+package compression
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+const Snappy = "snappy"
+
+type snappyCodec struct{}
+
+func (snappyCodec) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCodec) Decompress(data []byte, maxSize int) ([]byte, error) {
+	// The block format starts with the decompressed length, so it's checked before decompressing.
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, fmt.Errorf("snappy decompressing: %w", err)
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf("snappy decompressing: %w, %d bytes is more than %d", ErrTooLarge, size, maxSize)
+	}
+	decompressed, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, fmt.Errorf("snappy decompressing: %w", err)
+	}
+	return decompressed, nil
+}
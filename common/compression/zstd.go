@@ -0,0 +1,33 @@
+package compression
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const Zstd = "zstd"
+
+// Encoders are safe for concurrent use by EncodeAll, so one is shared.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+type zstdCodec struct{}
+
+func (zstdCodec) Compress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func (zstdCodec) Decompress(data []byte, maxSize int) ([]byte, error) {
+	reader, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("zstd decompressing: %w", err)
+	}
+	defer reader.Close()
+
+	decompressed, err := readAtMost(reader, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("zstd decompressing: %w", err)
+	}
+	return decompressed, nil
+}
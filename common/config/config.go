@@ -1,21 +1,191 @@
+// Package config loads a binary's config from layers, each overriding the last:
+//   - The defaults given by the binary.
+//   - One or more YAML files, given with the --config flag, or the binary's default files.
+//   - Environment variables, e.g. PUBSUB_PORT for port, and PUBSUB_LOGGING__VERBOSITY for
+//     logging.verbosity, with a double underscore separating nested keys.
+//   - Command line flags named by the keys, e.g. --port or --logging.verbosity.
+//
+// Keys which don't match any field of the config are reported as errors, as are configs which
+// fail their Validate method.
 package config
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/v2"
 )
 
-func ParseYAML[C any](filePath, configPath string) (C, error) {
-	var cfg C
+// A config implementing Validator is validated once loaded.
+type Validator interface {
+	Validate() error
+}
+
+type Options struct {
+	// The files loaded if none are given with the --config flag. Any which don't exist are skipped,
+	// unlike files given with the flag.
+	DefaultFiles []string
+	// Path of the config within each file.
+	ConfigPath string
+	// Prefix of the environment variables which override the files' config, e.g. PUBSUB_.
+	EnvPrefix string
+}
+
+// A Loader loads a config of type C from its layers.
+type Loader[C any] struct {
+	defaults C
+	opts     Options
+	files    []string
+	// Values of the flags which were set, by key.
+	flags map[string]string
+	args  []string
+}
+
+// NewLoader parses the command line arguments, returning why they're invalid. This includes
+// flag.ErrHelp if help was requested, in which case the usage has been printed.
+func NewLoader[C any](defaults C, opts Options, args []string) (*Loader[C], error) {
+	l := &Loader[C]{
+		defaults: defaults,
+		opts:     opts,
+		flags:    map[string]string{},
+	}
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.Func("config", "Path of a YAML config file. Can be given more than once, with later files overriding earlier ones.", func(path string) error {
+		l.files = append(l.files, path)
+		return nil
+	})
+	for _, key := range fieldKeys(defaults) {
+		flags.Var(&flagValue{key: key, flags: l.flags}, key.name, fmt.Sprintf("Overrides %s.", key.name))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	l.args = flags.Args()
+
+	if len(l.files) == 0 {
+		for _, path := range opts.DefaultFiles {
+			if _, err := os.Stat(path); err == nil {
+				l.files = append(l.files, path)
+			}
+		}
+	}
+	return l, nil
+}
+
+// The YAML files loaded.
+func (l *Loader[C]) Files() []string {
+	return l.files
+}
+
+// The command line arguments left after the flags.
+func (l *Loader[C]) Args() []string {
+	return l.args
+}
+
+// Load the config, returning why it couldn't be loaded or is invalid.
+func (l *Loader[C]) Load() (C, error) {
+	cfg := l.defaults
+	var errs []error
 
 	k := koanf.New(".")
-	if err := k.Load(file.Provider(filePath), yaml.Parser()); err != nil {
-		return cfg, fmt.Errorf("parsing yaml: %w", err)
+	load := func(source string, layer *koanf.Koanf) {
+		if unknown := unknownKeys(cfg, layer.Get(l.opts.ConfigPath)); len(unknown) != 0 {
+			errs = append(errs, fmt.Errorf("unknown keys in %s: %s", source, strings.Join(unknown, ", ")))
+		}
+		k.Merge(layer)
+	}
+
+	for _, path := range l.files {
+		layer := koanf.New(".")
+		if err := layer.Load(file.Provider(path), yaml.Parser()); err != nil {
+			return cfg, fmt.Errorf("parsing yaml: %w", err)
+		}
+		load(path, layer)
+	}
+
+	if l.opts.EnvPrefix != "" {
+		layer := koanf.New(".")
+		err := layer.Load(env.Provider(l.opts.EnvPrefix, ".", func(name string) string {
+			key := strings.ToLower(strings.TrimPrefix(name, l.opts.EnvPrefix))
+			return joinKey(l.opts.ConfigPath, strings.ReplaceAll(key, "__", "."))
+		}), nil)
+		if err != nil {
+			return cfg, fmt.Errorf("loading environment variables: %w", err)
+		}
+		load("environment variables", layer)
+	}
+
+	layer := koanf.New(".")
+	for key, value := range l.flags {
+		layer.Set(joinKey(l.opts.ConfigPath, key), value)
+	}
+	load("flags", layer)
+
+	if len(errs) != 0 {
+		return cfg, fmt.Errorf("loading config: %w", errors.Join(errs...))
 	}
 
-	k.Unmarshal(configPath, &cfg)
+	err := k.UnmarshalWithConf(l.opts.ConfigPath, &cfg, koanf.UnmarshalConf{
+		DecoderConfig: &mapstructure.DecoderConfig{
+			DecodeHook: mapstructure.ComposeDecodeHookFunc(
+				mapstructure.StringToTimeDurationHookFunc(),
+				mapstructure.TextUnmarshallerHookFunc()),
+			WeaklyTypedInput: true,
+		},
+	})
+	if err != nil {
+		return cfg, fmt.Errorf("unmarshalling config: %w", err)
+	}
+
+	if v, ok := any(cfg).(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return cfg, fmt.Errorf("invalid config: %w", err)
+		}
+	}
 	return cfg, nil
 }
+
+// How long Watch waits for a file to stop changing, so a file being written isn't loaded before
+// it's complete.
+const watchDelay = 100 * time.Millisecond
+
+// Watch calls onChange each time any of the files change, with the config loaded again or why it
+// couldn't be. Watching a file stops if it's removed.
+func (l *Loader[C]) Watch(onChange func(C, error)) error {
+	var (
+		mutex sync.Mutex
+		timer *time.Timer
+	)
+	for _, path := range l.files {
+		err := file.Provider(path).Watch(func(_ any, err error) {
+			if err != nil {
+				var cfg C
+				onChange(cfg, fmt.Errorf("watching %s: %w", path, err))
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(watchDelay, func() {
+				onChange(l.Load())
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("watching %s: %w", path, err)
+		}
+	}
+	return nil
+}
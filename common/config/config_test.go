@@ -0,0 +1,207 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Port    int           `koanf:"port"`
+	Timeout time.Duration `koanf:"timeout"`
+	Logging struct {
+		Verbosity string `koanf:"verbosity"`
+		JSON      bool   `koanf:"json"`
+	} `koanf:"logging"`
+	Topics []testTopic       `koanf:"topics"`
+	Labels map[string]string `koanf:"labels"`
+}
+
+type testTopic struct {
+	Name string `koanf:"name"`
+}
+
+func (c testConfig) Validate() error {
+	if c.Port < 0 {
+		return errors.New("port must not be negative")
+	}
+	return nil
+}
+
+var testOptions = Options{ConfigPath: "app", EnvPrefix: "CONFIGTEST_"}
+
+func testDefaults() testConfig {
+	cfg := testConfig{Port: 1, Timeout: time.Second}
+	cfg.Logging.Verbosity = "info"
+	return cfg
+}
+
+// Write the YAML to a file in the test's temporary directory, returning its path.
+func writeFile(t *testing.T, name, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustLoad(t *testing.T, args ...string) testConfig {
+	t.Helper()
+	loader, err := NewLoader(testDefaults(), testOptions, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// Each layer overrides the keys it sets in the layers before it, leaving the rest.
+func TestLoadLayers(t *testing.T) {
+	first := writeFile(t, "first.yaml", `
+app:
+  port: 2
+  logging:
+    verbosity: debug
+  topics:
+    - name: a
+  labels:
+    team: x
+other:
+  ignored: true
+`)
+	second := writeFile(t, "second.yaml", `
+app:
+  port: 3
+`)
+
+	want := testDefaults()
+	want.Port = 3
+	want.Logging.Verbosity = "debug"
+	want.Topics = []testTopic{{Name: "a"}}
+	want.Labels = map[string]string{"team": "x"}
+	if cfg := mustLoad(t, "--config", first, "--config", second); !reflect.DeepEqual(cfg, want) {
+		t.Errorf("loaded the files as %+v, want %+v", cfg, want)
+	}
+
+	t.Setenv("CONFIGTEST_PORT", "4")
+	t.Setenv("CONFIGTEST_TIMEOUT", "5s")
+	t.Setenv("CONFIGTEST_LOGGING__VERBOSITY", "warn")
+	want.Port = 4
+	want.Timeout = 5 * time.Second
+	want.Logging.Verbosity = "warn"
+	if cfg := mustLoad(t, "--config", first, "--config", second); !reflect.DeepEqual(cfg, want) {
+		t.Errorf("loaded the files and environment variables as %+v, want %+v", cfg, want)
+	}
+
+	want.Port = 5
+	want.Logging.JSON = true
+	if cfg := mustLoad(t, "--config", first, "--config", second, "--port", "5", "--logging.json"); !reflect.DeepEqual(cfg, want) {
+		t.Errorf("loaded every layer as %+v, want %+v", cfg, want)
+	}
+}
+
+func TestNewLoader(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+	present := writeFile(t, "present.yaml", "app:\n  port: 2\n")
+	opts := testOptions
+	opts.DefaultFiles = []string{missing, present}
+
+	loader, err := NewLoader(testDefaults(), opts, []string{"--port", "3", "rest", "--port"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := loader.Files(); !reflect.DeepEqual(files, []string{present}) {
+		t.Errorf("got files %q, want only the default file which exists", files)
+	}
+	if args := loader.Args(); !reflect.DeepEqual(args, []string{"rest", "--port"}) {
+		t.Errorf("got args %q, want those after the flags", args)
+	}
+
+	// Files given by flag replace the defaults, and must exist.
+	loader, err = NewLoader(testDefaults(), opts, []string{"--config", missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loader.Load(); err == nil {
+		t.Errorf("loaded a missing config file")
+	}
+
+	if _, err := NewLoader(testDefaults(), opts, []string{"--prot", "3"}); err == nil {
+		t.Errorf("parsed an unknown flag")
+	}
+	if _, err := NewLoader(testDefaults(), opts, []string{"--topics", "a"}); err == nil {
+		t.Errorf("parsed a flag for a slice")
+	}
+}
+
+// Keys which don't match a field are reported for every layer, rather than ignored.
+func TestLoadUnknownKeys(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+app:
+  prot: 2
+  logging:
+    verbose: true
+  topics:
+    - name: a
+    - nmae: b
+  labels:
+    anything: goes
+`)
+	t.Setenv("CONFIGTEST_LOGGING__FORMAT", "json")
+
+	loader, err := NewLoader(testDefaults(), testOptions, []string{"--config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loader.Load()
+	if err == nil {
+		t.Fatal("loaded a config with unknown keys")
+	}
+	for _, want := range []string{
+		"unknown keys in " + path + ": logging.verbose, prot, topics[1].nmae",
+		"unknown keys in environment variables: logging.format",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want it to report %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "anything") {
+		t.Errorf("got %v, want map keys accepted", err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{name: "unparsable", yaml: "app: [", want: "parsing yaml"},
+		{name: "wrong type", yaml: "app:\n  port: two\n", want: "unmarshalling config"},
+		{name: "bad duration", yaml: "app:\n  timeout: soon\n", want: "unmarshalling config"},
+		{name: "failing validation", yaml: "app:\n  port: -1\n", want: "invalid config: port must not be negative"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			loader, err := NewLoader(testDefaults(), testOptions, []string{"--config", writeFile(t, "config.yaml", test.yaml)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loader.Load(); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+
+	if _, err := NewLoader(testDefaults(), testOptions, []string{"--help"}); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("asking for help got %v, want %v", err, flag.ErrHelp)
+	}
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"iter"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// A key of a config which can be set by a flag.
+type fieldKey struct {
+	name   string
+	isBool bool
+}
+
+// The keys of the config's fields which hold a single value, so not those within slices or maps.
+func fieldKeys(cfg any) []fieldKey {
+	var keys []fieldKey
+	var walk func(prefix string, t reflect.Type)
+	walk = func(prefix string, t reflect.Type) {
+		for field := range structFields(t) {
+			name := joinKey(prefix, field.tag)
+			switch fieldType := indirect(field.Type); {
+			case fieldType.Kind() == reflect.Struct && fieldType != reflect.TypeFor[time.Time]():
+				walk(name, fieldType)
+			case fieldType.Kind() == reflect.Slice, fieldType.Kind() == reflect.Map, fieldType.Kind() == reflect.Func:
+			default:
+				keys = append(keys, fieldKey{name: name, isBool: fieldType.Kind() == reflect.Bool})
+			}
+		}
+	}
+	walk("", indirect(reflect.TypeOf(cfg)))
+	return keys
+}
+
+// The keys of the value which don't match a field of the config, sorted.
+func unknownKeys(cfg any, value any) []string {
+	var unknown []string
+	var walk func(key string, t reflect.Type, value any)
+	walk = func(key string, t reflect.Type, value any) {
+		t = indirect(t)
+		switch v := value.(type) {
+		case map[string]any:
+			switch t.Kind() {
+			case reflect.Struct:
+				fieldTypes := map[string]reflect.Type{}
+				for field := range structFields(t) {
+					fieldTypes[field.tag] = field.Type
+				}
+				for name, fieldValue := range v {
+					fieldType, ok := fieldTypes[name]
+					if !ok {
+						unknown = append(unknown, joinKey(key, name))
+						continue
+					}
+					walk(joinKey(key, name), fieldType, fieldValue)
+				}
+			case reflect.Map:
+				for name, elemValue := range v {
+					walk(joinKey(key, name), t.Elem(), elemValue)
+				}
+			}
+		case []any:
+			if t.Kind() == reflect.Slice {
+				for i, elemValue := range v {
+					walk(fmt.Sprintf("%s[%d]", key, i), t.Elem(), elemValue)
+				}
+			}
+		}
+	}
+	walk("", reflect.TypeOf(cfg), value)
+	slices.Sort(unknown)
+	return unknown
+}
+
+type structField struct {
+	reflect.StructField
+	tag string
+}
+
+// The exported fields of the struct type which have a koanf tag.
+func structFields(t reflect.Type) iter.Seq[structField] {
+	return func(yield func(structField) bool) {
+		for i := range t.NumField() {
+			field := t.Field(i)
+			tag := field.Tag.Get("koanf")
+			if !field.IsExported() || tag == "" || tag == "-" {
+				continue
+			}
+			if !yield(structField{StructField: field, tag: tag}) {
+				return
+			}
+		}
+	}
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+func joinKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// A flag which records its value by its key, if it's set.
+type flagValue struct {
+	key   fieldKey
+	flags map[string]string
+}
+
+func (f *flagValue) String() string {
+	if f == nil || f.flags == nil {
+		return ""
+	}
+	return f.flags[f.key.name]
+}
+
+func (f *flagValue) Set(value string) error {
+	f.flags[f.key.name] = value
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.key.isBool
+}
@@ -0,0 +1,15 @@
+package errors
+
+func NewDeadlineExceeded(message string) error {
+	return DeadlineExceeded{
+		Message: message,
+	}
+}
+
+type DeadlineExceeded struct {
+	Message string
+}
+
+func (i DeadlineExceeded) Error() string {
+	return i.Message
+}
@@ -0,0 +1,15 @@
+package errors
+
+func NewPermissionDenied(message string) error {
+	return PermissionDenied{
+		Message: message,
+	}
+}
+
+type PermissionDenied struct {
+	Message string
+}
+
+func (i PermissionDenied) Error() string {
+	return i.Message
+}
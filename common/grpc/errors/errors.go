@@ -1,7 +1,9 @@
 package errors
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 
@@ -25,6 +27,12 @@ func FromGRPCError(err error) error {
 }
 
 var converterFromGRPCByCode = map[codes.Code]func(message string, details []any) error{
+	codes.Canceled: func(message string, details []any) error {
+		return fmt.Errorf("%s: %w", message, context.Canceled)
+	},
+	codes.DeadlineExceeded: func(message string, details []any) error {
+		return commonerrors.NewDeadlineExceeded(message)
+	},
 	codes.FailedPrecondition: func(message string, details []any) error {
 		return commonerrors.NewFailedPrecondition(message, preconditionFailuresConverterFromGRPC(details)...)
 	},
@@ -34,6 +42,9 @@ var converterFromGRPCByCode = map[codes.Code]func(message string, details []any)
 	codes.InvalidArgument: func(message string, details []any) error {
 		return commonerrors.NewInvalidArgument(message, fieldViolationsConverterFromGRPC(details)...)
 	},
+	codes.PermissionDenied: func(message string, details []any) error {
+		return commonerrors.NewPermissionDenied(message)
+	},
 	codes.Unavailable: func(message string, details []any) error {
 		return commonerrors.NewUnavailable(message)
 	},
@@ -69,6 +80,11 @@ func fieldViolationsConverterFromGRPC(details []any) []commonerrors.FieldViolati
 }
 
 func ToGRPCError(err error) error {
+	deadlineExceeded := commonerrors.DeadlineExceeded{}
+	if errors.As(err, &deadlineExceeded) {
+		return toGRPCError(codes.DeadlineExceeded, deadlineExceeded.Message)
+	}
+
 	failedPrecon := commonerrors.FailedPrecondition{}
 	if errors.As(err, &failedPrecon) {
 		return toGRPCError(codes.FailedPrecondition, failedPrecon.Message, preconditionFailuresConverterToGRPC(failedPrecon.PreconditionFailures)...)
@@ -84,6 +100,11 @@ func ToGRPCError(err error) error {
 		return toGRPCError(codes.InvalidArgument, invalidArg.Message, fieldViolationsConverterToGRPC(invalidArg.FieldViolations)...)
 	}
 
+	permissionDenied := commonerrors.PermissionDenied{}
+	if errors.As(err, &permissionDenied) {
+		return toGRPCError(codes.PermissionDenied, permissionDenied.Message)
+	}
+
 	unavailable := commonerrors.Unavailable{}
 	if errors.As(err, &unavailable) {
 		return toGRPCError(codes.Unavailable, unavailable.Message)
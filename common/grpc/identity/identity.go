@@ -0,0 +1,30 @@
+// Package identity passes the ID a client identifies itself by to the Broker, in the metadata of
+// its calls. The ID isn't authenticated.
+package identity
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const metadataKey = "pubsub-client-id"
+
+// UnaryClientInterceptor adds the client ID to the metadata of each call.
+func UnaryClientInterceptor(clientID string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, metadataKey, clientID)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// ClientID returns the ID of the client making the call, or the empty string if it didn't give
+// one.
+func ClientID(ctx context.Context) string {
+	values := metadata.ValueFromIncomingContext(ctx, metadataKey)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,17 @@
+// Package headers names the message headers which have meaning to the Broker and its clients.
+package headers
+
+const (
+	// The topic a reply to a request should be published to.
+	ReplyTo = "pubsub-reply-to"
+	// Identifies the request a reply is for.
+	CorrelationID = "pubsub-correlation-id"
+	// Identifies the message a chunk of a payload too large for a single message is part of.
+	ChunkID = "pubsub-chunk-id"
+	// The position of the chunk within the payload, from zero, and how many chunks there are.
+	ChunkIndex = "pubsub-chunk-index"
+	ChunkCount = "pubsub-chunk-count"
+	// The version of the topic's schema the payload was written with. Payloads without one are
+	// valid if they're valid against any version.
+	SchemaVersion = "pubsub-schema-version"
+)
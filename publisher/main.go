@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
 	"os"
@@ -11,27 +13,58 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 
 	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/client/publisher"
 	"pubsub/common/config"
 	grpcerrors "pubsub/common/grpc/errors"
+	"pubsub/common/grpc/identity"
 )
 
 type Config struct {
 	Port int `koanf:"port"`
+	// Identifies the client to the Broker, for the ACLs of topics.
+	ClientID  string           `koanf:"client_id"`
+	Publisher publisher.Config `koanf:"publisher"`
+}
+
+var defaultConfig = Config{
+	Port: 9123,
+}
+
+func (c Config) Validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port: must be between 1 and 65535, got %d", c.Port)
+	}
+	return nil
 }
 
 func main() {
-	cfg, err := config.ParseYAML[Config]("publisher/config.yml", "config")
+	loader, err := config.NewLoader(defaultConfig, config.Options{
+		DefaultFiles: []string{"publisher/config.yml"},
+		ConfigPath:   "config",
+		EnvPrefix:    "PUBSUB_",
+	}, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("Parsing flags", slog.Any("error", err))
+		os.Exit(2)
+	}
+	cfg, err := loader.Load()
 	if err != nil {
-		slog.Error("Parsing config", slog.Any("error", err))
+		slog.Error("Loading config", slog.Any("error", err))
 		os.Exit(1)
 	}
-	slog.Debug("Config loaded", slog.Any("config", cfg))
+	slog.Debug("Config loaded", slog.Any("files", loader.Files()), slog.Any("config", cfg))
 
 	var opts []grpc.DialOption
 	opts = append(opts,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithChainUnaryInterceptor(grpcerrors.UnaryClientInterceptor),
 	)
+	if cfg.ClientID != "" {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(identity.UnaryClientInterceptor(cfg.ClientID)))
+	}
 	conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", cfg.Port), opts...)
 	if err != nil {
 		slog.Error("Dialling", slog.Any("error", err))
@@ -41,16 +74,24 @@ func main() {
 
 	client := brokerpb.NewBrokerClient(conn)
 
-	input := strings.Join(os.Args[1:], " ")
+	input := strings.Join(loader.Args(), " ")
 
-	request := brokerpb.PublishRequest_builder{
-		Topic: toPtr("animals.cats"),
-		Messages: []*brokerpb.Message{brokerpb.Message_builder{
-			Key:     toPtr("key"),
-			Payload: []byte(input),
-		}.Build()},
-	}.Build()
-	if _, err := client.Publish(context.Background(), request); err != nil {
+	ctx := context.Background()
+	pub, err := publisher.New(ctx, client, "animals.cats", cfg.Publisher)
+	if err != nil {
+		slog.Error("Creating publisher", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	result := pub.Publish(ctx, brokerpb.Message_builder{
+		Key:     toPtr("key"),
+		Payload: []byte(input),
+	}.Build())
+	if err := pub.Close(ctx); err != nil {
+		slog.Error("Closing publisher", slog.Any("error", err))
+		os.Exit(1)
+	}
+	if err := result.Get(ctx); err != nil {
 		slog.Error("Publishing", slog.Any("error", err))
 		os.Exit(1)
 	}
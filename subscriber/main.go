@@ -2,35 +2,69 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 
 	brokerpb "pubsub/broker/proto/broker"
+	"pubsub/client/subscriber"
 	"pubsub/common/config"
 	grpcerrors "pubsub/common/grpc/errors"
+	"pubsub/common/grpc/identity"
 )
 
 type Config struct {
 	Port int `koanf:"port"`
+	// Identifies the client to the Broker, for the ACLs of topics.
+	ClientID   string            `koanf:"client_id"`
+	Subscriber subscriber.Config `koanf:"subscriber"`
+}
+
+var defaultConfig = Config{
+	Port: 9123,
+}
+
+func (c Config) Validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port: must be between 1 and 65535, got %d", c.Port)
+	}
+	return nil
 }
 
 func main() {
-	cfg, err := config.ParseYAML[Config]("subscriber/config.yml", "config")
+	loader, err := config.NewLoader(defaultConfig, config.Options{
+		DefaultFiles: []string{"subscriber/config.yml"},
+		ConfigPath:   "config",
+		EnvPrefix:    "PUBSUB_",
+	}, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("Parsing flags", slog.Any("error", err))
+		os.Exit(2)
+	}
+	cfg, err := loader.Load()
 	if err != nil {
-		slog.Error("Parsing config", slog.Any("error", err))
+		slog.Error("Loading config", slog.Any("error", err))
 		os.Exit(1)
 	}
-	slog.Debug("Config loaded", slog.Any("config", cfg))
+	slog.Debug("Config loaded", slog.Any("files", loader.Files()), slog.Any("config", cfg))
 
 	var opts []grpc.DialOption
 	opts = append(opts,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithChainUnaryInterceptor(grpcerrors.UnaryClientInterceptor),
 	)
+	if cfg.ClientID != "" {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(identity.UnaryClientInterceptor(cfg.ClientID)))
+	}
 	conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", cfg.Port), opts...)
 	if err != nil {
 		slog.Error("Dialling", slog.Any("error", err))
@@ -40,43 +74,15 @@ func main() {
 
 	client := brokerpb.NewBrokerClient(conn)
 
-	resp, err := client.Subscribe(context.Background(), brokerpb.SubscribeRequest_builder{
-		Topic: toPtr("animals.cats"),
-		Group: toPtr("animals.cats.group"),
-	}.Build())
-	if err != nil {
-		slog.Error("Subscribing", slog.Any("error", err))
-		os.Exit(1)
-	}
-	subscriberID := resp.GetSubscriberId()
-
-	for {
-		resp, err := client.Poll(context.Background(), brokerpb.PollRequest_builder{
-			SubscriberId: &subscriberID,
-			Limit:        toPtr(int32(10)),
-		}.Build())
-		if err != nil {
-			slog.Error("Polling", slog.Any("error", err))
-			os.Exit(1)
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-		for _, message := range resp.GetMessages() {
-			fmt.Println(string(message.String()))
-		}
-
-		if len(resp.GetMessages()) == 0 {
-			continue
-		}
-
-		request := brokerpb.MoveOffsetRequest_builder{
-			SubscriberId: &subscriberID,
-			Delta:        toPtr(int32(len(resp.GetMessages()))),
-		}.Build()
-		if _, err := client.MoveOffset(context.Background(), request); err != nil {
-			slog.Error("Moving offset", slog.Any("error", err))
-			os.Exit(1)
-		}
+	sub := subscriber.New(client, "animals.cats", "animals.cats.group", cfg.Subscriber)
+	if err := sub.Receive(ctx, func(ctx context.Context, message *brokerpb.Message) error {
+		fmt.Println(message.String())
+		return nil
+	}); err != nil {
+		slog.Error("Receiving", slog.Any("error", err))
+		os.Exit(1)
 	}
 }
-
-func toPtr[P *T, T any](t T) P { return &t }